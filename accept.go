@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"path"
+	"slices"
+	"strings"
+)
+
+// normalizeAccept splits the client's Accept values into one media range per
+// value and removes invalid and duplicate ones, preserving their order. Some
+// upstreams reject or mishandle repeated Accept values. If supported isn't
+// empty, only the supported media types are kept, with wildcards expanded to
+// the supported types they match.
+func normalizeAccept(values []string, supported []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	add := func(mediaType string, params map[string]string) {
+		if seen[mediaType] {
+			return
+		}
+		seen[mediaType] = true
+		normalized = append(normalized, mime.FormatMediaType(mediaType, params))
+	}
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || !strings.Contains(mediaType, "/") {
+				continue
+			}
+			if len(supported) == 0 {
+				add(mediaType, params)
+				continue
+			}
+			for _, s := range supported {
+				if ok, _ := path.Match(mediaType, s); ok {
+					add(s, params)
+				}
+			}
+		}
+	}
+	return slices.Clip(normalized)
+}
+
+// variantSuffix returns a suffix for the cache paths of manifests, which
+// differ by the normalized Accept values of the request. Upstreams may
+// respond with e.g. an OCI index or a Docker manifest depending on them.
+func variantSuffix(accept []string) string {
+	if len(accept) == 0 {
+		return ""
+	}
+	sorted := slices.Sorted(slices.Values(accept))
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return "#" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeAccept(t *testing.T) {
+	const (
+		manifest = "application/vnd.docker.distribution.manifest.v2+json"
+		index    = "application/vnd.oci.image.index.v1+json"
+	)
+	tests := []struct {
+		name      string
+		values    []string
+		supported []string
+		want      []string
+	}{
+		{"empty", nil, nil, nil},
+		{"duplicates", []string{manifest, index, manifest}, nil, []string{manifest, index}},
+		{"combined values", []string{manifest + ", " + index, " " + index}, nil, []string{manifest, index}},
+		{"case", []string{"Application/JSON", "application/json"}, nil, []string{"application/json"}},
+		{"invalid", []string{"", ",,", "garbage", "text/plain; =", manifest}, nil, []string{manifest}},
+		{"params", []string{"application/json; q=0.5", "application/json"}, nil, []string{"application/json; q=0.5"}},
+		{"intersect", []string{"text/html", index, manifest}, []string{manifest, index}, []string{index, manifest}},
+		{"wildcard", []string{"*/*"}, []string{manifest, index}, []string{manifest, index}},
+		{"partial wildcard", []string{"application/vnd.oci.*"}, []string{manifest, index}, []string{index}},
+		{"nothing supported", []string{"text/html"}, []string{manifest}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeAccept(tt.values, tt.supported))
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Cache decisions reported in access logs.
+const (
+	decisionHit               = "hit"
+	decisionMiss              = "miss"
+	decisionRevalidated       = "revalidated"
+	decisionStale             = "served-stale"
+	decisionStaleRevalidating = "stale-while-revalidate"
+)
+
+// accessLog collects what happened during a request, to be logged in a
+// single line once it is done.
+type accessLog struct {
+	cachePath      string
+	decision       string
+	upstreamStatus int
+	upstreamTTFB   time.Duration // until the upstream sent response headers
+	preflight      time.Duration // duration of the preflight, including fetching a token
+}
+
+type accessLogKey struct{}
+
+func withAccessLog(ctx context.Context, entry *accessLog) context.Context {
+	return context.WithValue(ctx, accessLogKey{}, entry)
+}
+
+// accessLogFromContext returns the access log entry of the request, or nil if
+// it isn't logged. All setters may be called on nil.
+func accessLogFromContext(ctx context.Context) *accessLog {
+	entry, _ := ctx.Value(accessLogKey{}).(*accessLog)
+	return entry
+}
+
+func (l *accessLog) setCachePath(cachePath string) {
+	if l != nil {
+		l.cachePath = cachePath
+	}
+}
+
+func (l *accessLog) setDecision(decision string) {
+	if l != nil {
+		l.decision = decision
+	}
+}
+
+func (l *accessLog) setUpstreamStatus(status int) {
+	if l != nil {
+		l.upstreamStatus = status
+	}
+}
+
+func (l *accessLog) setUpstreamTTFB(ttfb time.Duration) {
+	if l != nil {
+		l.upstreamTTFB = ttfb
+	}
+}
+
+func (l *accessLog) setPreflightDuration(d time.Duration) {
+	if l != nil {
+		l.preflight = d
+	}
+}
+
+// countingWriter records the status and body size of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess assigns a request ID to each request and logs one line
+// summarizing it once next is done. Errors returned by next are logged by the
+// caller, so the status is only known for successful requests.
+func (app *App) logAccess(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		start := time.Now()
+		id := requestID(r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+		entry := &accessLog{}
+		ctx := withAccessLog(withRequestID(r.Context(), id), entry)
+		r = r.WithContext(ctx)
+		cw := &countingWriter{ResponseWriter: w}
+		err := next(cw, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("registry", r.PathValue("registry")),
+			slog.String("path", r.PathValue("path")),
+			slog.Int64("bytes", cw.bytes),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if entry.cachePath != "" {
+			attrs = append(attrs, slog.String("cache_path", entry.cachePath))
+		}
+		if entry.decision != "" {
+			attrs = append(attrs, slog.String("decision", entry.decision))
+		}
+		if entry.upstreamStatus != 0 {
+			attrs = append(attrs, slog.Int("upstream_status", entry.upstreamStatus))
+		}
+		if entry.preflight != 0 {
+			attrs = append(attrs, slog.Duration("preflight_duration", entry.preflight))
+		}
+		if entry.upstreamTTFB != 0 {
+			attrs = append(attrs, slog.Duration("upstream_ttfb", entry.upstreamTTFB))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		} else {
+			attrs = append(attrs, slog.Int("status", cmp.Or(cw.status, http.StatusOK)))
+		}
+		requestLog(ctx).LogAttrs(ctx, slog.LevelInfo, "access", attrs...)
+		return err
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogRequestID(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len("hello")))
+		_, _ = w.Write([]byte("hello"))
+	})
+	handler := app.logAccess(app.proxy)
+	for _, clientID := range []string{"pull-1", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/test/foo/blobs/"+testDigest, nil)
+		req.SetPathValue("registry", "test")
+		req.SetPathValue("path", "foo/blobs/"+testDigest)
+		if clientID != "" {
+			req.Header.Set(requestIDHeader, clientID)
+		}
+		w := httptest.NewRecorder()
+		r.NoError(handler(w, req))
+		a.Equal("hello", w.Body.String())
+		if clientID != "" {
+			a.Equal(clientID, w.Header().Get(requestIDHeader))
+		} else {
+			a.NotEmpty(w.Header().Get(requestIDHeader))
+		}
+	}
+}
+
+func TestAccessLogDecision(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len("hello")))
+		_, _ = w.Write([]byte("hello"))
+	})
+	request := func() *accessLog {
+		entry := &accessLog{}
+		req := httptest.NewRequest(http.MethodGet, "/v2/test/foo/manifests/latest", nil)
+		req = req.WithContext(withAccessLog(context.Background(), entry))
+		req.SetPathValue("registry", "test")
+		req.SetPathValue("path", "foo/manifests/latest")
+		r.NoError(app.proxy(httptest.NewRecorder(), req))
+		return entry
+	}
+
+	entry := request()
+	a.Equal(decisionMiss, entry.decision)
+	a.Equal(http.StatusOK, entry.upstreamStatus)
+	a.Contains(entry.cachePath, "test/foo/manifests/latest")
+
+	app.unconditionalCacheTime = time.Hour
+	entry = request()
+	a.Equal(decisionHit, entry.decision)
+	a.Zero(entry.upstreamStatus)
+
+	app.unconditionalCacheTime = 0
+	entry = request()
+	a.Equal(decisionRevalidated, entry.decision)
+	a.Equal(http.StatusNotModified, entry.upstreamStatus)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/authenticvision/util-go/httpp"
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// adminAuth protects admin endpoints with HTTP basic auth. The user name is
+// always "admin".
+func (app *App) adminAuth(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "admin" ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(app.adminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cachistry admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return nil
+		}
+		return next(w, r)
+	}
+}
+
+var browseTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head><title>cachistry: /{{.Path}}</title></head>
+<body>
+<h1>/{{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th><th></th></tr>
+{{- if .Path}}
+<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+{{- if .IsDir}}
+<td><a href="{{.Name}}/">{{.Name}}/</a></td><td></td><td></td><td></td>
+{{- else}}
+<td><a href="{{.Name}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td><td><a href="{{.Name}}?meta">metadata</a></td>
+{{- end}}
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type browseEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// browse serves a read-only listing of the cache directory. Files are served
+// as-is, or as JSON metadata with the "meta" query parameter. Viewing files
+// does not count as access for eviction purposes.
+func (app *App) browse(w http.ResponseWriter, r *http.Request) error {
+	p := r.PathValue("path")
+	if p == "" {
+		p = "."
+	}
+	p = path.Clean(p)
+	if !fs.ValidPath(p) {
+		return httpp.NotFound("invalid path")
+	}
+	fsys := app.cache.FS()
+	info, err := fs.Stat(fsys, p)
+	if err != nil {
+		return httpp.NotFound("not found")
+	}
+
+	if !info.IsDir() {
+		if !r.URL.Query().Has("meta") {
+			// Cached objects are arbitrary upstream content, never render them
+			// in the browser on the admin origin.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Disposition", "attachment")
+			http.ServeFileFS(w, r, fsys, p)
+			return nil
+		}
+		cached, err := app.cache.Peek(p)
+		if err != nil {
+			return logutil.NewError(err, "read metadata")
+		} else if cached == nil {
+			return httpp.NotFound("not found")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(struct {
+			Path      string    `json:"path"`
+			Size      int64     `json:"size"`
+			Modified  time.Time `json:"modified"`
+			MIMEType  string    `json:"mime_type"`
+			ETag      string    `json:"etag"`
+			Validated time.Time `json:"validated"`
+		}{
+			Path:      p,
+			Size:      info.Size(),
+			Modified:  info.ModTime(),
+			MIMEType:  cached.MIMEType,
+			ETag:      cached.ETag,
+			Validated: cached.Validated,
+		})
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// relative links in the listing require a trailing slash
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return nil
+	}
+	dirEntries, err := fs.ReadDir(fsys, p)
+	if err != nil {
+		return logutil.NewError(err, "read dir")
+	}
+	entries := make([]browseEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		info, err := d.Info()
+		if err != nil {
+			continue // removed concurrently
+		}
+		entries = append(entries, browseEntry{
+			Name:    d.Name(),
+			IsDir:   d.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	if p == "." {
+		p = ""
+	} else {
+		p += "/"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return browseTemplate.Execute(w, struct {
+		Path    string
+		Entries []browseEntry
+	}{p, entries})
+}
+
+// setCacheSize changes the maximum size of the cache, excluding lower tiers,
+// to the max_bytes of the JSON request body. Lowering it evicts right away.
+// Responds with the cache stats afterwards. The change is lost on restart.
+func (app *App) setCacheSize(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		MaxBytes uint64 `json:"max_bytes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil || req.MaxBytes == 0 {
+		http.Error(w, `expected {"max_bytes": <positive size>}`, http.StatusBadRequest)
+		return nil
+	}
+	if err := app.cache.SetMaxBytes(req.MaxBytes); err != nil {
+		return logutil.NewError(err, "set cache size")
+	}
+	slog.Info("changed cache size", slog.Uint64("max_bytes", req.MaxBytes))
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.cache.Stats())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCacheApp(t *testing.T) *App {
+	app := newTestApp(http.DefaultClient)
+	var err error
+	app.cache, err = cache.NewCache(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	return app
+}
+
+func storeTestFile(t *testing.T, c *cache.Cache, path string, mimeType string, data string) {
+	r := require.New(t)
+	f, cleanup, err := c.Create(mimeType, `"etag"`, "", "")
+	r.NoError(err)
+	defer cleanup()
+	_, err = f.WriteString(data)
+	r.NoError(err)
+	r.NoError(c.Store(f, path, uint64(len(data))))
+}
+
+func browseRequest(app *App, path string, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/admin/browse/"+path+query, nil)
+	req.SetPathValue("path", path)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	err := app.adminAuth(app.browse)(w, req)
+	if err != nil {
+		w.Code = http.StatusNotFound
+	}
+	return w
+}
+
+func TestBrowse(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.adminPassword = "secret"
+	storeTestFile(t, app.cache, "ghcr.io/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", "{}")
+
+	w := browseRequest(app, "", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `<a href="ghcr.io/">ghcr.io/</a>`)
+
+	w = browseRequest(app, "ghcr.io/foo/manifests/", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `<a href="latest">latest</a>`)
+	a.Contains(w.Body.String(), `<a href="latest?meta">metadata</a>`)
+
+	w = browseRequest(app, "ghcr.io/foo/manifests/latest", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("{}", w.Body.String())
+	a.Equal("application/octet-stream", w.Header().Get("Content-Type"))
+	a.Equal("nosniff", w.Header().Get("X-Content-Type-Options"))
+	a.Equal("attachment", w.Header().Get("Content-Disposition"))
+
+	w = browseRequest(app, "ghcr.io/foo/manifests/latest", "?meta")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `"mime_type":"application/vnd.oci.image.index.v1+json"`)
+	a.Contains(w.Body.String(), `"etag":"\"etag\""`)
+}
+
+func TestBrowseTraversal(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.adminPassword = "secret"
+	for _, path := range []string{"../", "../../etc/passwd", "/etc/passwd", "ghcr.io/../../etc/passwd"} {
+		w := browseRequest(app, path, "")
+		a.Equal(http.StatusNotFound, w.Code, path)
+		a.NotContains(w.Body.String(), "root:", path)
+	}
+}
+
+func TestBrowseUnauthorized(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.adminPassword = "secret"
+	req := httptest.NewRequest(http.MethodGet, "/admin/browse/", nil)
+	req.SetBasicAuth("admin", "wrong")
+	w := httptest.NewRecorder()
+	a.NoError(app.adminAuth(app.browse)(w, req))
+	a.Equal(http.StatusUnauthorized, w.Code)
+	a.True(strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic"))
+}
+
+func TestSetCacheSize(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.adminPassword = "secret"
+	storeTestFile(t, app.cache, "ghcr.io/foo/blobs/a", "application/octet-stream", "aaaa")
+	storeTestFile(t, app.cache, "ghcr.io/foo/blobs/b", "application/octet-stream", "bbbb")
+	setSize := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/cache-size", strings.NewReader(body))
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		r.NoError(app.adminAuth(app.setCacheSize)(w, req))
+		return w
+	}
+
+	a.Equal(http.StatusBadRequest, setSize(`{"max_bytes":0}`).Code)
+	w := setSize(`{"max_bytes":6}`)
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `"max_bytes":6`)
+	stats := app.cache.Stats()
+	a.Equal(uint64(4), stats.UsedBytes)
+	cached, err := app.cache.Peek("ghcr.io/foo/blobs/a")
+	r.NoError(err)
+	a.Nil(cached, "least recently used file must be evicted")
+
+	setSize(`{"max_bytes":1048576}`)
+	a.Equal(uint64(1<<20), app.cache.Stats().MaxBytes)
+	a.Equal(uint64(4), app.cache.Stats().UsedBytes)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/fs"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/authenticvision/cachistry/cache"
+)
+
+// blobPathRe matches cache paths of blobs and captures their digest.
+var blobPathRe = regexp.MustCompile(`/blobs/([a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+)$`)
+
+func blobDigest(cachePath string) (string, bool) {
+	m := blobPathRe.FindStringSubmatch(cachePath)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// blobIndex maps blob digests to the cache paths storing them, across all
+// registries and repositories. Entries may be stale and are dropped when a
+// lookup finds them evicted.
+type blobIndex struct {
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+func newBlobIndex() *blobIndex {
+	return &blobIndex{paths: make(map[string][]string)}
+}
+
+// Add indexes cachePath if it is a blob.
+func (i *blobIndex) Add(cachePath string) {
+	digest, ok := blobDigest(cachePath)
+	if !ok {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !slices.Contains(i.paths[digest], cachePath) {
+		i.paths[digest] = append(i.paths[digest], cachePath)
+	}
+}
+
+func (i *blobIndex) Remove(cachePath string) {
+	digest, ok := blobDigest(cachePath)
+	if !ok {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	paths := slices.DeleteFunc(i.paths[digest], func(p string) bool {
+		return p == cachePath
+	})
+	if len(paths) == 0 {
+		delete(i.paths, digest)
+	} else {
+		i.paths[digest] = paths
+	}
+}
+
+func (i *blobIndex) Candidates(digest string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return slices.Clone(i.paths[digest])
+}
+
+// indexBlobs adds all blobs in the cache's first tier to the index.
+func (app *App) indexBlobs() error {
+	return fs.WalkDir(app.cache.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasPrefix(path, "-") {
+			return fs.SkipDir // temporary files
+		}
+		if !d.IsDir() {
+			app.blobs.Add(path)
+		}
+		return nil
+	})
+}
+
+// findBlob looks for a cached blob with the same digest as cachePath, which
+// may be stored for another registry or repository, but not for other
+// client credentials if they are forwarded to upstreams.
+func (app *App) findBlob(cachePath string) (string, *cache.Cached, error) {
+	digest, ok := blobDigest(cachePath)
+	if !ok {
+		return "", nil, nil
+	}
+	for _, candidate := range app.blobs.Candidates(digest) {
+		if candidate == cachePath || pathNamespace(candidate) != pathNamespace(cachePath) {
+			continue
+		}
+		cached, err := app.cache.Get(candidate)
+		if err != nil {
+			return "", nil, err
+		} else if cached == nil {
+			app.blobs.Remove(candidate)
+			continue
+		}
+		return candidate, cached, nil
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDigest = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestBlobDigest(t *testing.T) {
+	a := assert.New(t)
+	digest, ok := blobDigest("docker.io/library/ubuntu/blobs/" + testDigest)
+	a.True(ok)
+	a.Equal(testDigest, digest)
+	_, ok = blobDigest("docker.io/library/ubuntu/manifests/latest")
+	a.False(ok)
+	_, ok = blobDigest("docker.io/library/ubuntu/blobs/uploads")
+	a.False(ok)
+}
+
+func TestCrossRegistryBlob(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	storeTestFile(t, app.cache, "docker.io/library/ubuntu/blobs/"+testDigest, "application/octet-stream", "hello")
+	app.blobs = newBlobIndex()
+	r.NoError(app.indexBlobs())
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/ghcr.io/org/ubuntu/blobs/"+testDigest, nil)
+	req.SetPathValue("registry", "ghcr.io")
+	req.SetPathValue("path", "org/ubuntu/blobs/"+testDigest)
+	w := httptest.NewRecorder()
+	r.NoError(app.proxy(w, req))
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("hello", w.Body.String())
+	r.Equal("application/octet-stream", w.Header().Get("Content-Type"))
+}
+
+func TestBlobIndexStale(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	app.blobs = newBlobIndex()
+	app.blobs.Add("docker.io/library/ubuntu/blobs/" + testDigest)
+	otherPath, cached, err := app.findBlob("ghcr.io/org/ubuntu/blobs/" + testDigest)
+	r.NoError(err)
+	r.Nil(cached)
+	r.Empty(otherPath)
+	r.Empty(app.blobs.Candidates(testDigest))
+}
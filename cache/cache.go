@@ -3,11 +3,14 @@ package cache
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
+	"math"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -19,53 +22,150 @@ import (
 
 type Cache struct {
 	root *os.Root
+	meta metadataStore
 
 	files     files
+	paths     pathLocks // serializes storing and evicting a path
 	usedBytes uint64
-	maxBytes  uint64
+	maxBytes  uint64 // accessed atomically, see SetMaxBytes
+	maxFiles  int64  // accessed atomically, 0 for unlimited, see SetMaxFiles
+	hits      uint64
+	misses    uint64
+
+	unavailable atomic.Bool // since an operation failed with ErrUnavailable, until CheckWritable passes
+
+	// Eviction starts when usage would exceed highWatermark and evicts down
+	// to lowWatermark, both relative to maxBytes and maxFiles.
+	highWatermark float64
+	lowWatermark  float64
+
+	storeRetries  int
+	pinned        []string          // path patterns never to evict, see SetPinned
+	compressTypes []string          // MIME type patterns to compress, see SetCompressTypes
+	sync          bool              // fsync files and directories when storing
+	accountBlocks bool              // account allocated blocks instead of logical size
+	readOnly      bool              // never modify the cache directory, see Tier.ReadOnly
+	onRemove      func(path string) // see SetOnRemove
+
+	next *Cache // lower tier receiving evicted files, if any
 }
 
 const tmpDir = "-/tmp"
 
+// Storing, evicting and probing the cache root go through these, which tests
+// replace to simulate file system errors.
+var (
+	renameInRoot = (*os.Root).Rename
+	removeInRoot = (*os.Root).Remove
+	statInRoot   = (*os.Root).Stat
+)
+
+// ErrReadOnly is returned by methods modifying a read-only cache.
+var ErrReadOnly = errors.New("cache is read-only")
+
 func NewCache(path string, maxSizeBytes uint64) (*Cache, error) {
+	return newCache(Tier{Path: path, MaxBytes: maxSizeBytes})
+}
+
+func newCache(tier Tier) (*Cache, error) {
+	path := tier.Path
 	r, err := os.OpenRoot(path)
 	if err != nil {
 		return nil, fmt.Errorf("openroot: %w", err)
 	}
 	c := &Cache{
-		root:     r,
-		maxBytes: maxSizeBytes,
+		root:          r,
+		maxBytes:      tier.MaxBytes,
+		highWatermark: 1,
+		lowWatermark:  1,
+		storeRetries:  1,
+		accountBlocks: tier.AccountBlocks,
+		readOnly:      tier.ReadOnly,
 	}
-	err = c.root.MkdirAll(tmpDir, 0777)
+	if tier.ReadOnly {
+		c.meta, err = detectMetadataStore(c.root)
+		if err != nil {
+			return nil, fmt.Errorf("detect metadata store: %w", err)
+		}
+	} else {
+		err = c.root.MkdirAll(tmpDir, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("mkdir tmp: %w", err)
+		}
+		c.meta, err = newMetadataStore(c.root)
+		if err != nil {
+			return nil, fmt.Errorf("probe xattr support: %w", err)
+		}
+	}
+	if _, ok := c.meta.(sidecarStore); ok {
+		slog.Info("file system does not support xattrs, using sidecar metadata files", slog.String("path", path))
+	}
+	var torn int
+	var loaded []file
+	journal, err := c.loadJournal()
 	if err != nil {
-		return nil, fmt.Errorf("mkdir tmp: %w", err)
+		slog.Warn("failed to load LRU journal, using access times", slog.Any("error", err))
+		journal = map[string]journalEntry{}
 	}
 	err = fs.WalkDir(c.root.FS(), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+		if err != nil {
 			return err
 		}
+		if d.IsDir() {
+			return nil
+		}
 		if strings.HasPrefix(path, tmpDir+"/") {
+			if c.readOnly {
+				return nil
+			}
 			err := c.root.Remove(path)
 			if err != nil {
 				return err
 			}
 			return nil
 		}
+		if isSidecar(path) || path == journalPath || path == secretPath {
+			return nil
+		}
 		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		c.files.InsertOrReplace(file{
+		if c.torn(path, info) {
+			torn++
+			if c.readOnly {
+				return nil // left for the writer to clean up
+			}
+			if err := c.root.Remove(path); err != nil {
+				return err
+			}
+			_ = c.meta.remove(path)
+			return nil
+		}
+		size := c.sizeOf(info)
+		entry, ok := journal[path]
+		if !ok {
+			entry.LastAccessed = atime(info)
+		}
+		loaded = append(loaded, file{
 			path:         path,
-			size:         uint64(info.Size()),
-			lastAccessed: atime(info),
+			size:         size,
+			lastAccessed: entry.LastAccessed,
+			accesses:     entry.Accesses,
 		})
-		atomic.AddUint64(&c.usedBytes, uint64(info.Size()))
+		atomic.AddUint64(&c.usedBytes, size)
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("walk storage dir: %w", err)
 	}
+	c.files.Load(loaded)
+	if torn > 0 {
+		slog.Warn("removed files not fully written before an unclean shutdown",
+			slog.String("path", path),
+			slog.Int("files", torn),
+		)
+	}
 	slog.Info(
 		"cache initialized",
 		slog.String("path", path),
@@ -74,64 +174,301 @@ func NewCache(path string, maxSizeBytes uint64) (*Cache, error) {
 	return c, nil
 }
 
+// SetWatermarks configures batched eviction for this cache and all lower
+// tiers: Once usage would exceed high (a fraction of the maximum size), files
+// are evicted until usage drops to low. The default of 1 for both evicts just
+// enough to make room for each stored file.
+func (c *Cache) SetWatermarks(high, low float64) error {
+	if !(0 < low && low <= high && high <= 1) {
+		return fmt.Errorf("invalid watermarks %v/%v, need 0 < low <= high <= 1", high, low)
+	}
+	for tier := c; tier != nil; tier = tier.next {
+		tier.highWatermark = high
+		tier.lowWatermark = low
+	}
+	return nil
+}
+
+// SetMaxBytes changes the maximum size of this cache at runtime, leaving lower
+// tiers as they are. Lowering it evicts files down to the new size right away.
+func (c *Cache) SetMaxBytes(maxBytes uint64) error {
+	if maxBytes == 0 {
+		return errors.New("cache size must be positive")
+	}
+	atomic.StoreUint64(&c.maxBytes, maxBytes)
+	return c.evict(maxBytes, c.filesTarget(0))
+}
+
+// EnforceLimits evicts files from this cache and all lower tiers until each
+// is within its maximum size and file count again, e.g. when files were
+// stored while usage was accounted too low.
+func (c *Cache) EnforceLimits() error {
+	for tier := c; tier != nil; tier = tier.next {
+		if err := tier.evict(atomic.LoadUint64(&tier.maxBytes), tier.filesTarget(0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMaxFiles limits the number of files in this cache, leaving lower tiers
+// as they are, 0 for unlimited. Caches of many small files may exhaust inodes
+// or take long to scan on startup without reaching their maximum size.
+// Lowering it evicts files down to the new count right away.
+func (c *Cache) SetMaxFiles(maxFiles int) error {
+	if maxFiles < 0 {
+		return errors.New("file count limit must not be negative")
+	}
+	atomic.StoreInt64(&c.maxFiles, int64(maxFiles))
+	return c.evict(atomic.LoadUint64(&c.maxBytes), c.filesTarget(0))
+}
+
+// filesTarget returns how many files eviction keeps to make room for room
+// more files, math.MaxInt without a limit.
+func (c *Cache) filesTarget(room int) int {
+	maxFiles := int(atomic.LoadInt64(&c.maxFiles))
+	if maxFiles == 0 {
+		return math.MaxInt
+	}
+	return max(0, int(c.lowWatermark*float64(maxFiles))-room)
+}
+
 func (c *Cache) statAttr() slog.Attr {
 	used := atomic.LoadUint64(&c.usedBytes)
+	maxBytes := atomic.LoadUint64(&c.maxBytes)
 	return slog.GroupAttrs("stats",
-		slog.Float64("used_percent", 100*float64(used)/float64(c.maxBytes)),
+		slog.Float64("used_percent", 100*float64(used)/float64(maxBytes)),
 		slog.String("used", fmtutil.FormatBytes(used)),
-		slog.String("max", fmtutil.FormatBytes(c.maxBytes)),
+		slog.String("max", fmtutil.FormatBytes(maxBytes)),
 	)
 }
 
+type Stats struct {
+	UsedBytes uint64 `json:"used_bytes"`
+	MaxBytes  uint64 `json:"max_bytes"`
+	Files     int    `json:"files"`
+	MaxFiles  int    `json:"max_files,omitempty"` // 0 for unlimited
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Lower     *Stats `json:"lower,omitempty"` // next lower tier
+
+	// PinnedFiles and PinnedBytes are the part of Files and UsedBytes which
+	// is never evicted.
+	PinnedFiles int    `json:"pinned_files,omitempty"`
+	PinnedBytes uint64 `json:"pinned_bytes,omitempty"`
+}
+
+// Stats returns a snapshot of the cache's usage and hit/miss counters as
+// recorded by Get.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		UsedBytes: atomic.LoadUint64(&c.usedBytes),
+		MaxBytes:  atomic.LoadUint64(&c.maxBytes),
+		Files:     c.files.Len(),
+		MaxFiles:  int(atomic.LoadInt64(&c.maxFiles)),
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+	}
+	stats.PinnedFiles, stats.PinnedBytes = c.files.Pinned()
+	if c.next != nil {
+		lower := c.next.Stats()
+		stats.Lower = &lower
+	}
+	return stats
+}
+
+// CheckWritable verifies that files can be created and removed in this cache
+// and all lower tiers, which fails e.g. when the file system became read-only
+// or was unmounted. Read-only caches are only checked to be readable. Errors
+// wrap ErrUnavailable if the cache directory is gone.
+func (c *Cache) CheckWritable() error {
+	for tier := c; tier != nil; tier = tier.next {
+		if err := tier.wrapUnavailable(tier.checkWritable()); err != nil {
+			return err
+		}
+		if tier.unavailable.CompareAndSwap(true, false) {
+			slog.Info("cache directory available again", slog.String("path", tier.root.Name()))
+		}
+	}
+	return nil
+}
+
+// checkWritable does the check of CheckWritable for this tier only.
+func (c *Cache) checkWritable() error {
+	if c.readOnly {
+		_, err := fs.ReadDir(c.root.FS(), ".")
+		return err
+	}
+	path := fmt.Sprintf("%s/health-%d", tmpDir, rand.Uint64())
+	err := c.root.WriteFile(path, nil, 0666)
+	if err != nil {
+		return err
+	}
+	return c.root.Remove(path)
+}
+
 const xattrMIME = "user.com.authenticvision.cachistry.mimetype"
 const xattrETag = "user.com.authenticvision.cachistry.etag"
-const xattrValidated = "user.com.authenticvision.cachistry.validated" // timestamp when ETag was last verified (RFC 3339)
+const xattrValidated = "user.com.authenticvision.cachistry.validated"       // timestamp when ETag was last verified (RFC 3339)
+const xattrSize = "user.com.authenticvision.cachistry.size"                 // size passed to Store, to detect torn writes
+const xattrDigest = "user.com.authenticvision.cachistry.digest"             // Docker-Content-Digest sent by the upstream, optional
+const xattrLastModified = "user.com.authenticvision.cachistry.lastmodified" // Last-Modified sent by the upstream, optional
 
 type Cached struct {
 	MIMEType  string
 	ETag      string
 	Validated time.Time
+	// Digest is the Docker-Content-Digest sent by the upstream, or empty if
+	// it sent none.
+	Digest string
+	// LastModified is the Last-Modified header sent by the upstream, or empty
+	// if it sent none.
+	LastModified string
 }
 
 // Get checks if path is in cache and if so, updates its atime and returns its
-// mime type, ETag and last validation time.
+// mime type, ETag and last validation time. Files found in a lower tier are
+// promoted into this tier first. Read-only caches keep the atime and don't
+// promote files. Errors wrap ErrUnavailable if the cache directory is gone.
 func (c *Cache) Get(path string) (*Cached, error) {
-	err := c.root.Chtimes(path, time.Now(), time.Time{})
+	cached, err := c.get(path)
+	return cached, c.wrapUnavailable(err)
+}
+
+func (c *Cache) get(path string) (*Cached, error) {
+	now := time.Now()
+	var err error
+	if c.readOnly {
+		_, err = c.root.Stat(path)
+	} else {
+		err = c.root.Chtimes(path, now, time.Time{})
+	}
+	if errors.Is(err, fs.ErrNotExist) && c.readOnly && c.next != nil {
+		return c.next.Get(path)
+	} else if errors.Is(err, fs.ErrNotExist) && c.next != nil {
+		var promoted bool
+		promoted, err = c.promote(path)
+		if err != nil {
+			return nil, fmt.Errorf("promote: %w", err)
+		} else if !promoted {
+			err = fs.ErrNotExist
+		}
+	}
 	if errors.Is(err, fs.ErrNotExist) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cached, err := c.metadata(path)
+	if errors.Is(err, errMissingMetadata) && c.readOnly {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, nil
+	} else if errors.Is(err, errMissingMetadata) {
+		// e.g. written by an older version or copied without xattrs, the
+		// file can't be served without its metadata
+		slog.Debug("evicting file with missing metadata",
+			slog.String("path", path),
+			slog.Any("error", err),
+		)
+		if err := c.remove(path); err != nil {
+			return nil, fmt.Errorf("remove file with missing metadata: %w", err)
+		}
+		atomic.AddUint64(&c.misses, 1)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.files.Touch(path, now)
+	return cached, nil
+}
+
+// Peek is like Get, but leaves the access time and eviction order of path
+// alone, so that maintenance like listings and scans over many files doesn't
+// make cold files look hot. Files in lower tiers are found, but not promoted.
+// Files with missing metadata are reported as not found, but not evicted.
+func (c *Cache) Peek(path string) (*Cached, error) {
+	_, err := c.root.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) && c.next != nil {
+		return c.next.Peek(path)
+	} else if errors.Is(err, fs.ErrNotExist) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	mimeType, err := getXAttr(c.absoluteInRoot(path), xattrMIME)
+	cached, err := c.metadata(path)
+	if errors.Is(err, errMissingMetadata) {
+		return nil, nil
+	}
+	return cached, err
+}
+
+func (c *Cache) metadata(path string) (*Cached, error) {
+	mimeType, err := c.meta.get(path, xattrMIME)
 	if err != nil {
 		return nil, err
 	}
-	validatedStr, err := getXAttr(c.absoluteInRoot(path), xattrValidated)
+	validatedStr, err := c.meta.get(path, xattrValidated)
 	if err != nil {
 		return nil, err
 	}
 	validated, err := time.Parse(time.RFC3339, validatedStr)
 	if err != nil {
-		return nil, err
+		// A corrupted timestamp must not break serving, so treat the entry
+		// as never validated instead, which forces a revalidation.
+		slog.Warn("unparseable validation timestamp, forcing revalidation",
+			slog.String("path", path),
+			slog.String("validated", validatedStr),
+		)
+		validated = time.Time{}
 	}
-	eTag, err := getXAttr(c.absoluteInRoot(path), xattrETag)
+	eTag, err := c.meta.get(path, xattrETag)
 	if err != nil {
 		return nil, err
 	}
+	// Files stored by older versions have no digest.
+	digest, err := c.meta.get(path, xattrDigest)
+	if err != nil && !errors.Is(err, errMissingMetadata) {
+		return nil, err
+	}
+	lastModified, err := c.meta.get(path, xattrLastModified)
+	if err != nil && !errors.Is(err, errMissingMetadata) {
+		return nil, err
+	}
 	return &Cached{
-		MIMEType:  mimeType,
-		ETag:      eTag,
-		Validated: validated,
+		MIMEType:     mimeType,
+		ETag:         eTag,
+		Validated:    validated,
+		Digest:       digest,
+		LastModified: lastModified,
 	}, nil
 }
 
+// ReadOnly reports whether the cache was opened read-only, see Tier.ReadOnly.
+func (c *Cache) ReadOnly() bool {
+	return c.readOnly
+}
+
+// FS returns the files of this cache, excluding lower tiers. Files stored
+// compressed are read decompressed.
 func (c *Cache) FS() fs.FS {
-	return c.root.FS()
+	return cacheFS{c}
 }
 
 type TempRemover func()
 
-func (c *Cache) Create(mimeType string, eTag string) (*os.File, TempRemover, error) {
+// Create returns a temporary file to be passed to Store, along with the
+// metadata to store for it. Empty digest and lastModified aren't stored.
+func (c *Cache) Create(mimeType string, eTag string, digest string, lastModified string) (*os.File, TempRemover, error) {
+	f, tempRemover, err := c.create(mimeType, eTag, digest, lastModified)
+	return f, tempRemover, c.wrapUnavailable(err)
+}
+
+func (c *Cache) create(mimeType string, eTag string, digest string, lastModified string) (*os.File, TempRemover, error) {
+	if c.readOnly {
+		return nil, nil, ErrReadOnly
+	}
 	path := fmt.Sprintf("%s/%d", tmpDir, rand.Uint64())
 	f, err := c.root.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
 	if err != nil {
@@ -140,41 +477,99 @@ func (c *Cache) Create(mimeType string, eTag string) (*os.File, TempRemover, err
 	tempRemover := func() {
 		_ = f.Close()
 		_ = c.root.Remove(path)
+		_ = c.meta.remove(path)
 	}
-	if err = setXAttr(f.Name(), xattrMIME, mimeType); err != nil {
+	if err = c.meta.set(path, xattrMIME, mimeType); err != nil {
 		return nil, tempRemover, err
 	}
-	if err = setXAttr(f.Name(), xattrETag, eTag); err != nil {
+	if err = c.meta.set(path, xattrETag, eTag); err != nil {
 		return nil, tempRemover, err
 	}
-	if err := c.UpdateValidated(c.relativeToRoot(f.Name())); err != nil {
+	if digest != "" {
+		if err = c.meta.set(path, xattrDigest, digest); err != nil {
+			return nil, tempRemover, err
+		}
+	}
+	if lastModified != "" {
+		if err = c.meta.set(path, xattrLastModified, lastModified); err != nil {
+			return nil, tempRemover, err
+		}
+	}
+	if err := c.UpdateValidated(path); err != nil {
 		return nil, tempRemover, err
 	}
 	return f, tempRemover, nil
 }
 
-// Store moves a temporary file into place, overriding previously existing files
+// Store moves a temporary file into place, overriding previously existing files.
+// Concurrent stores of the same path are serialized, the last one wins and is
+// the only one accounted for.
 func (c *Cache) Store(f *os.File, path string, size uint64) error {
-	err := c.evict(size)
+	return c.wrapUnavailable(c.store(f, path, size))
+}
+
+func (c *Cache) store(f *os.File, path string, size uint64) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	var err error
+	size, err = c.compress(f, size)
 	if err != nil {
-		return fmt.Errorf("evict: %w", err)
+		return fmt.Errorf("compress: %w", err)
+	}
+	unlock := c.paths.Lock(path)
+	defer unlock()
+	maxBytes := atomic.LoadUint64(&c.maxBytes)
+	maxFiles := int(atomic.LoadInt64(&c.maxFiles))
+	// Replacing a file doesn't add one, but evicting one too many then is
+	// cheaper than checking.
+	tooMany := maxFiles > 0 && c.files.Len()+1 > int(c.highWatermark*float64(maxFiles))
+	if tooMany || atomic.LoadUint64(&c.usedBytes)+size > uint64(c.highWatermark*float64(maxBytes)) {
+		target := uint64(c.lowWatermark * float64(maxBytes))
+		target -= min(target, size)
+		err := c.evict(target, c.filesTarget(1))
+		if err != nil {
+			return fmt.Errorf("evict: %w", err)
+		}
 	}
-	err = c.root.MkdirAll(filepath.Dir(path), fs.ModePerm)
+	err = c.meta.set(c.relativeToRoot(f.Name()), xattrSize, strconv.FormatUint(size, 10))
 	if err != nil {
 		return err
 	}
+	if c.sync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
 	err = f.Close()
 	if err != nil {
 		return err
 	}
-	err = c.root.Rename(c.relativeToRoot(f.Name()), path)
+	err = c.commit(f.Name(), path)
+	// The file system may run out of space before the configured cache size
+	// is reached, e.g. when shared with other data. Evicting files to make
+	// room for the new file may help then.
+	for attempt := 0; isNoSpace(err) && attempt < c.storeRetries; attempt++ {
+		if err := c.reclaim(size, slog.String("path", path), slog.Int("attempt", attempt+1)); err != nil {
+			return fmt.Errorf("evict: %w", err)
+		}
+		err = c.commit(f.Name(), path)
+	}
 	if err != nil {
 		return err
 	}
+	if c.accountBlocks {
+		info, err := c.root.Stat(path)
+		if err != nil {
+			return err
+		}
+		size = allocatedSize(info)
+	}
 	if old, replaced := c.files.InsertOrReplace(file{
 		path:         path,
 		size:         size,
 		lastAccessed: time.Now(),
+		accesses:     1,
 	}); replaced {
 		atomicSubtract(&c.usedBytes, old.size)
 	}
@@ -182,49 +577,295 @@ func (c *Cache) Store(f *os.File, path string, size uint64) error {
 	return nil
 }
 
+// commit moves the temporary file tmpName into place.
+func (c *Cache) commit(tmpName string, path string) error {
+	err := c.root.MkdirAll(filepath.Dir(path), fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.relativeToRoot(tmpName)
+	err = c.meta.rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	err = renameInRoot(c.root, tmpPath, path)
+	if err != nil {
+		_ = c.meta.rename(path, tmpPath)
+		return err
+	}
+	if c.sync {
+		return c.syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncDir makes renames into dir durable.
+func (c *Cache) syncDir(dir string) error {
+	d, err := c.root.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// torn reports whether a file's size differs from the size it was stored
+// with, e.g. because its data didn't reach the disk before a power loss.
+func (c *Cache) torn(path string, info fs.FileInfo) bool {
+	sizeStr, err := c.meta.get(path, xattrSize)
+	if err != nil {
+		// stored by an older version, only empty files are suspicious
+		return info.Size() == 0
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	return err != nil || size != info.Size()
+}
+
+// SetEvictionPolicy configures which files are evicted first from this cache
+// and all lower tiers. The default is EvictLRU.
+func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) error {
+	for tier := c; tier != nil; tier = tier.next {
+		if err := tier.files.SetPolicy(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSync configures whether this cache and all lower tiers fsync files and
+// their directories when storing them. Without it, files stored shortly
+// before a power loss may be torn, which NewCache detects and discards.
+func (c *Cache) SetSync(sync bool) {
+	for tier := c; tier != nil; tier = tier.next {
+		tier.sync = sync
+	}
+}
+
+// SetOnRemove registers fn to be called with the path of each file evicted or
+// otherwise removed from this cache, but not lower tiers, so that copies of
+// it kept elsewhere can be dropped.
+func (c *Cache) SetOnRemove(fn func(path string)) {
+	c.onRemove = fn
+}
+
+func (c *Cache) removed(path string) {
+	if c.onRemove != nil {
+		c.onRemove(path)
+	}
+}
+
+// Touch records an access of path for its eviction order, like Get does, for
+// files served from a copy kept elsewhere.
+func (c *Cache) Touch(path string) {
+	c.files.Touch(path, time.Now())
+}
+
+// SetStoreRetries configures how often Store evicts files and retries when the
+// file system runs out of space.
+func (c *Cache) SetStoreRetries(n int) {
+	for tier := c; tier != nil; tier = tier.next {
+		tier.storeRetries = n
+	}
+}
+
+// reclaim evicts files after the file system ran out of space, freeing at
+// least size bytes and a tenth of the cache. Running out of space below the
+// cache size means that the accounted usage drifted from actual usage.
+func (c *Cache) reclaim(size uint64, attrs ...any) error {
+	used := atomic.LoadUint64(&c.usedBytes)
+	maxBytes := atomic.LoadUint64(&c.maxBytes)
+	attrs = append(attrs,
+		slog.Uint64("used_bytes", used),
+		slog.Uint64("max_bytes", maxBytes),
+	)
+	slog.Warn("out of disk space, cache accounting may have drifted, evicting and retrying", attrs...)
+	return c.evict(used-min(used, max(size, maxBytes/10)), math.MaxInt)
+}
+
+// ReclaimingWriter returns a writer for a file of the given size created by
+// Create. When writing fails because the file system ran out of space, it
+// evicts files and retries once.
+func (c *Cache) ReclaimingWriter(w io.Writer, size uint64) io.Writer {
+	return &reclaimingWriter{cache: c, w: w, size: size}
+}
+
+type reclaimingWriter struct {
+	cache *Cache
+	w     io.Writer
+	size  uint64
+}
+
+func (w *reclaimingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if !isNoSpace(err) {
+		return n, err
+	}
+	if err := w.cache.reclaim(w.size); err != nil {
+		return n, fmt.Errorf("evict: %w", err)
+	}
+	m, err := w.w.Write(p[n:])
+	return n + m, err
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
 func atomicSubtract(addr *uint64, delta uint64) uint64 {
 	return atomic.AddUint64(addr, ^(delta - 1))
 }
 
 func (c *Cache) UpdateValidated(path string) error {
-	return setXAttr(c.absoluteInRoot(path), xattrValidated, time.Now().UTC().Format(time.RFC3339))
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	// Sidecars would be written for files evicted concurrently.
+	if _, err := c.root.Stat(path); err != nil {
+		return err
+	}
+	return c.meta.set(path, xattrValidated, time.Now().UTC().Format(time.RFC3339))
 }
 
-func (c *Cache) evict(size uint64) error {
-	if atomic.LoadUint64(&c.usedBytes)+size <= c.maxBytes {
+// evict removes the least recently accessed files until at most target bytes
+// are used by at most targetFiles files. Pinned files and files which fail to
+// be removed are skipped, the latter so that a single one can't block caching
+// for good. This only fails if skipping them left too much in the cache.
+// Read-only caches may exceed their limits, nothing is evicted from them.
+func (c *Cache) evict(target uint64, targetFiles int) error {
+	if c.readOnly || !c.overLimits(target, targetFiles) {
 		return nil
 	}
-	toEvict := int64(size)
+	var evicted uint64
+	var removeErr error
+	var skippedPinned bool
+	failed := make(map[string]bool)
 	before := c.statAttr()
-	err := c.files.Range(func(f file) error {
-		slog.Debug("evicting file",
-			slog.String("path", f.path),
-			slog.String("size", fmtutil.FormatBytes(f.size)),
-		)
-		err := c.root.Remove(f.path)
-		if errors.Is(err, fs.ErrNotExist) {
-			return nil
-		} else if err != nil {
-			return err
+	for c.overLimits(target, targetFiles) {
+		victims, pinned := c.pickVictims(target, targetFiles, failed)
+		skippedPinned = skippedPinned || pinned
+		if len(victims) == 0 {
+			break
 		}
-		atomicSubtract(&c.usedBytes, f.size)
-		toEvict -= int64(f.size)
-		if toEvict <= 0 {
-			return errRangeDone
+		for _, v := range victims {
+			if err := c.evictFile(v.file); err != nil {
+				slog.Warn("failed to evict file, skipping it",
+					slog.String("path", v.path),
+					slog.Any("error", err),
+				)
+				removeErr = err
+				failed[v.path] = true
+				c.files.InsertOrReplace(v.file)
+			} else {
+				evicted += v.size
+			}
+			v.unlock()
+		}
+	}
+	if c.overLimits(target, targetFiles) {
+		if removeErr != nil {
+			return fmt.Errorf("remove files: %w", removeErr)
+		} else if skippedPinned {
+			return errOnlyPinned
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 	slog.Debug("evicted files from cache",
 		slog.Any("before", before),
 		slog.Any("after", c.statAttr()),
-		slog.String("deleted", fmtutil.FormatBytes(uint64(int64(size)-toEvict))),
+		slog.String("deleted", fmtutil.FormatBytes(evicted)),
 	)
 	return nil
 }
 
+// overLimits reports whether more than target bytes or targetFiles files are
+// used. Files stored concurrently may make this a little off, which only
+// matters for whether one more file is evicted.
+func (c *Cache) overLimits(target uint64, targetFiles int) bool {
+	return atomic.LoadUint64(&c.usedBytes) > target || c.files.Len() > targetFiles
+}
+
+// victim is a file picked for eviction, with its path locked.
+type victim struct {
+	file
+	unlock func()
+}
+
+// pickVictims takes the least valuable files off the list until evicting
+// them would meet the limits. Only picking happens while the list is locked,
+// evicting files takes disk I/O which lookups and stores of other files
+// shouldn't wait for. Paths in skip are left alone.
+func (c *Cache) pickVictims(target uint64, targetFiles int, skip map[string]bool) (victims []victim, skippedPinned bool) {
+	used := atomic.LoadUint64(&c.usedBytes)
+	count := c.files.Len()
+	_ = c.files.Range(func(f file) (bool, error) {
+		if skip[f.path] {
+			return false, nil
+		}
+		if f.pinned {
+			skippedPinned = true
+			return false, nil
+		}
+		// A path which is being stored concurrently is about to be replaced,
+		// evicting it could delete the new file.
+		unlock, ok := c.paths.TryLock(f.path)
+		if !ok {
+			slog.Debug("skipping eviction of file being stored", slog.String("path", f.path))
+			return false, nil
+		}
+		victims = append(victims, victim{file: f, unlock: unlock})
+		used -= min(used, f.size)
+		count--
+		if used <= target && count <= targetFiles {
+			return true, errRangeDone
+		}
+		return true, nil
+	})
+	return victims, skippedPinned
+}
+
+// evictFile removes f, which has been taken off the list, moving it to the
+// next tier if there is one. The file is moved aside first, so that nothing
+// finds it in this tier anymore while it is copied to the next one.
+func (c *Cache) evictFile(f file) error {
+	slog.Debug("evicting file",
+		slog.String("path", f.path),
+		slog.String("size", fmtutil.FormatBytes(f.size)),
+	)
+	aside := fmt.Sprintf("%s/%d", tmpDir, rand.Uint64())
+	err := c.meta.rename(f.path, aside)
+	if err != nil {
+		return err
+	}
+	err = renameInRoot(c.root, f.path, aside)
+	if err != nil {
+		_ = c.meta.rename(aside, f.path)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		_ = c.meta.remove(f.path)
+		atomicSubtract(&c.usedBytes, f.size)
+		c.removed(f.path)
+		return nil
+	}
+	atomicSubtract(&c.usedBytes, f.size)
+	c.removed(f.path)
+	defer func() {
+		_ = removeInRoot(c.root, aside)
+		_ = c.meta.remove(aside)
+	}()
+	// keeps sweeping temporary files from deleting it while it is copied
+	now := time.Now()
+	_ = c.root.Chtimes(aside, now, now)
+	if c.next != nil {
+		if err := c.copyTo(c.next, aside, f.path); err != nil {
+			slog.Warn("failed to demote file to lower tier, dropping it",
+				slog.String("path", f.path),
+				slog.Any("error", err),
+			)
+		}
+	}
+	return nil
+}
+
 func (c *Cache) relativeToRoot(path string) string {
 	root := c.root.Name()
 	if strings.HasPrefix(path, root) {
@@ -236,9 +877,9 @@ func (c *Cache) relativeToRoot(path string) string {
 	return path
 }
 
-func (c *Cache) absoluteInRoot(path string) string {
+func absoluteInRoot(root *os.Root, path string) string {
 	sanitized := filepath.Join("/", path)
-	return filepath.Join(c.root.Name(), sanitized)
+	return filepath.Join(root.Name(), sanitized)
 }
 
 func getXAttr(path string, attr string) (string, error) {
@@ -258,6 +899,26 @@ func setXAttr(path string, attr string, data string) error {
 	return nil
 }
 
+func (c *Cache) sizeOf(info os.FileInfo) uint64 {
+	if c.accountBlocks {
+		return allocatedSize(info)
+	}
+	return uint64(info.Size())
+}
+
+// allocatedSize returns the disk space used by a file, which includes rounding
+// up to the file system's block size.
+func allocatedSize(info os.FileInfo) uint64 {
+	switch stat := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return uint64(stat.Blocks) * 512
+	case *unix.Stat_t:
+		return uint64(stat.Blocks) * 512
+	default:
+		return uint64(info.Size())
+	}
+}
+
 func atime(info os.FileInfo) time.Time {
 	switch stat := info.Sys().(type) {
 	case *syscall.Stat_t:
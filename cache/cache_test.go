@@ -1,12 +1,1024 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestPathSanitize(t *testing.T) {
 	require.Equal(t, "/test/asdf", filepath.Join("/test", filepath.Join("/", "../../asdf")))
 }
+
+func newTestCache(t *testing.T, maxBytes uint64) *Cache {
+	c, err := NewCache(t.TempDir(), maxBytes)
+	require.NoError(t, err)
+	return c
+}
+
+func storeTestFile(t *testing.T, c *Cache, path string, data string) {
+	r := require.New(t)
+	f, cleanup, err := c.Create("application/octet-stream", `"etag"`, "", "")
+	r.NoError(err)
+	defer cleanup()
+	_, err = f.WriteString(data)
+	r.NoError(err)
+	r.NoError(c.Store(f, path, uint64(len(data))))
+}
+
+// stubFS replaces one of the file system operations the cache goes through
+// for the rest of the test.
+func stubFS[F any](t *testing.T, op *F, stub F) {
+	orig := *op
+	*op = stub
+	t.Cleanup(func() { *op = orig })
+}
+
+func TestGetUnparseableValidated(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	storeTestFile(t, c, "registry/blob", "hello")
+	r.NoError(c.meta.set("registry/blob", xattrValidated, "garbage"))
+
+	cached, err := c.Get("registry/blob")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.True(cached.Validated.IsZero())
+	r.Equal(`"etag"`, cached.ETag)
+
+	// a successful revalidation repairs the entry
+	r.NoError(c.UpdateValidated("registry/blob"))
+	cached, err = c.Get("registry/blob")
+	r.NoError(err)
+	r.False(cached.Validated.IsZero())
+}
+
+func TestEvictConcurrentStore(t *testing.T) {
+	r := require.New(t)
+	const size = 1024
+	c := newTestCache(t, 4*size)
+	data := strings.Repeat("x", size)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for range 50 {
+				// all workers fight over few paths, so that eviction of a
+				// path races with re-storing it
+				storeTestFile(t, c, fmt.Sprintf("registry/blob%d", i%3), data)
+			}
+		})
+	}
+	wg.Wait()
+
+	var listed uint64
+	r.NoError(c.files.Range(func(f file) (bool, error) {
+		info, err := c.root.Stat(f.path)
+		r.NoError(err, "listed file must exist")
+		r.Equal(f.size, uint64(info.Size()))
+		listed += f.size
+		return false, nil
+	}))
+	r.Equal(listed, atomic.LoadUint64(&c.usedBytes))
+	r.LessOrEqual(listed, uint64(4*size))
+}
+
+func TestConcurrentStoreSamePath(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Go(func() {
+			// different sizes, so that accounting for the wrong one shows
+			storeTestFile(t, c, "registry/blob", strings.Repeat("x", 100+i))
+		})
+	}
+	wg.Wait()
+
+	info, err := c.root.Stat("registry/blob")
+	r.NoError(err)
+	r.Equal(uint64(info.Size()), atomic.LoadUint64(&c.usedBytes))
+	r.Equal(1, c.files.Len())
+	r.Equal([]string{"registry/blob"}, listedPaths(t, c))
+}
+
+func TestStats(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	storeTestFile(t, c, "registry/a", "hello")
+	storeTestFile(t, c, "registry/b", "world!")
+	storeTestFile(t, c, "registry/a", "hi")
+
+	cached, err := c.Get("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	cached, err = c.Get("registry/missing")
+	r.NoError(err)
+	r.Nil(cached)
+
+	r.Equal(Stats{
+		UsedBytes: 8,
+		MaxBytes:  1 << 20,
+		Files:     2,
+		Hits:      1,
+		Misses:    1,
+	}, c.Stats())
+}
+
+func readTestFile(t *testing.T, c *Cache, path string) string {
+	data, err := fs.ReadFile(c.FS(), path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestTiers(t *testing.T) {
+	r := require.New(t)
+	hot, err := NewTieredCache([]Tier{
+		{Path: t.TempDir(), MaxBytes: 8},
+		{Path: t.TempDir(), MaxBytes: 1 << 20},
+	})
+	r.NoError(err)
+	cold := hot.next
+
+	storeTestFile(t, hot, "registry/a", "aaaaa")
+	r.NoError(hot.meta.set("registry/a", xattrValidated, "2025-01-01T00:00:00Z"))
+	storeTestFile(t, hot, "registry/b", "bbbbb")
+
+	// a got demoted into the cold tier with its metadata
+	_, err = hot.root.Stat("registry/a")
+	r.ErrorIs(err, fs.ErrNotExist)
+	cached, err := cold.Peek("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal(`"etag"`, cached.ETag)
+	r.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), cached.Validated)
+	r.Equal("aaaaa", readTestFile(t, cold, "registry/a"))
+	temp, err := fs.ReadDir(hot.root.FS(), tmpDir)
+	r.NoError(err)
+	r.Empty(temp)
+
+	// accessing a promotes it back, demoting b
+	cached, err = hot.Get("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), cached.Validated)
+	r.Equal("aaaaa", readTestFile(t, hot, "registry/a"))
+	_, err = cold.root.Stat("registry/a")
+	r.ErrorIs(err, fs.ErrNotExist)
+	r.Equal("bbbbb", readTestFile(t, cold, "registry/b"))
+
+	stats := hot.Stats()
+	r.Equal(uint64(5), stats.UsedBytes)
+	r.Equal(1, stats.Files)
+	r.NotNil(stats.Lower)
+	r.Equal(uint64(5), stats.Lower.UsedBytes)
+	r.Equal(1, stats.Lower.Files)
+
+	cached, err = hot.Get("registry/missing")
+	r.NoError(err)
+	r.Nil(cached)
+}
+
+func TestPeek(t *testing.T) {
+	r := require.New(t)
+	hot, err := NewTieredCache([]Tier{
+		{Path: t.TempDir(), MaxBytes: 12},
+		{Path: t.TempDir(), MaxBytes: 1 << 20},
+	})
+	r.NoError(err)
+	storeTestFile(t, hot, "registry/a", "aaaaa")
+	storeTestFile(t, hot, "registry/b", "bbbbb")
+	before, err := hot.root.Stat("registry/a")
+	r.NoError(err)
+
+	// peeking the file evicted next keeps it that way
+	cached, err := hot.Peek("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	after, err := hot.root.Stat("registry/a")
+	r.NoError(err)
+	r.Equal(atime(before), atime(after))
+	r.Equal([]string{"registry/a", "registry/b"}, listedPaths(t, hot))
+	storeTestFile(t, hot, "registry/c", "ccccc")
+	r.Equal([]string{"registry/b", "registry/c"}, listedPaths(t, hot))
+
+	// files in lower tiers are found without promoting them
+	cached, err = hot.Peek("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal([]string{"registry/b", "registry/c"}, listedPaths(t, hot))
+	_, err = hot.root.Stat("registry/a")
+	r.ErrorIs(err, fs.ErrNotExist)
+	r.Zero(hot.Stats().Hits)
+
+	cached, err = hot.Peek("registry/missing")
+	r.NoError(err)
+	r.Nil(cached)
+}
+
+func TestEvictError(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 10)
+	storeTestFile(t, c, "registry/a", "aaaaa")
+	storeTestFile(t, c, "registry/b", "bbbbb")
+	stubFS(t, &renameInRoot, func(root *os.Root, oldpath, newpath string) error {
+		if oldpath == "registry/a" {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+		}
+		return root.Rename(oldpath, newpath)
+	})
+
+	// a is skipped, b is evicted in its place
+	storeTestFile(t, c, "registry/c", "ccccc")
+	r.Equal([]string{"registry/a", "registry/c"}, listedPaths(t, c))
+	r.Equal(uint64(10), c.Stats().UsedBytes)
+	r.Equal("aaaaa", readTestFile(t, c, "registry/a"))
+
+	// storing fails only if there is no room left
+	renameInRoot = func(root *os.Root, oldpath, newpath string) error {
+		if strings.HasPrefix(newpath, tmpDir+"/") {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+		}
+		return root.Rename(oldpath, newpath)
+	}
+	f, cleanup, err := c.Create("application/octet-stream", `"etag"`, "", "")
+	r.NoError(err)
+	defer cleanup()
+	_, err = f.WriteString("ddddd")
+	r.NoError(err)
+	r.ErrorIs(c.Store(f, "registry/d", 5), syscall.EBUSY)
+	r.Equal([]string{"registry/a", "registry/c"}, listedPaths(t, c))
+}
+
+func TestUnavailable(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	storeTestFile(t, c, "registry/a", "aaaaa")
+	r.NoError(c.CheckWritable())
+	stale := func(root *os.Root, oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ESTALE}
+	}
+	stubFS(t, &renameInRoot, stale)
+	store := func() error {
+		f, cleanup, err := c.Create("application/octet-stream", `"etag"`, "", "")
+		r.NoError(err)
+		defer cleanup()
+		return c.Store(f, "registry/b", 0)
+	}
+
+	// a single stale file leaves the cache available
+	err := store()
+	r.ErrorIs(err, syscall.ESTALE)
+	r.NotErrorIs(err, ErrUnavailable)
+
+	// failing along with the cache root, it is unavailable
+	stubFS(t, &statInRoot, func(root *os.Root, name string) (fs.FileInfo, error) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: syscall.ESTALE}
+	})
+	err = store()
+	r.ErrorIs(err, ErrUnavailable)
+	r.ErrorIs(err, syscall.ESTALE)
+
+	// and available again once the cache root is back
+	renameInRoot = (*os.Root).Rename
+	statInRoot = (*os.Root).Stat
+	r.NoError(c.CheckWritable())
+	r.NoError(store())
+
+	// unrelated errors are passed through as they are
+	r.NotErrorIs(c.wrapUnavailable(syscall.EBUSY), ErrUnavailable)
+	r.NoError(c.wrapUnavailable(nil))
+}
+
+func TestWatermarks(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	r.Error(c.SetWatermarks(0.5, 0.8))
+	r.Error(c.SetWatermarks(1.5, 0.8))
+	r.NoError(c.SetWatermarks(0.9, 0.5))
+
+	data := strings.Repeat("x", 10)
+	for i := range 9 {
+		storeTestFile(t, c, fmt.Sprintf("registry/%d", i), data)
+	}
+	r.Equal(9, c.Stats().Files)
+
+	// exceeding 90 bytes evicts the oldest files until 50 bytes are used,
+	// including the new file
+	storeTestFile(t, c, "registry/9", data)
+	r.Equal(uint64(50), c.Stats().UsedBytes)
+	for i := range 5 {
+		_, err := c.root.Stat(fmt.Sprintf("registry/%d", i))
+		r.ErrorIs(err, fs.ErrNotExist)
+	}
+	_, err := c.root.Stat("registry/9")
+	r.NoError(err)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 30)
+	r.Error(c.SetEvictionPolicy("mru"))
+	data := strings.Repeat("x", 10)
+	storeTestFile(t, c, "registry/hot", data)
+	for range 3 {
+		_, err := c.Get("registry/hot")
+		r.NoError(err)
+	}
+	storeTestFile(t, c, "registry/a", data)
+	storeTestFile(t, c, "registry/b", data)
+	r.Equal([]string{"registry/hot", "registry/a", "registry/b"}, listedPaths(t, c))
+
+	r.NoError(c.SetEvictionPolicy(EvictLFU))
+	r.Equal([]string{"registry/a", "registry/b", "registry/hot"}, listedPaths(t, c))
+	storeTestFile(t, c, "registry/c", data)
+	_, err := c.root.Stat("registry/hot")
+	r.NoError(err)
+	_, err = c.root.Stat("registry/a")
+	r.ErrorIs(err, fs.ErrNotExist)
+
+	r.NoError(c.SetEvictionPolicy(EvictLRU))
+	r.Equal([]string{"registry/hot", "registry/b", "registry/c"}, listedPaths(t, c))
+}
+
+// The file list keeps its order by moving files within it, which must match
+// sorting them.
+func TestFilesOrder(t *testing.T) {
+	r := require.New(t)
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU} {
+		var l files
+		r.NoError(l.SetPolicy(policy))
+		start := time.Now()
+		for i := range 2000 {
+			path := fmt.Sprintf("registry/%d", i*7919%13)
+			now := start.Add(time.Duration(i) * time.Second)
+			switch i % 5 {
+			case 0, 1:
+				l.Touch(path, now)
+			case 2:
+				l.InsertOrReplace(file{path: path, lastAccessed: now})
+			case 3:
+				l.InsertOrReplace(file{path: path, lastAccessed: start, accesses: uint64(i % 3)})
+			case 4:
+				l.Delete(file{path: path})
+			}
+			want := l.all()
+			slices.SortStableFunc(want, l.compare)
+			r.Equal(want, l.all(), "%s after %d operations", policy, i+1)
+			r.Len(l.byPath, l.order.Len())
+		}
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	r := require.New(t)
+	var l files
+	r.NoError(l.SetPolicy(EvictLFU))
+	start := time.Now()
+	l.InsertOrReplace(file{path: "registry/once-popular", lastAccessed: start})
+	for range 100 {
+		l.Touch("registry/once-popular", start)
+	}
+	l.InsertOrReplace(file{path: "registry/popular", lastAccessed: start})
+	for i := range lfuAgingPeriod * 1024 {
+		l.Touch("registry/popular", start.Add(time.Duration(i)))
+	}
+	var order []string
+	r.NoError(l.Range(func(f file) (bool, error) {
+		order = append(order, f.path)
+		return false, nil
+	}))
+	r.Equal([]string{"registry/once-popular", "registry/popular"}, order)
+	r.Equal(uint64(50), l.byPath["registry/once-popular"].Value.(file).accesses)
+}
+
+func TestStoreRetryNoSpace(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/old", "old")
+	failures := 0
+	stubFS(t, &renameInRoot, func(root *os.Root, oldpath, newpath string) error {
+		if _, err := root.Stat("registry/old"); err == nil && newpath == "registry/new" {
+			failures++
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOSPC}
+		}
+		return root.Rename(oldpath, newpath)
+	})
+	storeTestFile(t, c, "registry/new", "new")
+	r.Equal(1, failures)
+	r.Equal("new", readTestFile(t, c, "registry/new"))
+	r.Equal(Stats{UsedBytes: 3, MaxBytes: 100, Files: 1}, c.Stats())
+
+	c.SetStoreRetries(0)
+	renameInRoot = func(root *os.Root, oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOSPC}
+	}
+	f, cleanup, err := c.Create("application/octet-stream", `"etag"`, "", "")
+	r.NoError(err)
+	defer cleanup()
+	r.ErrorIs(c.Store(f, "registry/other", 0), syscall.ENOSPC)
+}
+
+type noSpaceWriter struct {
+	io.Writer
+	failures int
+}
+
+func (w *noSpaceWriter) Write(p []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		n, _ := w.Writer.Write(p[:len(p)/2])
+		return n, &os.PathError{Op: "write", Path: "test", Err: syscall.ENOSPC}
+	}
+	return w.Writer.Write(p)
+}
+
+func TestReclaimingWriter(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/old", "old")
+
+	var buf bytes.Buffer
+	w := c.ReclaimingWriter(&noSpaceWriter{Writer: &buf, failures: 1}, 4)
+	n, err := w.Write([]byte("data"))
+	r.NoError(err)
+	r.Equal(4, n)
+	r.Equal("data", buf.String())
+	r.Equal(Stats{MaxBytes: 100}, c.Stats(), "old file must be evicted")
+
+	buf.Reset()
+	w = c.ReclaimingWriter(&noSpaceWriter{Writer: &buf, failures: 2}, 4)
+	n, err = w.Write([]byte("data"))
+	r.ErrorIs(err, syscall.ENOSPC, "writes are retried only once")
+	r.Equal(3, n)
+}
+
+func TestSidecarMetadata(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 8)
+	c.meta = sidecarStore{c.root}
+
+	storeTestFile(t, c, "registry/a", "aaaaa")
+	_, err := getXAttr(absoluteInRoot(c.root, "registry/a"), xattrETag)
+	r.Error(err, "metadata must not be stored in xattrs")
+	cached, err := c.Get("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal(`"etag"`, cached.ETag)
+	r.Equal("application/octet-stream", cached.MIMEType)
+	r.NoError(c.UpdateValidated("registry/a"))
+
+	// sidecars are moved along with their file, and removed on eviction
+	storeTestFile(t, c, "registry/b", "bbbbb")
+	_, err = c.root.Stat("registry/a" + sidecarSuffix)
+	r.ErrorIs(err, fs.ErrNotExist)
+	_, err = c.root.Stat("registry/b" + sidecarSuffix)
+	r.NoError(err)
+	entries, err := c.root.FS().(fs.ReadDirFS).ReadDir(tmpDir)
+	r.NoError(err)
+	r.Empty(entries)
+
+	// sidecars are not accounted as cache files
+	c2, err := NewCache(c.root.Name(), 8)
+	r.NoError(err)
+	r.Equal(Stats{UsedBytes: 5, MaxBytes: 8, Files: 1}, c2.Stats())
+}
+
+// There is no negative caching, but a successful Store must replace whatever
+// is at a path, metadata included, so that nothing of it is served anymore.
+func TestStoreReplaces(t *testing.T) {
+	for name, sidecars := range map[string]bool{"xattrs": false, "sidecars": true} {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			c := newTestCache(t, 1<<20)
+			if sidecars {
+				c.meta = sidecarStore{c.root}
+			}
+			store := func(mimeType, eTag, data string) {
+				f, cleanup, err := c.Create(mimeType, eTag, "", "")
+				r.NoError(err)
+				defer cleanup()
+				_, err = f.WriteString(data)
+				r.NoError(err)
+				r.NoError(c.Store(f, "registry/a", uint64(len(data))))
+			}
+			store("text/plain", `"old"`, "not found")
+			store("application/octet-stream", `"new"`, "real")
+
+			cached, err := c.Get("registry/a")
+			r.NoError(err)
+			r.NotNil(cached)
+			r.Equal("application/octet-stream", cached.MIMEType)
+			r.Equal(`"new"`, cached.ETag)
+			r.Equal("real", readTestFile(t, c, "registry/a"))
+			r.Equal([]string{"registry/a"}, listedPaths(t, c))
+			r.Equal(uint64(4), c.Stats().UsedBytes)
+			entries, err := c.root.FS().(fs.ReadDirFS).ReadDir(tmpDir)
+			r.NoError(err)
+			r.Empty(entries)
+		})
+	}
+}
+
+func TestGetMissingMetadata(t *testing.T) {
+	for _, attr := range []string{xattrMIME, xattrETag, xattrValidated} {
+		t.Run(attr, func(t *testing.T) {
+			r := require.New(t)
+			c := newTestCache(t, 1<<20)
+			storeTestFile(t, c, "registry/blob", "hello")
+			r.NoError(unix.Removexattr(absoluteInRoot(c.root, "registry/blob"), attr))
+
+			cached, err := c.Peek("registry/blob")
+			r.NoError(err)
+			r.Nil(cached)
+
+			cached, err = c.Get("registry/blob")
+			r.NoError(err)
+			r.Nil(cached)
+			_, err = c.root.Stat("registry/blob")
+			r.ErrorIs(err, fs.ErrNotExist, "orphaned file must be evicted")
+			r.Equal(Stats{MaxBytes: 1 << 20, Misses: 1}, c.Stats())
+		})
+	}
+}
+
+func TestGetMissingSidecar(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	c.meta = sidecarStore{c.root}
+	storeTestFile(t, c, "registry/blob", "hello")
+	r.NoError(c.root.WriteFile("registry/blob"+sidecarSuffix, []byte("garbage"), 0666))
+	cached, err := c.Get("registry/blob")
+	r.NoError(err)
+	r.Nil(cached)
+	_, err = c.root.Stat("registry/blob" + sidecarSuffix)
+	r.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestSweepTemp(t *testing.T) {
+	for name, sidecars := range map[string]bool{"xattrs": false, "sidecars": true} {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			c := newTestCache(t, 1<<20)
+			if sidecars {
+				c.meta = sidecarStore{c.root}
+			}
+			old := time.Now().Add(-2 * time.Hour)
+			stale, cleanupStale, err := c.Create("application/octet-stream", `"etag"`, "", "")
+			r.NoError(err)
+			defer cleanupStale()
+			_, err = stale.WriteString("stale")
+			r.NoError(err)
+			staleName := c.relativeToRoot(stale.Name())
+			r.NoError(c.root.Chtimes(staleName, old, old))
+
+			active, cleanupActive, err := c.Create("application/octet-stream", `"etag"`, "", "")
+			r.NoError(err)
+			defer cleanupActive()
+			_, err = active.WriteString("active")
+			r.NoError(err)
+			if sidecars {
+				// written when the download started a while ago
+				r.NoError(c.root.Chtimes(staleName+sidecarSuffix, old, old))
+				r.NoError(c.root.Chtimes(c.relativeToRoot(active.Name())+sidecarSuffix, old, old))
+			}
+
+			removed, reclaimed, err := c.SweepTemp(time.Hour)
+			r.NoError(err)
+			if sidecars {
+				r.Equal(2, removed)
+			} else {
+				r.Equal(1, removed)
+			}
+			r.Equal(uint64(5), reclaimed)
+			_, err = c.root.Stat(c.relativeToRoot(active.Name()))
+			r.NoError(err)
+			r.NoError(c.Store(active, "registry/active", 6))
+			cached, err := c.Get("registry/active")
+			r.NoError(err)
+			r.NotNil(cached)
+			r.Equal("application/octet-stream", cached.MIMEType)
+		})
+	}
+}
+
+func TestAccountBlocks(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	c, err := NewTieredCache([]Tier{{Path: dir, MaxBytes: 1 << 20, AccountBlocks: true}})
+	r.NoError(err)
+	r.Zero(c.Stats().UsedBytes, "directories aren't counted")
+
+	storeTestFile(t, c, "registry/repo/blob", "hello")
+	info, err := c.root.Stat("registry/repo/blob")
+	r.NoError(err)
+	want := allocatedSize(info)
+	r.Greater(want, uint64(5))
+	r.Equal(want, c.Stats().UsedBytes)
+
+	c2, err := NewTieredCache([]Tier{{Path: dir, MaxBytes: 1 << 20, AccountBlocks: true}})
+	r.NoError(err)
+	r.Equal(want, c2.Stats().UsedBytes)
+
+	r.NoError(c.remove("registry/repo/blob"))
+	r.Zero(c.Stats().UsedBytes)
+}
+
+func listedPaths(t *testing.T, c *Cache) []string {
+	var paths []string
+	require.NoError(t, c.files.Range(func(f file) (bool, error) {
+		paths = append(paths, f.path)
+		return false, nil
+	}))
+	return paths
+}
+
+func TestJournal(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	c, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	storeTestFile(t, c, "registry/a", "a")
+	storeTestFile(t, c, "registry/b", "b")
+	storeTestFile(t, c, "registry/c", "c")
+	now := time.Now()
+	for i, p := range []string{"registry/b", "registry/c", "registry/a"} {
+		c.files.InsertOrReplace(file{path: p, size: 1, lastAccessed: now.Add(-time.Duration(i) * time.Minute)})
+	}
+	r.Equal([]string{"registry/a", "registry/c", "registry/b"}, listedPaths(t, c))
+	r.NoError(c.SaveJournal(t.Context()))
+
+	// contradict the journal's ordering with access times
+	for i, p := range []string{"registry/c", "registry/b", "registry/a"} {
+		at := time.Now().Add(time.Duration(i-10) * time.Hour)
+		r.NoError(c.root.Chtimes(p, at, at))
+	}
+
+	c2, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	r.Equal([]string{"registry/a", "registry/c", "registry/b"}, listedPaths(t, c2))
+	r.Equal(uint64(3), c2.Stats().UsedBytes)
+	_, err = c2.root.Stat(journalPath)
+	r.ErrorIs(err, fs.ErrNotExist, "journal must be consumed")
+
+	c3, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	r.Equal([]string{"registry/c", "registry/b", "registry/a"}, listedPaths(t, c3))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	r.ErrorIs(c3.SaveJournal(ctx), context.Canceled)
+}
+
+func TestSecret(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	c, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	secret, err := c.Secret()
+	r.NoError(err)
+	r.Len(secret, 32)
+	again, err := c.Secret()
+	r.NoError(err)
+	r.Equal(secret, again)
+
+	c2, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	again, err = c2.Secret()
+	r.NoError(err)
+	r.Equal(secret, again)
+	r.Zero(c2.Stats().UsedBytes, "secret must not count as cached object")
+	entries, err := os.ReadDir(filepath.Join(dir, tmpDir))
+	r.NoError(err)
+	r.Empty(entries)
+
+	_, err = newTestCache(t, 1<<20).Secret()
+	r.NoError(err)
+	other, err := newTestCache(t, 1<<20).Secret()
+	r.NoError(err)
+	r.NotEqual(secret, other)
+}
+
+func TestTornFiles(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	c, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	c.SetSync(true)
+	storeTestFile(t, c, "registry/intact", "hello")
+	storeTestFile(t, c, "registry/torn", "hello")
+	storeTestFile(t, c, "registry/empty", "")
+	r.NoError(os.Truncate(filepath.Join(dir, "registry/torn"), 0))
+	// files stored by older versions have no size, but must not be empty
+	r.NoError(os.WriteFile(filepath.Join(dir, "registry/legacy"), []byte("hello"), 0666))
+	r.NoError(os.WriteFile(filepath.Join(dir, "registry/legacy-empty"), nil, 0666))
+
+	c2, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	r.ElementsMatch([]string{"registry/intact", "registry/empty", "registry/legacy"}, listedPaths(t, c2))
+	_, err = os.Stat(filepath.Join(dir, "registry/torn"))
+	r.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestEntries(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/a", "aa")
+	storeTestFile(t, c, "registry/b", "bbb")
+	_, err := c.Get("registry/a")
+	r.NoError(err)
+	r.NoError(unix.Removexattr(absoluteInRoot(c.root, "registry/b"), xattrMIME))
+
+	entries, err := c.Entries()
+	r.NoError(err)
+	r.Len(entries, 2)
+	r.Equal("registry/b", entries[0].Path, "evicted next")
+	r.Equal(uint64(3), entries[0].Size)
+	r.Empty(entries[0].MIMEType)
+	r.Equal("registry/a", entries[1].Path)
+	r.Equal(uint64(2), entries[1].Accesses)
+	r.Equal("application/octet-stream", entries[1].MIMEType)
+	r.Equal(`"etag"`, entries[1].ETag)
+	r.WithinDuration(time.Now(), entries[1].Validated, time.Minute)
+}
+
+func TestSetMaxBytes(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/a", strings.Repeat("a", 10))
+	storeTestFile(t, c, "registry/b", strings.Repeat("b", 10))
+	r.Error(c.SetMaxBytes(0))
+	r.NoError(c.SetMaxBytes(15))
+	r.Equal([]string{"registry/b"}, listedPaths(t, c))
+	r.Equal(Stats{UsedBytes: 10, MaxBytes: 15, Files: 1}, c.Stats())
+	r.NoError(c.SetMaxBytes(30))
+	storeTestFile(t, c, "registry/c", strings.Repeat("c", 10))
+	r.Equal([]string{"registry/b", "registry/c"}, listedPaths(t, c))
+}
+
+func TestMaxFiles(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	r.Error(c.SetMaxFiles(-1))
+	r.NoError(c.SetMaxFiles(2))
+	storeTestFile(t, c, "registry/a", "a")
+	storeTestFile(t, c, "registry/b", "b")
+	storeTestFile(t, c, "registry/c", "c")
+	r.Equal([]string{"registry/b", "registry/c"}, listedPaths(t, c))
+	r.Equal(uint64(2), c.Stats().UsedBytes)
+	r.Equal(2, c.Stats().MaxFiles)
+
+	// the low watermark applies to the count as well
+	r.NoError(c.SetWatermarks(1, 0.5))
+	r.NoError(c.SetMaxFiles(4))
+	storeTestFile(t, c, "registry/d", "d")
+	storeTestFile(t, c, "registry/e", "e")
+	r.Equal([]string{"registry/b", "registry/c", "registry/d", "registry/e"}, listedPaths(t, c))
+	storeTestFile(t, c, "registry/f", "f")
+	r.Equal([]string{"registry/e", "registry/f"}, listedPaths(t, c))
+
+	// lowering the limit evicts right away
+	r.NoError(c.SetMaxFiles(0))
+	r.NoError(c.SetWatermarks(1, 1))
+	storeTestFile(t, c, "registry/g", "g")
+	r.NoError(c.SetMaxFiles(1))
+	r.Equal([]string{"registry/g"}, listedPaths(t, c))
+	_, err := c.root.Stat("registry/f")
+	r.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestPinned(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 15)
+	r.Error(c.SetPinned([]string{"["}))
+	r.NoError(c.SetPinned([]string{"docker.io/library/alpine", "ghcr.io/*/pinned"}))
+	storeTestFile(t, c, "docker.io/library/alpine/blobs/a", "aaaaa")
+	storeTestFile(t, c, "ghcr.io/org/pinned/manifests/b", "bbbbb")
+	storeTestFile(t, c, "docker.io/library/busybox/blobs/c", "ccccc")
+
+	// the oldest files are pinned, so the unpinned one goes
+	storeTestFile(t, c, "docker.io/library/alpinelinux/blobs/d", "ddddd")
+	r.Equal([]string{
+		"docker.io/library/alpine/blobs/a",
+		"ghcr.io/org/pinned/manifests/b",
+		"docker.io/library/alpinelinux/blobs/d",
+	}, listedPaths(t, c))
+
+	stats := c.Stats()
+	r.Equal(2, stats.PinnedFiles)
+	r.Equal(uint64(10), stats.PinnedBytes)
+	r.Equal(uint64(15), stats.UsedBytes)
+	entries, err := c.Entries()
+	r.NoError(err)
+	r.True(entries[0].Pinned)
+	r.False(entries[2].Pinned)
+
+	// patterns apply within namespace directories, too
+	r.NoError(c.SetMaxBytes(20))
+	storeTestFile(t, c, "~0123/docker.io/library/alpine/blobs/f", "fffff")
+	stats = c.Stats()
+	r.Equal(3, stats.PinnedFiles)
+	r.Equal(uint64(15), stats.PinnedBytes)
+	r.NoError(c.remove("~0123/docker.io/library/alpine/blobs/f"))
+	r.Equal(2, c.Stats().PinnedFiles)
+
+	// storing fails instead of evicting pinned files
+	r.NoError(c.SetMaxBytes(10))
+	f, cleanup, err := c.Create("application/octet-stream", `"etag"`, "", "")
+	r.NoError(err)
+	defer cleanup()
+	_, err = f.WriteString("eeeee")
+	r.NoError(err)
+	r.ErrorIs(c.Store(f, "quay.io/e", 5), errOnlyPinned)
+	r.Equal([]string{"docker.io/library/alpine/blobs/a", "ghcr.io/org/pinned/manifests/b"}, listedPaths(t, c))
+}
+
+func TestFsck(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 1<<20)
+	const content = "hello"
+	good := "registry/repo/blobs/sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	bad := "registry/repo/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	storeTestFile(t, c, good, content)
+	storeTestFile(t, c, bad, content)
+	storeTestFile(t, c, "registry/repo/blobs/md5:abc", content)
+	storeTestFile(t, c, "registry/repo/manifests/latest", "{}")
+	storeTestFile(t, c, "registry/repo/manifests/broken", "{}")
+	storeTestFile(t, c, "registry/repo/manifests/garbled", "{}")
+	r.NoError(unix.Removexattr(filepath.Join(c.root.Name(), "registry/repo/manifests/broken"), xattrETag))
+	r.NoError(c.meta.set("registry/repo/manifests/garbled", xattrValidated, "garbage"))
+
+	result, err := c.Fsck(func(path string) (string, bool) {
+		_, digest, ok := strings.Cut(path, "/blobs/")
+		return digest, ok
+	})
+	r.NoError(err)
+	r.Equal(FsckResult{Checked: 6, Corrupt: 3, ReclaimedBytes: 9}, result)
+	r.ElementsMatch([]string{good, "registry/repo/blobs/md5:abc", "registry/repo/manifests/latest"}, listedPaths(t, c))
+	r.Equal(uint64(12), c.Stats().UsedBytes)
+	_, err = c.root.Stat(bad)
+	r.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestWalk(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/a", "aa")
+	storeTestFile(t, c, "registry/b", "bbb")
+	var paths []string
+	var sizes []uint64
+	r.NoError(c.Walk(func(path string, size uint64, cached *Cached) error {
+		r.NotNil(cached)
+		paths = append(paths, path)
+		sizes = append(sizes, size)
+		// must not deadlock
+		_, err := c.Get(path)
+		return err
+	}))
+	r.Equal([]string{"registry/a", "registry/b"}, paths)
+	r.Equal([]uint64{2, 3}, sizes)
+
+	errStop := errors.New("stop")
+	calls := 0
+	r.ErrorIs(c.Walk(func(string, uint64, *Cached) error {
+		calls++
+		return errStop
+	}), errStop)
+	r.Equal(1, calls)
+}
+
+func TestReadOnly(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	w, err := NewCache(dir, 1<<20)
+	r.NoError(err)
+	storeTestFile(t, w, "registry/a", "aaa")
+	storeTestFile(t, w, "registry/nometa", "x")
+	r.NoError(os.WriteFile(filepath.Join(dir, tmpDir, "partial"), []byte("p"), 0666))
+	r.NoError(w.SaveJournal(t.Context()))
+	r.NoError(unix.Removexattr(filepath.Join(dir, "registry/nometa"), xattrMIME))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	r.NoError(os.Chtimes(filepath.Join(dir, "registry/a"), old, old))
+
+	c, err := NewTieredCache([]Tier{{Path: dir, MaxBytes: 1, ReadOnly: true}})
+	r.NoError(err)
+	r.True(c.ReadOnly())
+	r.Equal(uint64(4), c.Stats().UsedBytes, "files exceeding the size are kept")
+
+	cached, err := c.Get("registry/a")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal(`"etag"`, cached.ETag)
+	info, err := os.Stat(filepath.Join(dir, "registry/a"))
+	r.NoError(err)
+	r.Equal(old, atime(info), "atime left alone")
+	cached, err = c.Get("registry/nometa")
+	r.NoError(err)
+	r.Nil(cached)
+	cached, err = c.Get("registry/missing")
+	r.NoError(err)
+	r.Nil(cached)
+
+	_, _, err = c.Create("application/octet-stream", `"etag"`, "", "")
+	r.ErrorIs(err, ErrReadOnly)
+	r.ErrorIs(c.UpdateValidated("registry/a"), ErrReadOnly)
+	_, err = c.Fsck(func(string) (string, bool) { return "", false })
+	r.ErrorIs(err, ErrReadOnly)
+	removed, _, err := c.SweepTemp(0)
+	r.NoError(err)
+	r.Zero(removed)
+	r.NoError(c.SaveJournal(t.Context()))
+	r.NoError(c.CheckWritable())
+	for _, path := range []string{"registry/nometa", tmpDir + "/partial", journalPath} {
+		_, err := os.Stat(filepath.Join(dir, path))
+		r.NoError(err, path)
+	}
+
+	_, err = NewTieredCache([]Tier{{Path: dir, ReadOnly: true}, {Path: t.TempDir()}})
+	r.ErrorContains(err, "can't be mixed")
+}
+
+func TestEnforceLimits(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, 100)
+	storeTestFile(t, c, "registry/a", "aaaaa")
+	storeTestFile(t, c, "registry/b", "bbbbb")
+	r.NoError(c.EnforceLimits())
+	r.Equal([]string{"registry/a", "registry/b"}, listedPaths(t, c))
+
+	// e.g. usage accounted too low while storing
+	atomic.StoreUint64(&c.maxBytes, 6)
+	r.NoError(c.EnforceLimits())
+	r.Equal([]string{"registry/b"}, listedPaths(t, c))
+}
+
+func TestCompress(t *testing.T) {
+	r := require.New(t)
+	hot, err := NewTieredCache([]Tier{
+		{Path: t.TempDir(), MaxBytes: 1 << 20},
+		{Path: t.TempDir(), MaxBytes: 1 << 20},
+	})
+	r.NoError(err)
+	r.NoError(hot.SetCompressTypes([]string{"application/*+json"}))
+	r.Error(hot.SetCompressTypes([]string{"["}))
+	store := func(c *Cache, path, mimeType, data string) {
+		f, cleanup, err := c.Create(mimeType, `"etag"`, "", "")
+		r.NoError(err)
+		defer cleanup()
+		_, err = f.WriteString(data)
+		r.NoError(err)
+		r.NoError(c.Store(f, path, uint64(len(data))))
+	}
+	manifest := `{"layers":[` + strings.Repeat(`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip"},`, 100) + `{}]}`
+	store(hot, "registry/manifest", "application/vnd.oci.image.manifest.v1+json", manifest)
+	store(hot, "registry/blob", "application/octet-stream", manifest)
+	store(hot, "registry/tiny", "application/vnd.oci.image.index.v1+json", "{}")
+
+	raw, err := hot.root.ReadFile("registry/manifest")
+	r.NoError(err)
+	r.Equal([]byte{0x1f, 0x8b}, raw[:2], "stored gzip-compressed")
+	r.Less(len(raw), len(manifest))
+	r.Equal(uint64(len(raw)+len(manifest)+2), hot.Stats().UsedBytes, "accounted compressed")
+	r.Equal(manifest, readTestFile(t, hot, "registry/manifest"))
+	r.Equal(manifest, readTestFile(t, hot, "registry/blob"))
+	r.Equal("{}", readTestFile(t, hot, "registry/tiny"), "not compressed when it doesn't save space")
+	info, err := fs.Stat(hot.FS(), "registry/manifest")
+	r.NoError(err)
+	r.Equal(int64(len(manifest)), info.Size())
+
+	// moved between tiers as is
+	r.NoError(hot.evict(0, math.MaxInt))
+	raw2, err := hot.next.root.ReadFile("registry/manifest")
+	r.NoError(err)
+	r.Equal(raw, raw2)
+	r.Equal(manifest, readTestFile(t, hot.next, "registry/manifest"))
+	cached, err := hot.Get("registry/manifest")
+	r.NoError(err)
+	r.NotNil(cached)
+	r.Equal(manifest, readTestFile(t, hot, "registry/manifest"))
+
+	result, err := hot.Fsck(func(string) (string, bool) {
+		sum := sha256.Sum256([]byte(manifest))
+		return "sha256:" + hex.EncodeToString(sum[:]), true
+	})
+	r.NoError(err)
+	r.Equal(1, result.Corrupt, "only the tiny file doesn't match, the manifest is checked decompressed")
+}
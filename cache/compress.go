@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// xattrEncoding is set to the content coding of files stored compressed,
+// currently always gzip. Files without it are stored as received.
+const xattrEncoding = "user.com.authenticvision.cachistry.encoding"
+
+// maxCompressSize bounds the objects which are stored compressed, since they
+// are decompressed into memory to serve them.
+const maxCompressSize = 16 << 20
+
+// SetCompressTypes configures this cache and all lower tiers to store objects
+// whose MIME type matches one of patterns gzip-compressed, e.g. manifests with
+// application/*+json. Patterns use the syntax of path.Match. Objects which
+// don't get smaller, like compressed layers, are stored as received.
+// Compressed files count towards the cache size with their compressed size,
+// and are decompressed transparently by FS.
+func (c *Cache) SetCompressTypes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid MIME type pattern %q: %w", pattern, err)
+		}
+	}
+	for tier := c; tier != nil; tier = tier.next {
+		tier.compressTypes = patterns
+	}
+	return nil
+}
+
+func (c *Cache) compressible(mimeType string) bool {
+	for _, pattern := range c.compressTypes {
+		if ok, _ := path.Match(pattern, mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compress replaces the content of the temporary file f by its gzip-compressed
+// form, if its MIME type is configured to be compressed and compressing saves
+// space, and returns the size of its content.
+func (c *Cache) compress(f *os.File, size uint64) (uint64, error) {
+	if len(c.compressTypes) == 0 || size > maxCompressSize {
+		return size, nil
+	}
+	tmpPath := c.relativeToRoot(f.Name())
+	if _, err := c.meta.get(tmpPath, xattrEncoding); err == nil {
+		return size, nil // copied compressed from another tier
+	}
+	mimeType, err := c.meta.get(tmpPath, xattrMIME)
+	if err != nil {
+		return 0, err
+	}
+	if !c.compressible(mimeType) {
+		return size, nil
+	}
+	data, err := c.root.ReadFile(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if buf.Len() >= len(data) {
+		return size, nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		return 0, err
+	}
+	if err := c.meta.set(tmpPath, xattrEncoding, "gzip"); err != nil {
+		return 0, err
+	}
+	return uint64(buf.Len()), nil
+}
+
+// cacheFS serves the files of a cache, decompressing compressed ones.
+type cacheFS struct{ c *Cache }
+
+func (fsys cacheFS) Open(name string) (fs.File, error) {
+	return fsys.c.open(name)
+}
+
+// ReadDir lists directories without opening every entry.
+func (fsys cacheFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(fsys.c.root.FS(), name)
+}
+
+// open opens path for reading. Compressed files are decompressed into memory.
+func (c *Cache) open(path string) (fs.File, error) {
+	f, err := c.root.FS().Open(path)
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := c.meta.get(path, xattrEncoding)
+	if errors.Is(err, errMissingMetadata) {
+		return f, nil
+	}
+	defer func() { _ = f.Close() }()
+	if err != nil {
+		return nil, err
+	} else if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported encoding %q of %s", encoding, path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressedFile{
+		Reader: bytes.NewReader(data),
+		info:   decompressedInfo{FileInfo: info, size: int64(len(data))},
+	}, nil
+}
+
+type decompressedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *decompressedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *decompressedFile) Close() error { return nil }
+
+// decompressedInfo reports the size of a compressed file's content.
+type decompressedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i decompressedInfo) Size() int64 { return i.size }
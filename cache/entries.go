@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// Entry describes a cached file along with its metadata.
+type Entry struct {
+	Path         string    `json:"path"`
+	Tier         int       `json:"tier"` // 0 for this cache, 1 for the next lower tier, etc.
+	Size         uint64    `json:"size"`
+	LastAccessed time.Time `json:"last_accessed"`
+	Accesses     uint64    `json:"accesses"`
+	MIMEType     string    `json:"mime_type"`
+	ETag         string    `json:"etag"`
+	Validated    time.Time `json:"validated"`
+	Digest       string    `json:"digest,omitempty"`
+	Pinned       bool      `json:"pinned,omitempty"`
+}
+
+// Entries returns all files of this cache and its lower tiers in eviction
+// order, see Walk. Files with missing metadata are included with empty
+// metadata.
+func (c *Cache) Entries() ([]Entry, error) {
+	var entries []Entry
+	err := c.walk(func(tier int, f file, cached *Cached) error {
+		if cached == nil {
+			cached = &Cached{}
+		}
+		entries = append(entries, Entry{
+			Path:         f.path,
+			Tier:         tier,
+			Size:         f.size,
+			LastAccessed: f.lastAccessed,
+			Accesses:     f.accesses,
+			MIMEType:     cached.MIMEType,
+			ETag:         cached.ETag,
+			Validated:    cached.Validated,
+			Digest:       cached.Digest,
+			Pinned:       f.pinned,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// Walk calls fn for all files of this cache and its lower tiers in eviction
+// order, i.e. for each tier, the file evicted next comes first. cached is nil
+// for files with missing metadata. An error returned by fn stops the walk and
+// is returned.
+//
+// Walk is safe to call concurrently with Store and Get. It works on a
+// snapshot of the files taken when it reaches each tier: files evicted since
+// are skipped, files stored since are not visited.
+func (c *Cache) Walk(fn func(path string, size uint64, cached *Cached) error) error {
+	return c.walk(func(tier int, f file, cached *Cached) error {
+		return fn(f.path, f.size, cached)
+	})
+}
+
+func (c *Cache) walk(fn func(tier int, f file, cached *Cached) error) error {
+	for tier, t := 0, c; t != nil; tier, t = tier+1, t.next {
+		// snapshot first, reading metadata must not block the list
+		var files []file
+		_ = t.files.Range(func(f file) (bool, error) {
+			files = append(files, f)
+			return false, nil
+		})
+		for _, f := range files {
+			cached, err := t.metadata(f.path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if errors.Is(err, errMissingMetadata) {
+				cached = nil
+			} else if err != nil {
+				return fmt.Errorf("read metadata of %s: %w", f.path, err)
+			}
+			if err := fn(tier, f, cached); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
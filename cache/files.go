@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"cmp"
+	"container/list"
 	"errors"
+	"fmt"
 	"slices"
 	"sync"
 	"time"
@@ -11,61 +14,277 @@ type file struct {
 	path         string
 	size         uint64
 	lastAccessed time.Time
+	accesses     uint64
+	pinned       bool // see files.SetPinned
 }
 
+// EvictionPolicy decides which files are evicted first.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently accessed files first.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently accessed files first, and the
+	// least recently accessed ones among equally frequent files. Files pulled
+	// all the time stay resident even if untouched for a while. Access
+	// counts are halved regularly, so that files which were popular once
+	// don't stay forever.
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// lfuAgingPeriod is the number of accesses per file after which access
+// counts are halved.
+const lfuAgingPeriod = 8
+
+// files keeps files ordered by descending value, see compare. Files are
+// grouped by access count with EvictLFU and all in one group with EvictLRU.
+// Within a group, they are ordered by access time, so that accessed and
+// newly stored files go first in their group without searching for their
+// place.
 type files struct {
-	mu    sync.Mutex
-	files []file // stored sorted by descending last accessed time
+	mu      sync.Mutex
+	order   list.List                // of file
+	byPath  map[string]*list.Element // elements of order by path
+	groups  map[uint64]*list.Element // first element of each group
+	lfu     bool
+	touches int // since access counts were last halved
+
+	isPinned    func(path string) bool
+	pinnedFiles int
+	pinnedBytes uint64
+}
+
+// compare orders a before b if it is more valuable to keep.
+func (l *files) compare(a file, b file) int {
+	if c := cmp.Compare(l.group(b), l.group(a)); c != 0 {
+		return c
+	}
+	return b.lastAccessed.Compare(a.lastAccessed)
+}
+
+func (l *files) group(f file) uint64 {
+	if l.lfu {
+		return f.accesses
+	}
+	return 0
+}
+
+// SetPolicy changes the eviction order of all files.
+func (l *files) SetPolicy(policy EvictionPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch policy {
+	case EvictLRU:
+		l.lfu = false
+	case EvictLFU:
+		l.lfu = true
+	default:
+		return fmt.Errorf("unknown eviction policy %q", policy)
+	}
+	l.reset(l.all())
+	return nil
 }
 
+// SetPinned changes which files are pinned, keeping track of how many there
+// are and their size.
+func (l *files) SetPinned(isPinned func(path string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.isPinned = isPinned
+	l.reset(l.all())
+}
+
+// Pinned returns the number and size of pinned files.
+func (l *files) Pinned() (files int, bytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pinnedFiles, l.pinnedBytes
+}
+
+// Load replaces all files, e.g. with the ones found on startup, in any order.
+func (l *files) Load(files []file) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reset(files)
+}
+
+// InsertOrReplace adds f, which inherits the access count of the file it
+// replaces.
 func (l *files) InsertOrReplace(f file) (old file, replaced bool) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	old, replaced = l.delete(f)
-	l.insert(f)
+	f.pinned = l.isPinned != nil && l.isPinned(f.path)
+	var from *list.Element
+	if e, ok := l.byPath[f.path]; ok {
+		old, replaced = e.Value.(file), true
+		f.accesses += old.accesses
+		from = l.remove(e)
+		if l.group(f) != l.group(old) {
+			from = nil
+		}
+	}
+	l.insert(f, from)
 	return
 }
 
-func (l *files) Delete(f file) bool {
+// Touch records an access of path at t.
+func (l *files) Touch(path string, t time.Time) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	_, replaced := l.delete(f)
-	return replaced
+	e, ok := l.byPath[path]
+	if !ok {
+		return
+	}
+	f := e.Value.(file)
+	from := l.remove(e)
+	f.lastAccessed = t
+	f.accesses++
+	l.insert(f, from)
+	if l.lfu {
+		l.touches++
+		if l.touches >= lfuAgingPeriod*max(l.order.Len(), 1024) {
+			l.age()
+		}
+	}
 }
 
-func (l *files) insert(f file) {
-	i, _ := slices.BinarySearchFunc(l.files, f, func(a file, b file) int {
-		return b.lastAccessed.Compare(a.lastAccessed)
-	})
-	l.files = slices.Insert(l.files, i, f)
+func (l *files) Delete(f file) (old file, deleted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.byPath[f.path]; ok {
+		old, deleted = e.Value.(file), true
+		l.remove(e)
+	}
 	return
 }
 
-func (l *files) delete(f file) (old file, replaced bool) {
-	if i := slices.IndexFunc(l.files, func(prev file) bool {
-		return prev.path == f.path
-	}); i >= 0 {
-		replaced = true
-		old = l.files[i]
-		slices.Delete(l.files, i, i+1)
+func (l *files) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// insert adds f before the first file which is less valuable. If f's group is
+// empty, from must be nil or an element which only more valuable files
+// precede, like what remove returned for a file of f's group or the one
+// below.
+func (l *files) insert(f file, from *list.Element) {
+	if l.byPath == nil {
+		l.byPath = make(map[string]*list.Element)
+		l.groups = make(map[uint64]*list.Element)
+	}
+	g := l.group(f)
+	head, ok := l.groups[g]
+	if ok {
+		from = head
+	} else if from == nil {
+		from = l.order.Front()
+	}
+	at := from
+	for at != nil && l.compare(f, at.Value.(file)) > 0 {
+		at = at.Next()
+	}
+	var e *list.Element
+	if at != nil {
+		e = l.order.InsertBefore(f, at)
+	} else {
+		e = l.order.PushBack(f)
+	}
+	l.byPath[f.path] = e
+	if !ok || e.Next() == head {
+		l.groups[g] = e
+	}
+	if f.pinned {
+		l.pinnedFiles++
+		l.pinnedBytes += f.size
+	}
+}
+
+// remove deletes e and returns where its group starts, or would start, i.e.
+// an element which only files of higher groups precede.
+func (l *files) remove(e *list.Element) *list.Element {
+	f := e.Value.(file)
+	g := l.group(f)
+	if l.groups[g] == e {
+		if next := e.Next(); next != nil && l.group(next.Value.(file)) == g {
+			l.groups[g] = next
+		} else {
+			delete(l.groups, g)
+		}
+	}
+	from, ok := l.groups[g]
+	if !ok {
+		from = e.Next()
+	}
+	delete(l.byPath, f.path)
+	l.order.Remove(e)
+	if f.pinned {
+		l.pinnedFiles--
+		l.pinnedBytes -= f.size
+	}
+	return from
+}
+
+func (l *files) all() []file {
+	files := make([]file, 0, l.order.Len())
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		files = append(files, e.Value.(file))
+	}
+	return files
+}
+
+// reset replaces all files with files, sorting them once.
+func (l *files) reset(files []file) {
+	slices.SortStableFunc(files, l.compare)
+	l.order.Init()
+	l.byPath = make(map[string]*list.Element, len(files))
+	l.groups = make(map[uint64]*list.Element)
+	l.pinnedFiles, l.pinnedBytes = 0, 0
+	for _, f := range files {
+		f.pinned = l.isPinned != nil && l.isPinned(f.path)
+		if f.pinned {
+			l.pinnedFiles++
+			l.pinnedBytes += f.size
+		}
+		e := l.order.PushBack(f)
+		l.byPath[f.path] = e
+		if _, ok := l.groups[l.group(f)]; !ok {
+			l.groups[l.group(f)] = e
+		}
 	}
-	return
+}
+
+// age halves all access counts.
+func (l *files) age() {
+	files := l.all()
+	for i := range files {
+		files[i].accesses /= 2
+	}
+	l.reset(files)
+	l.touches = 0
 }
 
 var errRangeDone = errors.New("skip the rest")
 
-// Range goes through files from the oldest access time to the newest
-func (l *files) Range(f func(f file) error) error {
+// Range goes through files from the least valuable to the most valuable,
+// which is from the oldest access time to the newest for EvictLRU. Files for
+// which f returns remove=true are deleted from the list.
+func (l *files) Range(f func(f file) (remove bool, err error)) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	for i := len(l.files) - 1; i >= 0; i-- {
-		err := f(l.files[i])
+	for e := l.order.Back(); e != nil; {
+		prev := e.Prev()
+		remove, err := f(e.Value.(file))
+		if remove {
+			l.remove(e)
+		}
 		//goland:noinspection GoDirectComparisonOfErrors
 		if err == errRangeDone {
 			return nil
 		} else if err != nil {
 			return err
 		}
+		e = prev
 	}
 	return nil
 }
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// FsckResult summarizes a run of Fsck.
+type FsckResult struct {
+	Checked        int    `json:"checked"`
+	Corrupt        int    `json:"corrupt"`
+	ReclaimedBytes uint64 `json:"reclaimed_bytes"`
+}
+
+// Fsck checks all files of this cache and its lower tiers and evicts corrupt
+// ones: files whose metadata is missing or unparseable, and files whose
+// content doesn't match the digest returned by expectedDigest, which reports
+// false for paths that aren't content-addressed. Digests of algorithms other
+// than sha256 and sha512 aren't verified.
+//
+// Fsck reads every file in full, so it is meant for a cache suspected of
+// corruption rather than for regular use while serving.
+func (c *Cache) Fsck(expectedDigest func(path string) (string, bool)) (FsckResult, error) {
+	var result FsckResult
+	if c.readOnly {
+		return result, ErrReadOnly
+	}
+	for t := c; t != nil; t = t.next {
+		var files []file
+		_ = t.files.Range(func(f file) (bool, error) {
+			files = append(files, f)
+			return false, nil
+		})
+		for _, f := range files {
+			problem, err := t.check(f.path, expectedDigest)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // evicted meanwhile
+			} else if err != nil {
+				return result, fmt.Errorf("check %s: %w", f.path, err)
+			}
+			result.Checked++
+			if problem == "" {
+				continue
+			}
+			slog.Warn("evicting corrupt file",
+				slog.String("path", f.path),
+				slog.String("problem", problem),
+			)
+			if err := t.remove(f.path); err != nil {
+				return result, fmt.Errorf("remove %s: %w", f.path, err)
+			}
+			result.Corrupt++
+			result.ReclaimedBytes += f.size
+		}
+	}
+	return result, nil
+}
+
+// check returns what is wrong with path in this tier, if anything.
+func (c *Cache) check(path string, expectedDigest func(path string) (string, bool)) (string, error) {
+	for _, attr := range []string{xattrMIME, xattrETag, xattrValidated} {
+		_, err := c.meta.get(path, attr)
+		if errors.Is(err, errMissingMetadata) {
+			return "missing metadata " + attr, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	validated, _ := c.meta.get(path, xattrValidated)
+	if _, err := time.Parse(time.RFC3339, validated); err != nil {
+		return "unparseable validation timestamp", nil
+	}
+	digest, ok := expectedDigest(path)
+	if !ok {
+		return "", nil
+	}
+	algorithm, expected, _ := strings.Cut(digest, ":")
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", nil
+	}
+	f, err := c.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return "digest mismatch, content hashes to " + algorithm + ":" + actual, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// journalPath stores the LRU ordering across restarts. It is removed once
+// loaded, so that a crash afterwards falls back to access times.
+const journalPath = "-/lru.journal"
+
+type journalEntry struct {
+	Path         string    `json:"path"`
+	LastAccessed time.Time `json:"last_accessed"`
+	Accesses     uint64    `json:"accesses,omitempty"`
+}
+
+// SaveJournal persists the recency and access counts of all files of this
+// cache and all lower tiers, so that the next NewCache restores them exactly
+// instead of relying on file access times, which may be coarse or disabled
+// (noatime). Writing stops with an error when ctx is done.
+func (c *Cache) SaveJournal(ctx context.Context) error {
+	if c.readOnly {
+		return nil
+	}
+	for tier := c; tier != nil; tier = tier.next {
+		if err := tier.saveJournal(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) saveJournal(ctx context.Context) error {
+	var entries []journalEntry
+	err := c.files.Range(func(f file) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		entries = append(entries, journalEntry{Path: f.path, LastAccessed: f.lastAccessed, Accesses: f.accesses})
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s/journal", tmpDir)
+	if err := c.root.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		_ = c.root.Remove(tmp)
+		return err
+	}
+	return c.root.Rename(tmp, journalPath)
+}
+
+// loadJournal reads and removes the journal, keyed by path. A missing
+// journal yields an empty map. Read-only caches leave the journal in place.
+func (c *Cache) loadJournal() (map[string]journalEntry, error) {
+	data, err := c.root.ReadFile(journalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]journalEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !c.readOnly {
+		if err := c.root.Remove(journalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var entries []journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse journal: %w", err)
+	}
+	accessed := make(map[string]journalEntry, len(entries))
+	for _, e := range entries {
+		accessed[e.Path] = e
+	}
+	return accessed, nil
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// errMissingMetadata is returned by metadataStore.get if the attribute is not
+// set or unreadable.
+var errMissingMetadata = errors.New("missing metadata")
+
+// metadataStore persists metadata attributes of cache files. Paths are
+// relative to the cache root.
+type metadataStore interface {
+	get(path string, attr string) (string, error)
+	set(path string, attr string, value string) error
+	// rename and remove are called along with renaming and removing the
+	// file itself.
+	rename(oldpath, newpath string) error
+	remove(path string) error
+}
+
+// newMetadataStore probes whether the file system supports extended
+// attributes and falls back to sidecar files otherwise.
+func newMetadataStore(root *os.Root) (metadataStore, error) {
+	probe := tmpDir + "/xattr-probe"
+	f, err := root.Create(probe)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+	defer func() { _ = root.Remove(probe) }()
+	xattrs := xattrStore{root}
+	if err := xattrs.set(probe, xattrMIME, "probe"); err != nil {
+		return sidecarStore{root}, nil
+	}
+	return xattrs, nil
+}
+
+// detectMetadataStore returns the metadata store the files in root were
+// stored with, without writing anything. It looks at the first file found,
+// assuming that all were stored the same way.
+func detectMetadataStore(root *os.Root) (metadataStore, error) {
+	var store metadataStore = xattrStore{root}
+	errFound := errors.New("found")
+	err := fs.WalkDir(root.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path == journalPath || path == secretPath || strings.HasPrefix(path, tmpDir+"/") {
+			return err
+		}
+		if isSidecar(path) {
+			store = sidecarStore{root}
+		} else if _, err := store.get(path, xattrMIME); err != nil {
+			store = sidecarStore{root}
+		}
+		return errFound
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return nil, err
+	}
+	return store, nil
+}
+
+// xattrStore keeps metadata in extended attributes, which move along with the
+// file they belong to.
+type xattrStore struct{ root *os.Root }
+
+func (s xattrStore) get(path string, attr string) (string, error) {
+	value, err := getXAttr(absoluteInRoot(s.root, path), attr)
+	if errors.Is(err, unix.ENODATA) {
+		return "", fmt.Errorf("%w: %w", errMissingMetadata, err)
+	}
+	return value, err
+}
+
+func (s xattrStore) set(path string, attr string, value string) error {
+	return setXAttr(absoluteInRoot(s.root, path), attr, value)
+}
+
+func (s xattrStore) rename(oldpath, newpath string) error { return nil }
+
+func (s xattrStore) remove(path string) error { return nil }
+
+// sidecarSuffix is appended to a file's path to get the path of its sidecar
+// metadata file. It can't be part of repository names, tags or digests.
+const sidecarSuffix = "#meta"
+
+// sidecarStore keeps metadata as JSON object in a file next to the file it
+// belongs to, for file systems which don't support extended attributes.
+type sidecarStore struct{ root *os.Root }
+
+func isSidecar(path string) bool {
+	return strings.HasSuffix(path, sidecarSuffix)
+}
+
+func (s sidecarStore) load(path string) (map[string]string, error) {
+	data, err := s.root.ReadFile(path + sidecarSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var attrs map[string]string
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, fmt.Errorf("%w: parse sidecar: %w", errMissingMetadata, err)
+	}
+	return attrs, nil
+}
+
+func (s sidecarStore) get(path string, attr string) (string, error) {
+	attrs, err := s.load(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := attrs[attr]
+	if !ok {
+		return "", fmt.Errorf("%w: sidecar attribute %q not found", errMissingMetadata, attr)
+	}
+	return value, nil
+}
+
+func (s sidecarStore) set(path string, attr string, value string) error {
+	attrs, err := s.load(path)
+	if err != nil {
+		return err
+	}
+	attrs[attr] = value
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return s.root.WriteFile(path+sidecarSuffix, data, 0666)
+}
+
+func (s sidecarStore) rename(oldpath, newpath string) error {
+	err := s.root.Rename(oldpath+sidecarSuffix, newpath+sidecarSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s sidecarStore) remove(path string) error {
+	err := s.root.Remove(path + sidecarSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
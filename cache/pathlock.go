@@ -0,0 +1,62 @@
+package cache
+
+import "sync"
+
+// pathLocks hands out a mutex per cache path. Entries are reference counted
+// and removed once unused.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (p *pathLocks) acquire(path string) *pathLock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.locks == nil {
+		p.locks = make(map[string]*pathLock)
+	}
+	l, ok := p.locks[path]
+	if !ok {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.refs++
+	return l
+}
+
+func (p *pathLocks) release(path string, l *pathLock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(p.locks, path)
+	}
+}
+
+// Lock blocks until path is locked and returns a function for unlocking it.
+func (p *pathLocks) Lock(path string) (unlock func()) {
+	l := p.acquire(path)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.release(path, l)
+	}
+}
+
+// TryLock locks path if it isn't locked already.
+func (p *pathLocks) TryLock(path string) (unlock func(), ok bool) {
+	l := p.acquire(path)
+	if !l.TryLock() {
+		p.release(path, l)
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		p.release(path, l)
+	}, true
+}
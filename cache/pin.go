@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NamespacePrefix starts the names of directories keeping separate caches
+// below the cache root, e.g. one per client. It can't start a registry name.
+const NamespacePrefix = "~"
+
+// errOnlyPinned is returned by evict if it can't make enough room without
+// evicting pinned files.
+var errOnlyPinned = errors.New("only pinned files left to evict")
+
+// SetPinned configures glob patterns, as understood by path.Match, of paths
+// this cache and all lower tiers never evict. A pattern matching a directory
+// pins everything below it. Patterns match paths within namespace directories
+// as well. Pinned files still count towards the cache size, and storing fails
+// rather than evicting them when nothing else is left to make room.
+func (c *Cache) SetPinned(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	for tier := c; tier != nil; tier = tier.next {
+		tier.pinned = patterns
+		tier.files.SetPinned(tier.isPinned)
+	}
+	return nil
+}
+
+// isPinned reports whether p or one of its parent directories matches a
+// pinned pattern, not counting a namespace directory p is in.
+func (c *Cache) isPinned(p string) bool {
+	if dir, rest, ok := strings.Cut(p, "/"); ok && strings.HasPrefix(dir, NamespacePrefix) {
+		p = rest
+	}
+	for _, pattern := range c.pinned {
+		for q := p; q != "." && q != "/"; q = path.Dir(q) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	mathrand "math/rand/v2"
+)
+
+// secretPath stores random bytes generated for the cache once, see Secret.
+const secretPath = "-/secret"
+
+// Secret returns random bytes that are kept with the cache, generating them
+// on first use. Instances sharing the cache get the same secret, and a
+// cache that is cleared gets a new one.
+func (c *Cache) Secret() ([]byte, error) {
+	secret, err := c.root.ReadFile(secretPath)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) || c.readOnly {
+		return secret, err
+	}
+	secret = make([]byte, 32)
+	_, _ = rand.Read(secret)
+	tmp := fmt.Sprintf("%s/secret-%d", tmpDir, mathrand.Uint64())
+	if err := c.root.WriteFile(tmp, secret, 0600); err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.root.Remove(tmp) }()
+	// linking fails if another instance got there first, whose secret wins
+	if err := c.root.Link(tmp, secretPath); errors.Is(err, fs.ErrExist) {
+		return c.root.ReadFile(secretPath)
+	} else if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/authenticvision/util-go/fmtutil"
+)
+
+// SweepTemp removes temporary files of this cache and all lower tiers, which
+// weren't written to for longer than maxAge. These are left behind by failed
+// downloads and aren't accounted for in the cache size. Read-only caches have
+// none.
+func (c *Cache) SweepTemp(maxAge time.Duration) (removed int, reclaimed uint64, err error) {
+	if c.readOnly {
+		return 0, 0, nil
+	}
+	for tier := c; tier != nil; tier = tier.next {
+		n, size, err := tier.sweepTemp(maxAge)
+		removed += n
+		reclaimed += size
+		if err != nil {
+			return removed, reclaimed, err
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+func (c *Cache) sweepTemp(maxAge time.Duration) (removed int, reclaimed uint64, err error) {
+	entries, err := fs.ReadDir(c.root.FS(), tmpDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, d := range entries {
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // stored or removed concurrently
+		} else if err != nil {
+			return removed, reclaimed, err
+		}
+		// The modification time of files still being downloaded is recent.
+		// Their sidecars are written once when the download starts, so they
+		// are as old as the file they belong to, if it is still there.
+		modTime := info.ModTime()
+		if name, ok := strings.CutSuffix(d.Name(), sidecarSuffix); ok {
+			if data, err := c.root.Stat(path.Join(tmpDir, name)); err == nil {
+				modTime = data.ModTime()
+			}
+		}
+		if time.Since(modTime) < maxAge {
+			continue
+		}
+		err = c.root.Remove(path.Join(tmpDir, d.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return removed, reclaimed, err
+		}
+		removed++
+		if !isSidecar(d.Name()) {
+			reclaimed += uint64(info.Size())
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+// SweepTempPeriodically runs SweepTemp every interval until ctx is done.
+func (c *Cache) SweepTempPeriodically(ctx context.Context, interval time.Duration, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, reclaimed, err := c.SweepTemp(maxAge)
+		if err != nil {
+			slog.Error("failed to sweep temporary files", slog.Any("error", err))
+		}
+		if removed > 0 {
+			slog.Info("removed orphaned temporary files",
+				slog.Int("files", removed),
+				slog.String("reclaimed", fmtutil.FormatBytes(reclaimed)),
+			)
+		}
+	}
+}
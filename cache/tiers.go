@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+type Tier struct {
+	Path     string
+	MaxBytes uint64
+
+	// AccountBlocks makes the tier count allocated disk blocks of files
+	// towards MaxBytes instead of logical file sizes. Directories aren't
+	// counted, they stay around when the files in them are evicted.
+	AccountBlocks bool
+
+	// ReadOnly opens the tier without ever modifying it, e.g. to serve a
+	// cache populated by another instance from a read-only mount. Access
+	// times, temporary files and the LRU journal are left alone, nothing
+	// is stored or evicted, and files aren't promoted from lower tiers.
+	// Either all tiers of a cache are read-only or none is.
+	ReadOnly bool
+}
+
+// NewTieredCache creates a cache spanning multiple directories, ordered from
+// the hottest to the coldest tier. Files evicted from a tier are demoted into
+// the next tier and only removed when evicted from the last one. Files found
+// in a lower tier are promoted into the first tier on access.
+func NewTieredCache(tiers []Tier) (*Cache, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("no cache tiers")
+	}
+	var next *Cache
+	for i := len(tiers) - 1; i >= 0; i-- {
+		if tiers[i].ReadOnly != tiers[0].ReadOnly {
+			return nil, fmt.Errorf("tier %d: read-only and writable tiers can't be mixed", i)
+		}
+		c, err := newCache(tiers[i])
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: %w", i, err)
+		}
+		c.next = next
+		next = c
+	}
+	return next, nil
+}
+
+// promote moves path from a lower tier into this tier, looking into all lower
+// tiers recursively.
+func (c *Cache) promote(path string) (bool, error) {
+	cached, err := c.next.Get(path)
+	if err != nil || cached == nil {
+		return false, err
+	}
+	err = c.next.copyTo(c, path, path)
+	if err != nil {
+		return false, err
+	}
+	return true, c.next.remove(path)
+}
+
+// copyTo stores a copy of the file at src in dst at path, including its
+// metadata.
+func (c *Cache) copyTo(dst *Cache, src string, path string) error {
+	cached, err := c.metadata(src)
+	if err != nil {
+		return err
+	}
+	in, err := c.root.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	f, cleanup, err := dst.Create(cached.MIMEType, cached.ETag, cached.Digest, cached.LastModified)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	err = dst.meta.set(dst.relativeToRoot(f.Name()), xattrValidated, cached.Validated.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	// copied as is, compressed or not
+	if encoding, err := c.meta.get(src, xattrEncoding); err == nil {
+		err = dst.meta.set(dst.relativeToRoot(f.Name()), xattrEncoding, encoding)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := io.Copy(f, in)
+	if err != nil {
+		return err
+	}
+	return dst.Store(f, path, uint64(n))
+}
+
+// remove deletes path from this tier only.
+func (c *Cache) remove(path string) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+	err := c.root.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_ = c.meta.remove(path)
+	if old, deleted := c.files.Delete(file{path: path}); deleted {
+		atomicSubtract(&c.usedBytes, old.size)
+	}
+	c.removed(path)
+	return nil
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+)
+
+// ErrUnavailable is wrapped by errors of operations which failed because the
+// cache directory itself became unavailable, e.g. its volume was unmounted
+// uncleanly or its NFS server went away.
+var ErrUnavailable = errors.New("cache directory unavailable")
+
+// unavailableErrnos indicate that a file system is gone rather than a single
+// operation failing. EIO is left out, a bad sector shouldn't take down the
+// whole cache.
+var unavailableErrnos = []syscall.Errno{
+	syscall.ENOTCONN, // FUSE daemon died
+	syscall.ESTALE,   // NFS export or root directory gone
+	syscall.ENODEV,
+}
+
+func isUnavailable(err error) bool {
+	for _, errno := range unavailableErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapUnavailable wraps err in ErrUnavailable if it indicates that the cache
+// directory is unavailable. Single files fail with the same errors, e.g. NFS
+// reports ESTALE for files replaced by another client, so it only does if the
+// cache root fails as well.
+func (c *Cache) wrapUnavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) || !isUnavailable(err) {
+		return err
+	}
+	if _, rootErr := statInRoot(c.root, "."); !isUnavailable(rootErr) {
+		return err
+	}
+	if c.unavailable.CompareAndSwap(false, true) {
+		slog.Error("cache directory became unavailable, marking unhealthy",
+			slog.String("path", c.root.Name()),
+			slog.Any("error", err),
+		)
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
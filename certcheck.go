@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// expiringCert describes an upstream certificate close to its expiry.
+type expiringCert struct {
+	Registry string
+	Subject  string
+	NotAfter time.Time
+}
+
+// checkCertsPeriodically calls checkCerts every interval until ctx is done.
+func (app *App) checkCertsPeriodically(ctx context.Context, interval, warnBefore time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		app.checkCerts(ctx, warnBefore)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkCerts connects to every upstream and warns about certificates in
+// their chains which expire within warnBefore, or which fail verification.
+func (app *App) checkCerts(ctx context.Context, warnBefore time.Duration) []expiringCert {
+	ctx = withUserAgent(ctx, app.userAgent)
+	log := logutil.FromContext(ctx)
+	var expiring []expiringCert
+	for _, registry := range slices.Sorted(maps.Keys(app.regs)) {
+		log := log.With(slog.String("registry", registry))
+		certs, err := app.upstreamCerts(ctx, registry)
+		if err != nil {
+			log.Warn("failed to check upstream certificate", slog.Any("error", err))
+			continue
+		}
+		for _, cert := range certs {
+			if time.Until(cert.NotAfter) > warnBefore {
+				continue
+			}
+			expiring = append(expiring, expiringCert{
+				Registry: registry,
+				Subject:  cert.Subject.String(),
+				NotAfter: cert.NotAfter,
+			})
+			log.Warn("upstream certificate expires soon",
+				slog.String("subject", cert.Subject.String()),
+				slog.Time("not_after", cert.NotAfter),
+			)
+		}
+	}
+	return expiring
+}
+
+// upstreamCerts returns the certificate chain presented by a registry's
+// upstream. Connecting through the client applies SNI overrides and DNS
+// caching like for regular requests.
+func (app *App) upstreamCerts(ctx context.Context, registry string) ([]*x509.Certificate, error) {
+	upstreamURL, _ := app.upstreamAPI(registry)
+	req, err := newRequest(ctx, http.MethodHead, upstreamURL, nil)
+	if err != nil {
+		return nil, logutil.NewError(err, "new request")
+	}
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return nil, logutil.NewError(err, "do request")
+	}
+	_ = resp.Body.Close()
+	if resp.TLS == nil {
+		return nil, logutil.NewError(nil, "upstream connection is not using tls")
+	}
+	return resp.TLS.PeerCertificates, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCert(t *testing.T, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "upstream.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCheckCerts(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestApp(nil)
+	pool := x509.NewCertPool()
+	for name, notAfter := range map[string]time.Time{
+		"expiring": time.Now().Add(24 * time.Hour),
+		"valid":    time.Now().Add(365 * 24 * time.Hour),
+	} {
+		cert := newTestCert(t, notAfter)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		r.NoError(err)
+		pool.AddCert(parsed)
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		r.NoError(err)
+		app.regs[name] = u.Host
+	}
+	app.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	expiring := app.checkCerts(t.Context(), 7*24*time.Hour)
+	r.Len(expiring, 1)
+	a.Equal("expiring", expiring[0].Registry)
+	a.Equal("CN=upstream.test", expiring[0].Subject)
+	a.WithinDuration(time.Now().Add(24*time.Hour), expiring[0].NotAfter, time.Minute)
+
+	a.Empty(app.checkCerts(t.Context(), time.Hour))
+}
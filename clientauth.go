@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/authenticvision/cachistry/httputil"
+	"github.com/authenticvision/util-go/httpp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// clientAuth holds the credentials clients need to present to use the
+// proxy. It is independent of the credentials used towards upstreams.
+type clientAuth struct {
+	users map[string][]byte // bcrypt hashes by user name
+	token string
+
+	htpasswd string       // path users were loaded from, if any, see reload
+	mu       sync.RWMutex // guards users and verified against reloads
+
+	verified sync.Map // sha256 of verified user:password pairs, bcrypt is slow
+}
+
+// parseHtpasswd reads user:hash lines as written by htpasswd -B. Only bcrypt
+// hashes are supported.
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported: %w", lineNo, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseHtpasswd(f)
+}
+
+// authorized checks the request's credentials. Besides a static bearer token,
+// the token is accepted as basic auth password for any user, so that docker
+// login works with it.
+func (a *clientAuth) authorized(r *http.Request) bool {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(a.token)) == 1
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(password), []byte(a.token)) == 1 {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + ":" + password))
+	if _, ok := a.verified.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.verified.Store(key, struct{}{})
+	return true
+}
+
+// reload reads the htpasswd file again, if users were loaded from one. Users
+// whose password changed must log in with the new one right away.
+func (a *clientAuth) reload() error {
+	if a == nil || a.htpasswd == "" {
+		return nil
+	}
+	users, err := loadHtpasswd(a.htpasswd)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	a.verified.Clear()
+	return nil
+}
+
+type forwardedCredentialsKey struct{}
+
+// withForwardedCredentials makes upstream requests made with ctx authenticate
+// with creds instead of the proxy's own credentials.
+func withForwardedCredentials(ctx context.Context, creds dockerCredentials) context.Context {
+	return context.WithValue(ctx, forwardedCredentialsKey{}, creds)
+}
+
+func forwardedCredentials(ctx context.Context) (dockerCredentials, bool) {
+	creds, ok := ctx.Value(forwardedCredentialsKey{}).(dockerCredentials)
+	return creds, ok
+}
+
+// credentialsNamespace returns the cache directory of objects fetched with
+// creds, named after a hash of them. Clients only get to see it with the same
+// credentials, which the upstream accepted when the objects were fetched. The
+// hash is keyed with the cache's secret, so that directory names can't be
+// used to guess credentials offline.
+func (app *App) credentialsNamespace(creds dockerCredentials) string {
+	mac := hmac.New(sha256.New, app.namespaceKey)
+	mac.Write([]byte(creds.username + "\x00" + creds.password))
+	return cache.NamespacePrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// cachePath returns the path objects at path of registry are cached at for
+// the request, which is in the directory of the client's credentials if they
+// are forwarded to upstreams. Listings cached in memory are keyed by it, too.
+func (app *App) cachePath(r *http.Request, registry, objectPath string) string {
+	namespace := ""
+	if creds, ok := forwardedCredentials(r.Context()); ok {
+		namespace = app.credentialsNamespace(creds)
+	}
+	return path.Join(namespace, registry, objectPath)
+}
+
+// pathNamespace returns the client cache directory cachePath is in, or "" if
+// it is in the shared cache.
+func pathNamespace(cachePath string) string {
+	if dir, _, ok := strings.Cut(cachePath, "/"); ok && strings.HasPrefix(dir, cache.NamespacePrefix) {
+		return dir
+	}
+	return ""
+}
+
+// requireClientAuth rejects requests without valid client credentials, if
+// client authentication is configured. If client credentials are forwarded to
+// upstreams, any are accepted here, and passed on in the request's context.
+func (app *App) requireClientAuth(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.forwardCredentials {
+			if user, password, ok := r.BasicAuth(); ok {
+				creds := dockerCredentials{username: user, password: password}
+				return next(w, r.WithContext(withForwardedCredentials(r.Context(), creds)))
+			}
+		} else if app.clientAuth == nil || app.clientAuth.authorized(r) {
+			return next(w, r)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="cachistry"`)
+		return httputil.WriteOCIError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	}
+}
+
+// debugAuth protects the debug endpoints. These are usually available to
+// registry clients, but forwarded client credentials are accepted without
+// checking them, so the endpoints then require the admin password instead,
+// and are refused without one.
+func (app *App) debugAuth(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	if !app.forwardCredentials {
+		return app.requireClientAuth(next)
+	} else if app.adminPassword == "" {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			return httpp.Forbidden("debug endpoints require an admin password when forwarding client credentials")
+		}
+	}
+	return app.adminAuth(next)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	r := require.New(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	r.NoError(err)
+	users, err := parseHtpasswd(strings.NewReader("# comment\n\nalice:" + string(hash) + "\n"))
+	r.NoError(err)
+	r.Equal(map[string][]byte{"alice": hash}, users)
+
+	_, err = parseHtpasswd(strings.NewReader("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	r.ErrorContains(err, "line 1: only bcrypt")
+	_, err = parseHtpasswd(strings.NewReader("alice\n"))
+	r.ErrorContains(err, "line 1: expected user:hash")
+}
+
+func TestRequireClientAuth(t *testing.T) {
+	r := require.New(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	r.NoError(err)
+	app := newTestApp(nil)
+	handler := app.requireClientAuth(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+	do := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		r.NoError(handler(w, req))
+		return w
+	}
+	basic := func(user, password string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, password)
+		return req.Header
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.Header{}).Code, "auth is disabled by default")
+
+	app.clientAuth = &clientAuth{users: map[string][]byte{"alice": hash}, token: "token"}
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"anonymous", http.Header{}, http.StatusUnauthorized},
+		{"basic", basic("alice", "secret"), http.StatusOK},
+		{"basic cached", basic("alice", "secret"), http.StatusOK},
+		{"wrong password", basic("alice", "wrong"), http.StatusUnauthorized},
+		{"unknown user", basic("bob", "secret"), http.StatusUnauthorized},
+		{"bearer", http.Header{"Authorization": {"Bearer token"}}, http.StatusOK},
+		{"wrong bearer", http.Header{"Authorization": {"Bearer wrong"}}, http.StatusUnauthorized},
+		{"token as password", basic("anyone", "token"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.header)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="cachistry"`, w.Header().Get("WWW-Authenticate"))
+				assert.Contains(t, w.Body.String(), `"UNAUTHORIZED"`)
+			}
+		})
+	}
+}
+
+func TestDebugRequiresClientAuth(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	app.clientAuth = &clientAuth{token: "token"}
+	mux, _ := app.routes()
+	for _, path := range []string{"/debug/cache", "/debug/proxy", "/debug/upstream-latency", "/debug/media-types"} {
+		w := httptest.NewRecorder()
+		r.NoError(mux.ServeErrHTTP(w, httptest.NewRequest(http.MethodGet, path, nil)))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w = httptest.NewRecorder()
+		r.NoError(mux.ServeErrHTTP(w, req))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+}
+
+func TestDebugWithForwardedCredentials(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	app.forwardCredentials = true
+	mux, _ := app.routes()
+	req := httptest.NewRequest(http.MethodGet, "/debug/cache", nil)
+	req.SetBasicAuth("alice", "anything")
+	r.Error(mux.ServeErrHTTP(httptest.NewRecorder(), req))
+
+	app.adminPassword = "secret"
+	mux, _ = app.routes()
+	w := httptest.NewRecorder()
+	r.NoError(mux.ServeErrHTTP(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	r.NoError(mux.ServeErrHTTP(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestForwardClientCredentials(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.blobs = newBlobIndex()
+	app.unconditionalCacheTime = time.Hour
+	app.forwardCredentials = true
+	app.namespaceKey = []byte("key")
+	passwords := map[string]string{"alice": "secret", "bob": "secret"}
+	tokenRequests := map[string]int{}
+	requests := 0
+	var srv *httptest.Server
+	srv = newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			user, password, ok := req.BasicAuth()
+			if !ok || passwords[user] != password {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokenRequests[user]++
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(Token{Token: user})
+			return
+		}
+		user, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		if user != "alice" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "5")
+		_, _ = w.Write([]byte("hello"))
+	})
+	do := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/test/private/blobs/"+testDigest, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		req.SetPathValue("registry", "test")
+		req.SetPathValue("path", "private/blobs/"+testDigest)
+		w := httptest.NewRecorder()
+		r.NoError(app.requireClientAuth(app.proxy)(w, req))
+		return w
+	}
+
+	w := do("", "")
+	a.Equal(http.StatusUnauthorized, w.Code)
+	a.Equal(`Basic realm="cachistry"`, w.Header().Get("WWW-Authenticate"))
+
+	w = do("alice", "secret")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("hello", w.Body.String())
+	w = do("alice", "secret")
+	a.Equal("hello", w.Body.String())
+	a.Equal(1, requests, "served from alice's cache")
+
+	// neither another user nor a wrong password gets alice's copy
+	w = do("bob", "secret")
+	a.Equal(http.StatusForbidden, w.Code)
+	w = do("alice", "wrong")
+	a.Equal(http.StatusForbidden, w.Code)
+	a.Equal(2, requests)
+	a.Equal(map[string]int{"alice": 1, "bob": 1}, tokenRequests, "tokens are cached per client")
+
+	cached, err := app.cache.Get("test/private/blobs/" + testDigest)
+	r.NoError(err)
+	a.Nil(cached, "nothing is cached outside the client's namespace")
+	alice := dockerCredentials{username: "alice", password: "secret"}
+	cached, err = app.cache.Get(path.Join(app.credentialsNamespace(alice), "test/private/blobs", testDigest))
+	r.NoError(err)
+	a.NotNil(cached, "alice's copy is in alice's namespace")
+
+	namespace := app.credentialsNamespace(alice)
+	app.namespaceKey = []byte("other key")
+	a.NotEqual(namespace, app.credentialsNamespace(alice), "namespaces are keyed per instance")
+}
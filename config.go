@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/authenticvision/util-go/fmtutil"
+)
+
+// parseCacheTiers parses path=size pairs of lower cache tiers, with sizes in
+// the same format as --cache-size.
+func parseCacheTiers(specs []string) ([]cache.Tier, error) {
+	tiers := make([]cache.Tier, 0, len(specs))
+	for _, spec := range specs {
+		path, sizeStr, ok := strings.Cut(spec, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("malformed cache tier %q, expected path=size", spec)
+		}
+		size, err := fmtutil.ParseBytes(sizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("cache tier %q: %w", spec, err)
+		}
+		tiers = append(tiers, cache.Tier{Path: path, MaxBytes: size})
+	}
+	return tiers, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheTiers(t *testing.T) {
+	r := require.New(t)
+	tiers, err := parseCacheTiers([]string{"/mnt/slow=2TiB", "/mnt/archive=10TiB"})
+	r.NoError(err)
+	r.Equal([]cache.Tier{
+		{Path: "/mnt/slow", MaxBytes: 2 << 40},
+		{Path: "/mnt/archive", MaxBytes: 10 << 40},
+	}, tiers)
+	_, err = parseCacheTiers([]string{"/mnt/slow"})
+	r.ErrorContains(err, "malformed cache tier")
+	_, err = parseCacheTiers([]string{"/mnt/slow=2T"})
+	r.ErrorContains(err, `cache tier "/mnt/slow=2T"`)
+}
@@ -0,0 +1,88 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// LookupFunc resolves a host name to a list of addresses, see
+// net.Resolver.LookupHost.
+type LookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// Resolver caches host name lookups for a fixed TTL. When a refresh fails,
+// the previously resolved addresses continue to be used.
+type Resolver struct {
+	lookup LookupFunc
+	ttl    time.Duration
+	dialer net.Dialer
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+type entry struct {
+	addrs    []string
+	resolved time.Time
+}
+
+// New creates a Resolver. If lookup is nil, net.DefaultResolver is used.
+func New(ttl time.Duration, lookup LookupFunc) *Resolver {
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupHost
+	}
+	return &Resolver{
+		lookup:  lookup,
+		ttl:     ttl,
+		entries: make(map[string]entry),
+	}
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	cached, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && time.Since(cached.resolved) < r.ttl {
+		return cached.addrs, nil
+	}
+	addrs, err := r.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		if ok {
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	r.mu.Lock()
+	r.entries[host] = entry{addrs: addrs, resolved: time.Now()}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext can be used as net/http.Transport.DialContext.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedAcrossRequests(t *testing.T) {
+	r := require.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	r.NoError(err)
+
+	var lookups atomic.Int32
+	resolver := New(time.Hour, func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		assert.Equal(t, "registry.invalid", host)
+		return []string{"127.0.0.1"}, nil
+	})
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       resolver.DialContext,
+		DisableKeepAlives: true,
+	}}
+	for range 3 {
+		resp, err := client.Get("http://registry.invalid:" + srvURL.Port() + "/")
+		r.NoError(err)
+		_ = resp.Body.Close()
+	}
+	r.Equal(int32(1), lookups.Load())
+}
+
+func TestRefreshAfterTTL(t *testing.T) {
+	r := require.New(t)
+	var lookups atomic.Int32
+	fail := false
+	resolver := New(time.Nanosecond, func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		if fail {
+			return nil, errors.New("transient failure")
+		}
+		return []string{"127.0.0.1"}, nil
+	})
+	addrs, err := resolver.LookupHost(t.Context(), "registry.invalid")
+	r.NoError(err)
+	r.Equal([]string{"127.0.0.1"}, addrs)
+	time.Sleep(time.Millisecond)
+
+	// a failed refresh keeps using the previous addresses
+	fail = true
+	addrs, err = resolver.LookupHost(t.Context(), "registry.invalid")
+	r.NoError(err)
+	r.Equal([]string{"127.0.0.1"}, addrs)
+	r.Equal(int32(2), lookups.Load())
+
+	_, err = resolver.LookupHost(t.Context(), "other.invalid")
+	r.Error(err)
+}
+
+func TestDialIP(t *testing.T) {
+	r := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer func() { _ = l.Close() }()
+	resolver := New(time.Hour, func(ctx context.Context, host string) ([]string, error) {
+		return nil, errors.New("must not be called")
+	})
+	conn, err := resolver.DialContext(t.Context(), "tcp", l.Addr().String())
+	r.NoError(err)
+	_ = conn.Close()
+}
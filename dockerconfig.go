@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// dockerHubServerURL is the key Docker uses for Docker Hub credentials.
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// dockerCredentials authenticate towards a registry's auth server.
+type dockerCredentials struct {
+	username      string
+	password      string
+	identityToken string // refresh token for the OAuth2 token flow
+}
+
+// dockerConfig holds upstream credentials from a Docker config.json as
+// written by docker login, keyed by registry as configured in Registries.
+type dockerConfig struct {
+	path string       // to reload from
+	mu   sync.RWMutex // guards the fields below against reloads
+
+	auths       map[string]dockerCredentials
+	credHelpers map[string]string
+	credsStore  string
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// loadDockerConfig reads the auths, credHelpers and credsStore sections of
+// the Docker config at path.
+func loadDockerConfig(path string) (*dockerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file dockerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	d := &dockerConfig{
+		path:        path,
+		auths:       make(map[string]dockerCredentials, len(file.Auths)),
+		credHelpers: make(map[string]string, len(file.CredHelpers)),
+		credsStore:  file.CredsStore,
+	}
+	// sorted, so that the same registry written differently resolves the
+	// same way on every start
+	for _, key := range slices.Sorted(maps.Keys(file.Auths)) {
+		auth := file.Auths[key]
+		creds := dockerCredentials{
+			username:      auth.Username,
+			password:      auth.Password,
+			identityToken: auth.IdentityToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decode auth of %q: %w", key, err)
+			}
+			var ok bool
+			creds.username, creds.password, ok = strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed auth of %q, expected user:password", key)
+			}
+		}
+		if creds != (dockerCredentials{}) {
+			d.auths[dockerConfigRegistry(key)] = creds
+		}
+	}
+	for key, helper := range file.CredHelpers {
+		d.credHelpers[dockerConfigRegistry(key)] = helper
+	}
+	return d, nil
+}
+
+// dockerConfigRegistry maps a Docker config key, which may be a URL, to a
+// registry name as configured in Registries.
+func dockerConfigRegistry(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// credentials returns the credentials for registry, if any. Like Docker, a
+// credential helper configured for the registry takes precedence over the
+// credentials store, which takes precedence over the auths section.
+func (d *dockerConfig) credentials(ctx context.Context, registry string) (dockerCredentials, error) {
+	if d == nil {
+		return dockerCredentials{}, nil
+	}
+	d.mu.RLock()
+	helper, ok := d.credHelpers[registry]
+	if !ok {
+		helper = d.credsStore
+	}
+	creds := d.auths[registry]
+	d.mu.RUnlock()
+	if helper != "" {
+		helped, found, err := runCredentialHelper(ctx, helper, registry)
+		if err != nil || found {
+			return helped, err
+		}
+	}
+	return creds, nil
+}
+
+// reload reads the Docker config again, e.g. after docker login added
+// credentials.
+func (d *dockerConfig) reload() error {
+	if d == nil {
+		return nil
+	}
+	loaded, err := loadDockerConfig(d.path)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.auths, d.credHelpers, d.credsStore = loaded.auths, loaded.credHelpers, loaded.credsStore
+	return nil
+}
+
+// runCredentialHelper asks docker-credential-helper for the credentials of
+// registry, following the protocol of Docker's credential helpers.
+func runCredentialHelper(ctx context.Context, helper, registry string) (dockerCredentials, bool, error) {
+	serverURL := registry
+	if registry == "docker.io" {
+		serverURL = dockerHubServerURL
+	}
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (bytes.Contains(out, []byte("credentials not found")) ||
+		bytes.Contains(exitErr.Stderr, []byte("credentials not found"))) {
+		return dockerCredentials{}, false, nil
+	} else if err != nil {
+		return dockerCredentials{}, false, fmt.Errorf("run docker-credential-%s: %w", helper, err)
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return dockerCredentials{}, false, fmt.Errorf("parse output of docker-credential-%s: %w", helper, err)
+	}
+	// helpers store identity tokens under this user name
+	if resp.Username == "<token>" {
+		return dockerCredentials{identityToken: resp.Secret}, true, nil
+	}
+	return dockerCredentials{username: resp.Username, password: resp.Secret}, true, nil
+}
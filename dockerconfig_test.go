@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/authenticvision/cachistry/wwwauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestDockerConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+	return path
+}
+
+func TestLoadDockerConfig(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	d, err := loadDockerConfig(writeTestDockerConfig(t, `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOnB3OmQ="},
+			"ghcr.io": {"username": "gh", "password": "token"},
+			"https://quay.io": {"identitytoken": "refresh"},
+			"registry.example.com": {}
+		},
+		"credHelpers": {"123.dkr.ecr.eu-west-1.amazonaws.com": "ecr-login"}
+	}`))
+	r.NoError(err)
+	a.Equal(map[string]dockerCredentials{
+		"docker.io": {username: "hub", password: "pw:d"},
+		"ghcr.io":   {username: "gh", password: "token"},
+		"quay.io":   {identityToken: "refresh"},
+	}, d.auths)
+	a.Equal(map[string]string{"123.dkr.ecr.eu-west-1.amazonaws.com": "ecr-login"}, d.credHelpers)
+
+	_, err = loadDockerConfig(writeTestDockerConfig(t, `{"auths": {"ghcr.io": {"auth": "bm9jb2xvbg=="}}}`))
+	a.ErrorContains(err, "expected user:password")
+}
+
+func TestDockerConfigHelper(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	bin := t.TempDir()
+	helper := `#!/bin/sh
+read server
+case "$server" in
+https://index.docker.io/v1/) echo '{"ServerURL":"'$server'","Username":"hub","Secret":"helped"}' ;;
+ghcr.io) echo '{"ServerURL":"'$server'","Username":"<token>","Secret":"refresh"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	r.NoError(os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(helper), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := &dockerConfig{
+		auths:      map[string]dockerCredentials{"quay.io": {username: "file", password: "pw"}},
+		credsStore: "test",
+	}
+	creds, err := d.credentials(t.Context(), "docker.io")
+	r.NoError(err)
+	a.Equal(dockerCredentials{username: "hub", password: "helped"}, creds)
+	creds, err = d.credentials(t.Context(), "ghcr.io")
+	r.NoError(err)
+	a.Equal(dockerCredentials{identityToken: "refresh"}, creds)
+	creds, err = d.credentials(t.Context(), "quay.io")
+	r.NoError(err)
+	a.Equal(dockerCredentials{username: "file", password: "pw"}, creds, "falls back to auths")
+
+	d.credHelpers = map[string]string{"docker.io": "missing"}
+	_, err = d.credentials(t.Context(), "docker.io")
+	a.ErrorContains(err, "docker-credential-missing")
+}
+
+func TestFetchTokenDockerConfig(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		a.True(ok)
+		a.Equal("user", user)
+		a.Equal("secret", password)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token":"authenticated"}`))
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	app.dockerConfig = &dockerConfig{auths: map[string]dockerCredentials{
+		"registry.example.com": {username: "user", password: "secret"},
+	}}
+	token, err := app.fetchToken(t.Context(), "registry.example.com", wwwauth.WWWAuthenticate{
+		Realm:   srv.URL + "/token",
+		Service: "registry.example.com",
+	})
+	r.NoError(err)
+	a.Equal("authenticated", token.Bearer())
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/authenticvision/util-go/fmtutil"
+)
+
+// fsck evicts corrupt files from the cache, verifying blobs against the
+// digest in their path, and logs what it found.
+func (app *App) fsck() error {
+	result, err := app.cache.Fsck(blobDigest)
+	if err != nil {
+		return err
+	}
+	log := slog.With(
+		slog.Int("checked", result.Checked),
+		slog.Int("corrupt", result.Corrupt),
+		slog.String("reclaimed", fmtutil.FormatBytes(result.ReclaimedBytes)),
+	)
+	if result.Corrupt > 0 {
+		log.Warn("evicted corrupt files from the cache")
+	} else {
+		log.Info("no corrupt files in the cache")
+	}
+	return nil
+}
@@ -8,6 +8,9 @@ require (
 	github.com/mologie/ttlmap-go v0.1.0
 	github.com/spf13/cobra v1.10.1
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.43.0
+	golang.org/x/net v0.46.0
+	golang.org/x/sync v0.17.0
 	golang.org/x/sys v0.37.0
 )
 
@@ -23,5 +26,6 @@ require (
 	github.com/mologie/nicecmd v0.2.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
+	golang.org/x/text v0.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type health struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	UsedBytes uint64 `json:"used_bytes"`
+	MaxBytes  uint64 `json:"max_bytes"`
+}
+
+// healthz reports whether the cache is usable, so that orchestrators can stop
+// routing to or restart an instance whose cache volume failed.
+func (app *App) healthz(w http.ResponseWriter, r *http.Request) error {
+	stats := app.cache.Stats()
+	h := health{
+		Status:    "ok",
+		UsedBytes: stats.UsedBytes,
+		MaxBytes:  stats.MaxBytes,
+	}
+	status := http.StatusOK
+	if err := app.cache.CheckWritable(); err != nil {
+		h.Status = "unavailable"
+		h.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(h)
+}
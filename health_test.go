@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthz(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+	app := newTestApp(http.DefaultClient)
+	var err error
+	app.cache, err = cache.NewCache(dir, 1<<20)
+	r.NoError(err)
+	storeTestFile(t, app.cache, "test/foo", "text/plain", "foo")
+
+	check := func() (int, health) {
+		w := httptest.NewRecorder()
+		r.NoError(app.healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil)))
+		var h health
+		r.NoError(json.NewDecoder(w.Body).Decode(&h))
+		return w.Code, h
+	}
+	code, h := check()
+	a.Equal(http.StatusOK, code)
+	a.Equal(health{Status: "ok", UsedBytes: 3, MaxBytes: 1 << 20}, h)
+
+	// simulate the cache volume disappearing
+	r.NoError(os.RemoveAll(filepath.Join(dir, "-")))
+	code, h = check()
+	a.Equal(http.StatusServiceUnavailable, code)
+	a.Equal("unavailable", h.Status)
+	a.NotEmpty(h.Error)
+}
@@ -0,0 +1,48 @@
+package httputil
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CanonicalETag returns etag in the entity-tag syntax of RFC 9110, which
+// clients and servers parse in If-None-Match. Registries sometimes send the
+// opaque tag unquoted, or the weak prefix in lower case, which would never
+// match. Weak ETags stay weak: If-None-Match uses the weak comparison, so they
+// revalidate fine, while If-Range and If-Match correctly reject them. ok is
+// false if etag can't be made into an entity-tag, e.g. for quotes inside it.
+func CanonicalETag(etag string) (canonical string, ok bool) {
+	etag = strings.TrimSpace(etag)
+	weak := strings.HasPrefix(etag, "W/") || strings.HasPrefix(etag, "w/")
+	if weak {
+		etag = etag[2:]
+	}
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		etag = etag[1 : len(etag)-1]
+	}
+	if etag == "" {
+		return "", false
+	}
+	for i := 0; i < len(etag); i++ {
+		// etagc = %x21 / %x23-7E / obs-text
+		if c := etag[i]; c == '"' || c <= 0x20 || c == 0x7f {
+			return "", false
+		}
+	}
+	if weak {
+		return `W/"` + etag + `"`, true
+	}
+	return `"` + etag + `"`, true
+}
+
+// SetETag sets the ETag header of h to the canonical form of etag, or removes
+// it if etag is empty or malformed beyond repair. Only what clients see is
+// canonicalized: upstreams get their ETags back as they sent them, since some
+// compare If-None-Match byte by byte.
+func SetETag(h http.Header, etag string) {
+	if canonical, ok := CanonicalETag(etag); ok {
+		h.Set("ETag", canonical)
+	} else {
+		h.Del("ETag")
+	}
+}
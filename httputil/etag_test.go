@@ -0,0 +1,41 @@
+package httputil
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalETag(t *testing.T) {
+	tests := []struct {
+		etag      string
+		canonical string
+		ok        bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `W/"abc"`, true},
+		{`abc`, `"abc"`, true},
+		{`w/"abc"`, `W/"abc"`, true},
+		{`W/abc`, `W/"abc"`, true},
+		{` "sha256:abc" `, `"sha256:abc"`, true},
+		{`""`, "", false},
+		{`"a"b"`, "", false},
+		{`a b`, "", false},
+		{``, "", false},
+	}
+	for _, tt := range tests {
+		canonical, ok := CanonicalETag(tt.etag)
+		assert.Equal(t, tt.canonical, canonical, tt.etag)
+		assert.Equal(t, tt.ok, ok, tt.etag)
+	}
+}
+
+func TestSetETag(t *testing.T) {
+	a := assert.New(t)
+	h := http.Header{}
+	SetETag(h, "abc")
+	a.Equal(`"abc"`, h.Get("ETag"))
+	SetETag(h, `"a"b"`)
+	a.NotContains(h, "Etag")
+}
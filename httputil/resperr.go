@@ -1,28 +1,116 @@
 package httputil
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
+	"strings"
 )
 
 type Error struct {
 	StatusCode int
 	Message    string
+	Errors     []OCIError // parsed from JSON bodies, if any
+}
+
+// OCIError is an entry of the error response body defined by the OCI
+// distribution spec.
+type OCIError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
 }
 
 func (e Error) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("http status %d: %s", e.StatusCode, strings.Join(e.Codes(), ", "))
+	}
 	return fmt.Sprintf("http status %d: %s", e.StatusCode, e.Message)
 }
 
+// Codes returns the OCI error codes of the response, e.g. MANIFEST_UNKNOWN.
+func (e Error) Codes() []string {
+	codes := make([]string, len(e.Errors))
+	for i, ociErr := range e.Errors {
+		codes[i] = ociErr.Code
+	}
+	return codes
+}
+
+// DefaultMaxErrorBody is how much of an error body ResponseAsError reads.
+const DefaultMaxErrorBody = 4 * 1024
+
+// maxErrorDrain bounds how much of an overlong error body is discarded to
+// allow reusing the connection. Larger bodies are cut off instead.
+const maxErrorDrain = 64 * 1024
+
 // ResponseAsError packs an http.Response into an error. It assumes the user
 // has checked the status code already. It reads up to 4KiB of body as error
-// message and closes the body.
+// message and closes the body. JSON bodies in the OCI error format are parsed
+// into Error.Errors.
 func ResponseAsError(resp *http.Response) error {
-	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+	return ResponseAsErrorLimit(resp, DefaultMaxErrorBody)
+}
+
+// ResponseAsErrorLimit is like ResponseAsError, but reads up to limit bytes
+// of body. A limit <= 0 selects DefaultMaxErrorBody.
+func ResponseAsErrorLimit(resp *http.Response, limit int64) error {
+	if limit <= 0 {
+		limit = DefaultMaxErrorBody
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	truncated := int64(len(msg)) > limit
+	if truncated {
+		msg = msg[:limit]
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorDrain))
+	}
 	_ = resp.Body.Close()
-	return &Error{
+	err := &Error{
 		StatusCode: resp.StatusCode,
 		Message:    string(msg),
 	}
+	if truncated {
+		err.Message += "… (truncated)"
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mimeType == "application/json" {
+		var body struct {
+			Errors []OCIError `json:"errors"`
+		}
+		if json.Unmarshal(msg, &body) == nil {
+			err.Errors = body.Errors
+		}
+	}
+	return err
+}
+
+// IsOCICode reports whether err is an Error carrying the given OCI error code.
+func IsOCICode(err error, code string) bool {
+	var httpErr *Error
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return slices.ContainsFunc(httpErr.Errors, func(e OCIError) bool {
+		return e.Code == code
+	})
+}
+
+// WriteOCIError responds with status and an error body in the format of the
+// OCI distribution spec, which registry clients show to users.
+func WriteOCIError(w http.ResponseWriter, status int, code string, message string) error {
+	return WriteOCIErrors(w, status, []OCIError{{Code: code, Message: message}})
+}
+
+// WriteOCIErrors is like WriteOCIError, but for several errors, e.g. those of
+// an upstream response.
+func WriteOCIErrors(w http.ResponseWriter, status int, errs []OCIError) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(struct {
+		Errors []OCIError `json:"errors"`
+	}{errs})
 }
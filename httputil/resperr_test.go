@@ -0,0 +1,71 @@
+package httputil
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newResponse(status int, contentType string, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestResponseAsErrorOCI(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	err := ResponseAsError(newResponse(http.StatusNotFound, "application/json; charset=utf-8",
+		`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"tag":"latest"}}]}`))
+	var httpErr *Error
+	r.ErrorAs(err, &httpErr)
+	a.Equal([]string{"MANIFEST_UNKNOWN"}, httpErr.Codes())
+	a.Equal("manifest unknown", httpErr.Errors[0].Message)
+	a.JSONEq(`{"tag":"latest"}`, string(httpErr.Errors[0].Detail))
+	a.Equal("http status 404: MANIFEST_UNKNOWN", err.Error())
+	a.True(IsOCICode(err, "MANIFEST_UNKNOWN"))
+	a.True(IsOCICode(fmt.Errorf("wrapped: %w", err), "MANIFEST_UNKNOWN"))
+	a.False(IsOCICode(err, "UNAUTHORIZED"))
+}
+
+func TestResponseAsErrorPlain(t *testing.T) {
+	a := assert.New(t)
+	err := ResponseAsError(newResponse(http.StatusBadGateway, "text/plain", `{"errors":[{"code":"UNAUTHORIZED"}]}`))
+	a.False(IsOCICode(err, "UNAUTHORIZED"))
+	a.Equal(`http status 502: {"errors":[{"code":"UNAUTHORIZED"}]}`, err.Error())
+
+	err = ResponseAsError(newResponse(http.StatusBadGateway, "application/json", `not json`))
+	a.Equal(`http status 502: not json`, err.Error())
+}
+
+func TestResponseAsErrorTruncated(t *testing.T) {
+	a := assert.New(t)
+	err := ResponseAsError(newResponse(http.StatusBadGateway, "text/plain", strings.Repeat("x", 4*1024)))
+	a.Equal("http status 502: "+strings.Repeat("x", 4*1024), err.Error())
+
+	err = ResponseAsError(newResponse(http.StatusBadGateway, "text/plain", strings.Repeat("x", 5*1024)))
+	a.Equal("http status 502: "+strings.Repeat("x", 4*1024)+"… (truncated)", err.Error())
+}
+
+func TestResponseAsErrorLimit(t *testing.T) {
+	a := assert.New(t)
+	err := ResponseAsErrorLimit(newResponse(http.StatusBadGateway, "text/plain", "0123456789"), 4)
+	a.Equal("http status 502: 0123… (truncated)", err.Error())
+
+	err = ResponseAsErrorLimit(newResponse(http.StatusBadGateway, "text/plain", "0123"), 4)
+	a.Equal("http status 502: 0123", err.Error())
+
+	body := `{"errors":[{"code":"DENIED","detail":"` + strings.Repeat("x", 5*1024) + `"}]}`
+	err = ResponseAsErrorLimit(newResponse(http.StatusForbidden, "application/json", body), 8*1024)
+	a.True(IsOCICode(err, "DENIED"), "large structured errors must be parsed with a larger limit")
+
+	err = ResponseAsErrorLimit(newResponse(http.StatusBadGateway, "text/plain", strings.Repeat("x", 5*1024)), 0)
+	a.Equal("http status 502: "+strings.Repeat("x", 4*1024)+"… (truncated)", err.Error())
+}
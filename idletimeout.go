@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errUpstreamStalled is the cause of upstream requests canceled by
+// watchIdle.
+var errUpstreamStalled = errors.New("upstream response body stalled")
+
+// watchIdle makes reading the body of resp fail once it makes no progress for
+// timeout, by canceling its request through cancel. Unlike a deadline, this
+// doesn't limit slow but steady downloads of large layers. A timeout <= 0
+// disables this.
+func watchIdle(ctx context.Context, resp *http.Response, cancel context.CancelCauseFunc, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	resp.Body = &idleReader{
+		ReadCloser: resp.Body,
+		ctx:        ctx,
+		timer:      time.AfterFunc(timeout, func() { cancel(errUpstreamStalled) }),
+		timeout:    timeout,
+	}
+}
+
+type idleReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && errors.Is(context.Cause(r.ctx), errUpstreamStalled) {
+		err = errUpstreamStalled
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.upstreamIdleTimeout = 100 * time.Millisecond
+	stalled := make(chan struct{})
+	const content = "0123456789"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Length", "10")
+		for i := range content {
+			_, _ = w.Write([]byte{content[i]})
+			w.(http.Flusher).Flush()
+			if strings.HasSuffix(req.URL.Path, "/stalled") && i == 4 {
+				<-stalled
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	})
+	// runs before the upstream is closed, which waits for its handlers
+	t.Cleanup(func() { close(stalled) })
+
+	// slower in total than the timeout, but steadily progressing
+	w, err := proxyRequest(app, "foo/manifests/steady", nil)
+	r.NoError(err)
+	a.Equal(content, w.Body.String())
+
+	_, err = proxyRequest(app, "foo/manifests/stalled", nil)
+	r.ErrorIs(err, errUpstreamStalled)
+	cached, err := app.cache.Peek("test/foo/manifests/stalled")
+	r.NoError(err)
+	a.Nil(cached)
+}
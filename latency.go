@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets, from
+// a cached token on a nearby mirror up to a large layer over a slow link.
+var latencyBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// histogram counts durations into latencyBuckets.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // the last one for durations beyond all buckets
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+type histogramBucket struct {
+	LE    float64 `json:"le"`    // upper bound in seconds
+	Count uint64  `json:"count"` // cumulative, like Prometheus buckets
+}
+
+type histogramJSON struct {
+	Count      uint64            `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+	Buckets    []histogramBucket `json:"buckets"` // the count includes durations beyond the last one
+}
+
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	v := histogramJSON{Count: h.count, SumSeconds: h.sum.Seconds()}
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i]
+		v.Buckets = append(v.Buckets, histogramBucket{LE: le.Seconds(), Count: cumulative})
+	}
+	return json.Marshal(v)
+}
+
+// roundTripLatency is the latency of one kind of upstream round trip.
+type roundTripLatency struct {
+	TTFB  histogram `json:"ttfb"`  // until the response headers arrived
+	Total histogram `json:"total"` // until the response was handled in full
+}
+
+func (rt *roundTripLatency) observe(ttfb, total time.Duration) {
+	rt.TTFB.observe(ttfb)
+	rt.Total.observe(total)
+}
+
+type registryLatency struct {
+	// Preflight requests, whose total includes fetching a token.
+	Preflight roundTripLatency `json:"preflight"`
+	// Requests for manifests and blobs, whose total includes reading the
+	// body, at the pace the client takes it.
+	Fetch roundTripLatency `json:"fetch"`
+}
+
+// upstreamLatency records the latency of upstream round trips by registry.
+// The zero value is ready to use.
+type upstreamLatency struct {
+	mu         sync.Mutex
+	registries map[string]*registryLatency
+}
+
+func (l *upstreamLatency) observePreflight(registry string, ttfb, total time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.registry(registry).Preflight.observe(ttfb, total)
+}
+
+func (l *upstreamLatency) observeFetch(registry string, ttfb, total time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.registry(registry).Fetch.observe(ttfb, total)
+}
+
+// registry returns the latencies of name, l.mu must be held.
+func (l *upstreamLatency) registry(name string) *registryLatency {
+	if l.registries == nil {
+		l.registries = make(map[string]*registryLatency)
+	}
+	reg, ok := l.registries[name]
+	if !ok {
+		reg = &registryLatency{}
+		l.registries[name] = reg
+	}
+	return reg
+}
+
+func (app *App) listUpstreamLatency(w http.ResponseWriter, r *http.Request) error {
+	app.latency.mu.Lock()
+	data, err := json.Marshal(app.latency.registries)
+	app.latency.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	var h histogram
+	h.observe(time.Millisecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(200 * time.Millisecond)
+	h.observe(time.Hour)
+	data, err := json.Marshal(&h)
+	r.NoError(err)
+	var v histogramJSON
+	r.NoError(json.Unmarshal(data, &v))
+	a.Equal(uint64(4), v.Count)
+	a.InDelta(3600.206, v.SumSeconds, 1e-9)
+	r.Len(v.Buckets, len(latencyBuckets))
+	a.Equal(histogramBucket{LE: 0.005, Count: 2}, v.Buckets[0])
+	a.Equal(histogramBucket{LE: 0.1, Count: 2}, v.Buckets[4])
+	a.Equal(histogramBucket{LE: 0.25, Count: 3}, v.Buckets[5])
+	a.Equal(histogramBucket{LE: 300, Count: 3}, v.Buckets[len(v.Buckets)-1])
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len("hello")))
+		_, _ = w.Write([]byte("hello"))
+	})
+	entry := &accessLog{}
+	req := httptest.NewRequest(http.MethodGet, "/v2/test/foo/blobs/"+testDigest, nil)
+	req = req.WithContext(withAccessLog(req.Context(), entry))
+	req.SetPathValue("registry", "test")
+	req.SetPathValue("path", "foo/blobs/"+testDigest)
+	r.NoError(app.proxy(httptest.NewRecorder(), req))
+	a.Positive(entry.preflight)
+	a.Positive(entry.upstreamTTFB)
+
+	w := httptest.NewRecorder()
+	r.NoError(app.listUpstreamLatency(w, httptest.NewRequest(http.MethodGet, "/debug/upstream-latency", nil)))
+	var latency map[string]map[string]map[string]histogramJSON
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &latency))
+	for _, kind := range []string{"preflight", "fetch"} {
+		for _, phase := range []string{"ttfb", "total"} {
+			a.Equal(uint64(1), latency["test"][kind][phase].Count, kind+" "+phase)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/authenticvision/util-go/httpmw"
+	"github.com/authenticvision/util-go/httpp"
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// newServer returns a server for handler with the middlewares which
+// mainutil.ListenAndServe applies to the main listener, so that failed
+// requests are logged and reported the same way.
+func newServer(ctx context.Context, handler httpp.Handler) *http.Server {
+	return &http.Server{
+		Handler: httpp.NeverErrors(httpmw.Chain(handler,
+			httpmw.NewCompressionMiddleware(),
+			httpmw.NewPanicMiddleware(),
+			httpmw.NewLogMiddleware(logutil.FromContext(ctx)),
+		)),
+	}
+}
+
+// serveUntilDone runs serve until ctx is done, then shuts srv down.
+func serveUntilDone(ctx context.Context, srv *http.Server, serve func() error) error {
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	err := serve()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// listen binds addr and serves handler over plain HTTP on it in the
+// background until ctx is done. Binding happens right away, so that a
+// misconfigured address fails startup instead of only being logged.
+func (app *App) listen(ctx context.Context, addr string, handler httpp.Handler) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := newServer(ctx, handler)
+	go func() {
+		err := serveUntilDone(ctx, srv, func() error { return srv.Serve(ln) })
+		if err != nil {
+			slog.Error("failed to serve HTTP", slog.String("addr", addr), slog.Any("error", err))
+		}
+	}()
+	return ln, nil
+}
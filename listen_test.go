@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/authenticvision/util-go/httpp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	mux, admin := app.routes()
+	a.Same(mux, admin, "without an admin address, everything is served together")
+
+	app.adminBindAddr = "127.0.0.1:0"
+	mux, admin = app.routes()
+	get := func(h httpp.Handler, path string) int {
+		w := httptest.NewRecorder()
+		r.NoError(h.ServeErrHTTP(w, httptest.NewRequest(http.MethodGet, path, nil)))
+		return w.Code
+	}
+	a.Equal(http.StatusNotFound, get(mux, "/debug/cache"))
+	a.Equal(http.StatusOK, get(admin, "/debug/cache"))
+	a.Equal(http.StatusOK, get(mux, "/v2/"))
+	a.Equal(http.StatusNotFound, get(admin, "/v2/"))
+	a.Equal(http.StatusOK, get(mux, "/healthz"))
+	a.Equal(http.StatusOK, get(admin, "/healthz"))
+}
+
+func TestListen(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mux, _ := app.routes()
+	ln, err := app.listen(ctx, "127.0.0.1:0", mux)
+	r.NoError(err)
+	resp, err := http.Get("http://" + ln.Addr().String() + "/healthz")
+	r.NoError(err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = app.listen(ctx, ln.Addr().String(), mux)
+	r.Error(err, "binding failures are reported right away")
+}
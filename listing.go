@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/authenticvision/cachistry/httputil"
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// listPathRe matches the catalog, tag list and referrers endpoints, whose
+// responses change frequently and are paginated. Referrers of a manifest
+// appear whenever a signature, SBOM or attestation is pushed for it.
+var listPathRe = regexp.MustCompile(`^(_catalog|.+/tags/list|.+/referrers/` + digestExpr + `)$`)
+
+// maxListBody bounds listings kept in memory.
+const maxListBody = 16 << 20
+
+type listResponse struct {
+	contentType string
+	link        string
+	filters     string // OCI-Filters-Applied of referrers responses
+	body        []byte
+	fetchedAt   time.Time
+}
+
+// proxyList proxies a catalog, tag list or referrers request. Listings are
+// cached in memory for a short time only, and per page and filter.
+func (app *App) proxyList(w http.ResponseWriter, r *http.Request, registry, path string) error {
+	scope := logutil.NewScope("list", slog.String("registry", registry), slog.String("path", path))
+	log := scope.Log(requestLog(r.Context()))
+
+	apiURL, ok := app.upstreamAPI(registry)
+	if !ok {
+		return httputil.WriteOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "registry not proxied")
+	}
+	query := url.Values{}
+	for _, key := range []string{"n", "last", "artifactType"} {
+		if value := r.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	cacheKey := app.cachePath(r, registry, path) + "?" + query.Encode()
+
+	access := accessLogFromContext(r.Context())
+	list, ok := app.loadList(cacheKey)
+	if ok {
+		log.Debug("serving listing from cache")
+		access.setDecision(decisionHit)
+	} else if app.offline {
+		access.setDecision(decisionMiss)
+		return httputil.WriteOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "listing not cached, and offline")
+	} else {
+		access.setDecision(decisionMiss)
+		if ok, retryAfter := app.rateLimits.take(registry); !ok {
+			log.Warn("rejecting listing, upstream request budget exhausted")
+			return writeRateLimited(w, retryAfter)
+		}
+		release, err := app.upstreamLimit.acquire(r.Context())
+		if errors.Is(err, errUpstreamBusy) {
+			log.Warn("rejecting listing, upstream busy")
+			return httputil.WriteOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", err.Error())
+		} else if err != nil {
+			return scope.Err(err, "wait for upstream")
+		}
+		list, err = app.fetchList(r, registry, apiURL, path, query)
+		release()
+		if err != nil && app.upstreamErrors != nil {
+			app.upstreamErrors.Record(registry, path, err)
+		}
+		if err != nil {
+			return scope.Err(&upstreamFailure{err}, "fetch listing")
+		}
+		if app.listCache != nil {
+			app.listCache.Store(cacheKey, list)
+		}
+	}
+
+	w.Header().Set("Content-Type", list.contentType)
+	if list.link != "" {
+		w.Header().Set("Link", rewriteLink(list.link, apiURL.Path, registry))
+	}
+	if list.filters != "" {
+		// tells clients whether they have to filter by artifactType
+		// themselves
+		w.Header().Set("OCI-Filters-Applied", list.filters)
+	}
+	_, err := w.Write(list.body)
+	return err
+}
+
+func (app *App) loadList(cacheKey string) (listResponse, bool) {
+	if app.listCache == nil {
+		return listResponse{}, false
+	}
+	list, ok := app.listCache.Load(cacheKey)
+	if !ok || time.Since(list.fetchedAt) >= app.listCacheTTL {
+		return listResponse{}, false
+	}
+	return list, true
+}
+
+func (app *App) fetchList(r *http.Request, registry string, apiURL *url.URL, path string, query url.Values) (listResponse, error) {
+	upstreamURL := apiURL.JoinPath(path)
+	upstreamURL.RawQuery = query.Encode()
+	token, err := app.preflight(r.Context(), registry, upstreamURL)
+	if err != nil {
+		return listResponse{}, logutil.NewError(err, "preflight")
+	}
+	req, err := newRequest(r.Context(), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return listResponse{}, logutil.NewError(err, "new request")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.client.Do(req)
+	if err == nil {
+		accessLogFromContext(r.Context()).setUpstreamStatus(resp.StatusCode)
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = httputil.ResponseAsErrorLimit(resp, app.maxErrorBody)
+	}
+	if err != nil {
+		return listResponse{}, logutil.NewError(err, "do request")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListBody+1))
+	if err != nil {
+		return listResponse{}, logutil.NewError(err, "read body")
+	}
+	if len(body) > maxListBody {
+		return listResponse{}, logutil.NewError(nil, "listing too large")
+	}
+	return listResponse{
+		contentType: resp.Header.Get("Content-Type"),
+		link:        resp.Header.Get("Link"),
+		filters:     resp.Header.Get("OCI-Filters-Applied"),
+		body:        body,
+		fetchedAt:   time.Now(),
+	}, nil
+}
+
+// rewriteLink rewrites the URL of a pagination Link header like
+// `</v2/_catalog?last=b&n=2>; rel="next"` to point at this proxy's path for
+// the registry. Absolute URLs to the upstream are made relative. apiPath is
+// the upstream's API path, /v2/ unless it has a path prefix.
+func rewriteLink(link string, apiPath string, registry string) string {
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start != 0 || end < start {
+		return link
+	}
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return link
+	}
+	rest, ok := strings.CutPrefix(u.Path, apiPath)
+	if !ok {
+		return link
+	}
+	next := url.URL{Path: "/v2/" + registry + "/" + rest, RawQuery: u.RawQuery}
+	return "<" + next.String() + ">" + link[end+1:]
+}
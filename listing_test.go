@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mologie/ttlmap-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteLink(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(`</v2/test/_catalog?last=b&n=2>; rel="next"`,
+		rewriteLink(`</v2/_catalog?last=b&n=2>; rel="next"`, "/v2/", "test"))
+	a.Equal(`</v2/test/foo/bar/tags/list?last=v1&n=1>; rel="next"`,
+		rewriteLink(`<https://upstream.example.com/v2/foo/bar/tags/list?last=v1&n=1>; rel="next"`, "/v2/", "test"))
+	a.Equal(`</v2/test/foo/tags/list?n=1>; rel="next"`,
+		rewriteLink(`</artifacts/v2/foo/tags/list?n=1>; rel="next"`, "/artifacts/v2/", "test"))
+	a.Equal(`garbage`, rewriteLink(`garbage`, "/v2/", "test"))
+}
+
+func TestProxyList(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.listCacheTTL = time.Hour
+	app.listCache = ttlmap.New[string, listResponse](app.listCacheTTL)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		a.Equal("/v2/foo/tags/list", req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("last") == "" {
+			a.Equal("1", req.URL.Query().Get("n"))
+			w.Header().Set("Link", `</v2/foo/tags/list?last=v1&n=1>; rel="next"`)
+			_, _ = w.Write([]byte(`{"name":"foo","tags":["v1"]}`))
+		} else {
+			a.Equal("v1", req.URL.Query().Get("last"))
+			_, _ = w.Write([]byte(`{"name":"foo","tags":["v2"]}`))
+		}
+	})
+	list := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/test/foo/tags/list?"+query, nil)
+		req.SetPathValue("registry", "test")
+		req.SetPathValue("path", "foo/tags/list")
+		w := httptest.NewRecorder()
+		r.NoError(app.proxy(w, req))
+		return w
+	}
+
+	w := list("n=1")
+	a.Equal(`{"name":"foo","tags":["v1"]}`, w.Body.String())
+	a.Equal(`</v2/test/foo/tags/list?last=v1&n=1>; rel="next"`, w.Header().Get("Link"))
+	w = list("last=v1&n=1")
+	a.Equal(`{"name":"foo","tags":["v2"]}`, w.Body.String())
+	a.Empty(w.Header().Get("Link"))
+	a.Equal(2, requests)
+
+	// pages are cached separately for a short time, and never on disk
+	w = list("n=1")
+	a.Equal(`{"name":"foo","tags":["v1"]}`, w.Body.String())
+	a.Equal(2, requests)
+	cached, err := app.cache.Peek("test/foo/tags/list")
+	r.NoError(err)
+	a.Nil(cached)
+
+	app.listCacheTTL = 0
+	list("n=1")
+	a.Equal(3, requests, "expired listings must be fetched again")
+}
+
+func TestProxyReferrers(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.listCacheTTL = time.Hour
+	app.listCache = ttlmap.New[string, listResponse](app.listCacheTTL)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		a.Equal("/v2/foo/referrers/"+testDigest, req.URL.Path)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		if artifactType := req.URL.Query().Get("artifactType"); artifactType != "" {
+			w.Header().Set("OCI-Filters-Applied", "artifactType")
+			_, _ = w.Write([]byte(`{"manifests":["` + artifactType + `"]}`))
+		} else {
+			_, _ = w.Write([]byte(`{"manifests":["all"]}`))
+		}
+	})
+	referrers := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/test/foo/referrers/"+testDigest+"?"+query, nil)
+		req.SetPathValue("registry", "test")
+		req.SetPathValue("path", "foo/referrers/"+testDigest)
+		w := httptest.NewRecorder()
+		r.NoError(app.proxy(w, req))
+		return w
+	}
+
+	w := referrers("")
+	a.Equal(`{"manifests":["all"]}`, w.Body.String())
+	a.Equal("application/vnd.oci.image.index.v1+json", w.Header().Get("Content-Type"))
+	a.Empty(w.Header().Get("OCI-Filters-Applied"))
+	w = referrers("artifactType=application/spdx%2Bjson")
+	a.Equal(`{"manifests":["application/spdx+json"]}`, w.Body.String())
+	a.Equal("artifactType", w.Header().Get("OCI-Filters-Applied"))
+	a.Equal(2, requests)
+
+	// filtered and unfiltered lists are cached separately, and never on disk
+	w = referrers("artifactType=application/spdx%2Bjson")
+	a.Equal("artifactType", w.Header().Get("OCI-Filters-Applied"))
+	a.Equal(2, requests)
+	cached, err := app.cache.Peek("test/foo/referrers/" + testDigest)
+	r.NoError(err)
+	a.Nil(cached)
+}
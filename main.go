@@ -2,24 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"net/url"
-	"path/filepath"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/authenticvision/cachistry/cache"
 	"github.com/authenticvision/cachistry/httputil"
-	"github.com/authenticvision/cachistry/wwwauth"
 	"github.com/authenticvision/util-go/fmtutil"
 	"github.com/authenticvision/util-go/httpp"
 	"github.com/authenticvision/util-go/logutil"
 	"github.com/authenticvision/util-go/mainutil"
 	"github.com/mologie/ttlmap-go"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/singleflight"
 )
 
 var packageScope = logutil.NewScope("coordinator")
@@ -28,224 +28,477 @@ type Config struct {
 	mainutil.LogConfig
 	mainutil.ServerConfig
 
-	Registries             []string `flag:"required" env:"-" usage:"docker.io, ghcr.io, etc"`
-	CacheDir               string   `flag:"required"`
-	CacheSize              fmtutil.Bytes
-	UnconditionalCacheTime time.Duration
+	Registries               []string `flag:"required" env:"-" usage:"docker.io, ghcr.io, etc"`
+	CacheDir                 string   `flag:"required"`
+	MaxRegistries            int      `usage:"maximum number of registries, 0 for unlimited"`
+	ListenerRegistries       []string `env:"-" usage:"address=registry pairs restricting the registries served on a listener, e.g. :5443=docker.io, all for listeners without any"`
+	AllowedRepositories      []string `env:"-" usage:"registry=pattern pairs restricting the repositories proxied from a registry, e.g. docker.io=library/* or ghcr.io=org, which allows everything below org/; registries without any are unrestricted"`
+	UpstreamPathPrefixes     []string `env:"-" usage:"registry=path pairs of upstreams serving the registry API below a path prefix, e.g. example.com=/artifacts for https://example.com/artifacts/v2/"`
+	RefreshTokens            []string `env:"-" usage:"registry=token pairs for the OAuth2 token flow"`
+	OAuthClientID            string   `usage:"client_id for the OAuth2 token flow"`
+	DockerConfig             string   `usage:"Docker config.json to read upstream credentials from, e.g. ~/.docker/config.json after docker login, including credential helpers; RefreshTokens take precedence"`
+	CacheSize                fmtutil.Bytes
+	PinnedPaths              []string      `env:"-" usage:"glob patterns of cache paths, i.e. registry/repository/..., never to evict, e.g. docker.io/library/alpine or ghcr.io/org/*; storing fails when only pinned files are left to make room"`
+	MaxCacheFiles            int           `usage:"maximum number of files in the cache, excluding lower tiers, evicting like when full beyond it, 0 for unlimited"`
+	MemoryCacheSize          fmtutil.Bytes `usage:"keep recently used manifests up to this size in total in memory, 0 to disable"`
+	MaxObjectSize            fmtutil.Bytes `usage:"proxy objects larger than this without caching them, 0 for unlimited"`
+	CompressMediaTypes       []string      `env:"-" usage:"media type patterns of objects to store gzip-compressed, e.g. application/*+json for manifests; layers are compressed already"`
+	LowerCacheTiers          []string      `env:"-" usage:"path=size pairs of slower cache tiers receiving evicted files, from hot to cold"`
+	AccountBlocks            bool          `usage:"count allocated disk blocks instead of file sizes towards cache sizes"`
+	EvictHighWatermark       float64       `usage:"fraction of cache size at which eviction starts"`
+	EvictLowWatermark        float64       `usage:"fraction of cache size down to which files are evicted"`
+	EvictionPolicy           string        `usage:"which files to evict first: lru (least recently used) or lfu (least frequently used, keeps files pulled all the time)"`
+	SyncWrites               bool          `usage:"fsync cached files before serving them from the cache, which survives power loss at the cost of throughput"`
+	StoreRetries             int           `usage:"how often to evict and retry storing a file when out of disk space"`
+	TempMaxAge               time.Duration `usage:"remove temporary files of failed downloads not written to for this long"`
+	TempSweepInterval        time.Duration `usage:"how often to look for stale temporary files, 0 to disable"`
+	UnconditionalCacheTime   time.Duration
+	Offline                  bool          `usage:"never contact upstreams, serve hits without revalidation and answer misses with 404"`
+	ReadOnlyCache            bool          `usage:"never modify the cache, e.g. one populated by another instance on a read-only mount, serving hits without revalidation"`
+	ReadOnlyMisses           string        `usage:"handling of misses of a read-only cache: proxy (without caching) or 404"`
+	StaleWhileRevalidate     bool          `usage:"serve objects due for revalidation from cache right away and revalidate them in the background for later requests"`
+	StaleGracePeriod         time.Duration `usage:"with stale-while-revalidate, serve objects stale only for this long past the unconditional cache time, and revalidate them before serving after, 0 for no limit"`
+	ListCacheTTL             time.Duration `usage:"cache catalog and tag listings for this long, 0 to disable"`
+	TagDigestTTL             time.Duration `usage:"serve tags which resolved to a manifest digest within this long from the manifest cached by digest, without asking the upstream whether the tag moved, 0 to disable"`
+	DNSCacheTTL              time.Duration `usage:"cache upstream DNS lookups for this long, 0 to disable"`
+	DebugCacheEntries        bool          `usage:"list all cached files with their metadata in eviction order at /debug/cache/entries, which reveals what is pulled through the proxy"`
+	AdminPassword            string        `usage:"enables /admin/ endpoints, protected by basic auth with user admin"`
+	SNIOverrides             []string      `env:"-" usage:"registry=servername pairs for upstreams requiring a different TLS SNI, which must not be reached through an upstream proxy"`
+	ResponseHeaderTimeout    time.Duration `usage:"fail upstream requests not sending response headers in time, 0 to disable"`
+	UpstreamIdleTimeout      time.Duration `usage:"fail upstream downloads not receiving any data for this long, regardless of their total duration, 0 to disable"`
+	MaxUpstreamRequests      int           `usage:"maximum number of concurrent upstream requests, 0 for unlimited"`
+	RateLimits               []string      `env:"-" usage:"registry=requests/period pairs limiting the rate of upstream requests, e.g. docker.io=100/6h; when exhausted, stale cache is served or requests are refused with 429"`
+	UpstreamQueueTimeout     time.Duration `usage:"how long requests wait for a free upstream request slot"`
+	UserAgent                string        `usage:"User-Agent for upstream requests"`
+	ForwardUserAgent         bool          `usage:"append the client's User-Agent to the User-Agent of upstream requests"`
+	UpstreamProxy            string        `usage:"proxy URL for upstream requests, overrides HTTP_PROXY and HTTPS_PROXY while honoring NO_PROXY"`
+	UpstreamHTTP2            bool          `usage:"negotiate HTTP/2 with upstreams supporting it, multiplexing the many small requests of a pull over one connection per host"`
+	MaxIdleConnsPerHost      int           `usage:"idle HTTP/1.1 connections to keep open per upstream host for reuse, above Go's default of 2 to fit parallel layer downloads"`
+	IdleConnTimeout          time.Duration `usage:"close idle upstream connections after this long, 0 to keep them open"`
+	CrossRegistryBlobs       bool          `usage:"serve blobs from the cache of any registry or repository with the same digest, trusting digest integrity"`
+	MaxManifestSize          fmtutil.Bytes `usage:"manifests larger than this are served and cached, but not parsed"`
+	EmptyResponses           string        `usage:"handling of empty upstream responses: cache, verify (only blobs with the empty digest) or refuse"`
+	ContentTypeMismatch      string        `usage:"handling of responses with a content type not fitting the path, e.g. an index for a blob: reject or warn"`
+	MaxErrorBody             fmtutil.Bytes `usage:"how much of upstream error bodies to read into error messages"`
+	UpstreamErrorHistory     int           `usage:"number of recent upstream errors to keep for /admin/upstream-errors"`
+	LRUJournalTimeout        time.Duration `usage:"on shutdown, spend up to this long persisting the LRU order for the next start, 0 to disable"`
+	ClientHtpasswd           string        `usage:"htpasswd file with bcrypt hashes, requires clients to authenticate"`
+	ClientToken              string        `usage:"static bearer token, requires clients to authenticate"`
+	ForwardClientCredentials bool          `usage:"authenticate to upstreams with the basic auth credentials of each client, e.g. from docker login to the proxy, instead of the proxy's own, and keep a separate cache for each, so that private objects are only served to clients the upstream let fetch them; excludes ClientHtpasswd and ClientToken; debug endpoints then require the AdminPassword"`
+	AcceptMediaTypes         []string      `env:"-" usage:"media types to forward in Accept headers, all if empty"`
+	ManifestMediaTypes       []string      `env:"-" usage:"custom manifest media types, e.g. of artifacts, to recognize and request in addition to the defaults"`
+	PrefetchAccept           []string      `env:"-" usage:"Accept header prefetching requests manifests with; manifests are cached by Accept header, so this should be what pulling clients send, containerd's and Docker's by default"`
+	CertCheckInterval        time.Duration `usage:"how often to check upstream TLS certificates for upcoming expiry, 0 to disable"`
+	CertExpiryWarning        time.Duration `usage:"warn about upstream TLS certificates expiring within this duration"`
+	ExtraBindAddrs           []string      `env:"-" usage:"further addresses to serve plain HTTP on, e.g. an IPv6 one next to an IPv4 bind address"`
+	AdminBindAddr            string        `usage:"separate address to serve the debug and admin endpoints on instead of the bind address, e.g. a private interface"`
+	TLSBindAddr              string        `usage:"address to serve HTTPS on if a TLS certificate is configured"`
+	TLSCert                  string        `usage:"PEM certificate chain for HTTPS, valid for the host name clients pull from, reloaded on change"`
+	TLSKey                   string        `usage:"PEM private key for HTTPS"`
+	Fsck                     bool          `usage:"check all cached files for missing metadata and blobs for content not matching their digest, evict corrupt ones, then exit instead of serving"`
+	Validate                 bool          `usage:"check that all registries are reachable and hand out tokens, then exit instead of serving, non-zero on failure"`
 }
 
 type App struct {
-	client     *http.Client
-	cache      *cache.Cache
-	regs       map[string]string
-	tokenCache *ttlmap.TTLMap[wwwauth.WWWAuthenticate, Token]
+	client             *http.Client
+	cache              *cache.Cache
+	regs               map[string]string
+	listenerRegs       map[string]map[string]bool    // allowed registries by listener address, if restricted
+	allowedRepos       map[string][]string           // allowed repository patterns by registry, of restricted ones
+	tokenCache         *ttlmap.TTLMap[string, Token] // entries are valid until their ExpiresAt
+	tokenFlights       singleflight.Group
+	latency            upstreamLatency
+	blobs              *blobIndex    // nil unless cross-registry blobs are enabled
+	clientAuth         *clientAuth   // nil unless client authentication is enabled
+	forwardCredentials bool          // pass client credentials on to upstreams, see requireClientAuth
+	namespaceKey       []byte        // keys credentialsNamespace, kept with the cache
+	tlsCerts           *certReloader // nil unless HTTPS is enabled
+	memCache           *memCache     // nil if disabled
+	tlsBindAddr        string
+	extraBindAddrs     []string
+	adminBindAddr      string
+	upstreamErrors     *upstreamErrors  // nil if disabled
+	upstreamLimit      *upstreamLimiter // nil if unlimited
+	rateLimits         rateLimits       // by registry, only of rate limited ones
+	refreshTokens      map[string]string
+	dockerConfig       *dockerConfig // nil unless configured
+	oauthClientID      string
+	adminPassword      string
+	cacheEntries       bool // serve /debug/cache/entries
+
+	unconditionalCacheTime time.Duration
+	offline                bool
+	readOnlyMisses         string // handling of misses if the cache is read-only
+	staleWhileRevalidate   bool
+	staleGracePeriod       time.Duration
+	listCache              *ttlmap.TTLMap[string, listResponse] // nil if disabled
+	listCacheTTL           time.Duration
+	tagDigests             *ttlmap.TTLMap[string, tagDigest] // nil if disabled
+	tagDigestTTL           time.Duration
+	maxManifestSize        int64
+	maxObjectSize          uint64
+	maxErrorBody           int64
+	emptyResponses         string
+	contentTypeMismatch    string
+	lruJournalTimeout      time.Duration
+	tempMaxAge             time.Duration
+	upstreamIdleTimeout    time.Duration
+	acceptMediaTypes       []string
+	prefetchAccept         []string
+	userAgent              string
+	forwardUserAgent       bool
+	mediaTypes             mediaTypes
+
+	backgroundFetches sync.Map // cache paths being fetched in the background
+	clientDisconnects atomic.Uint64
 }
 
 func main() {
 	app := App{
 		client:     http.DefaultClient,
-		regs:       make(map[string]string),
-		tokenCache: ttlmap.New[wwwauth.WWWAuthenticate, Token](5 * time.Minute),
+		tokenCache: ttlmap.New[string, Token](maxTokenTTL),
 	}
-	cmd := mainutil.RootCommand(app.setup, mainutil.Server(app.run), cobra.Command{
+	serve := mainutil.Server(app.run)
+	cmd := mainutil.RootCommand(app.setup, func(cfg *Config, cmd *cobra.Command, args []string) error {
+		if cfg.Validate {
+			if err := app.validateUpstreams(cmd.Context()); err != nil {
+				return err
+			}
+			slog.Info("all upstreams passed the check")
+			return nil
+		}
+		// mainutil.Run exits the process right after the command returns
+		defer app.saveJournal()
+		if cfg.Fsck {
+			if err := app.fsck(); err != nil {
+				return fmt.Errorf("check cache: %w", err)
+			}
+			return nil
+		}
+		return serve(cfg, cmd, args)
+	}, cobra.Command{
 		Use: "cachistry",
 	}, Config{
 		LogConfig: mainutil.LogDefault,
 		ServerConfig: mainutil.ServerConfig{
 			BindAddr: "127.0.0.1:5000",
 		},
+		MaxRegistries:          64,
+		OAuthClientID:          "cachistry",
 		CacheSize:              1 << 30,
+		MemoryCacheSize:        16 << 20,
+		EvictHighWatermark:     1,
+		EvictLowWatermark:      1,
+		EvictionPolicy:         string(cache.EvictLRU),
+		StoreRetries:           1,
+		TempMaxAge:             time.Hour,
+		TempSweepInterval:      10 * time.Minute,
 		UnconditionalCacheTime: 5 * time.Minute,
+		ListCacheTTL:           5 * time.Second,
+		TagDigestTTL:           30 * time.Second,
+		UserAgent:              defaultUserAgent,
+		UpstreamQueueTimeout:   30 * time.Second,
+		UpstreamIdleTimeout:    time.Minute,
+		UpstreamHTTP2:          true,
+		MaxIdleConnsPerHost:    32,
+		IdleConnTimeout:        90 * time.Second,
+		MaxManifestSize:        4 << 20,
+		ReadOnlyMisses:         readOnlyMissesProxy,
+		EmptyResponses:         emptyResponsesVerify,
+		ContentTypeMismatch:    contentTypeMismatchReject,
+		MaxErrorBody:           httputil.DefaultMaxErrorBody,
+		UpstreamErrorHistory:   20,
+		CertExpiryWarning:      14 * 24 * time.Hour,
+		TLSBindAddr:            "127.0.0.1:5443",
+		PrefetchAccept:         containerdManifestAccept,
 	})
 	mainutil.Run(cmd)
 }
 
-func (app *App) setup(cfg *Config, cmd *cobra.Command, args []string) (err error) {
-	app.cache, err = cache.NewCache(cfg.CacheDir, uint64(cfg.CacheSize))
-	if err != nil {
-		return fmt.Errorf("create cache: %w", err)
+// saveJournal persists the cache's LRU order after the server shut down, so
+// that recency survives restarts without relying on file access times.
+func (app *App) saveJournal() {
+	if app.cache == nil || app.lruJournalTimeout <= 0 {
+		return
 	}
-
-	for _, reg := range cfg.Registries {
-		if reg == "docker.io" {
-			app.regs[reg] = "registry-1.docker.io"
-		} else {
-			app.regs[reg] = reg
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), app.lruJournalTimeout)
+	defer cancel()
+	if err := app.cache.SaveJournal(ctx); err != nil {
+		slog.Error("failed to save LRU journal", slog.Any("error", err))
 	}
-	return nil
 }
 
-func (app *App) run(cfg *Config, cmd *cobra.Command, args []string) (httpp.Handler, error) {
-	mux := httpp.NewServeMux()
-	mux.HandleFunc("GET /v2/{$}", func(w http.ResponseWriter, r *http.Request) error {
-		return nil
-	})
-	mux.HandleFunc("GET /v2/{registry}/{path...}", func(w http.ResponseWriter, r *http.Request) error {
-		registry := r.PathValue("registry")
-		path := r.PathValue("path")
-		cachePath := filepath.Join(registry, path)
-
-		scope := logutil.NewScope("proxy", slog.String("cache_path", cachePath))
-		log := scope.Log(logutil.FromContext(r.Context()))
-
-		cached, err := app.cache.Get(cachePath)
-		if err != nil {
-			return scope.Err(err, "check cache")
-		}
-		serveFromCache := func() error {
-			log.Debug("serving from cache")
-			w.Header().Set("Content-Type", cached.MIMEType)
-			w.Header().Set("ETag", cached.ETag)
-			http.ServeFileFS(w, r, app.cache.FS(), cachePath)
-			return nil
-		}
-		revalidate := false
-		if cached != nil {
-			revalidate = cached.Validated.Add(cfg.UnconditionalCacheTime).Before(time.Now())
-			if !revalidate {
-				return serveFromCache()
-			}
-		}
-
-		reg, ok := app.regs[registry]
-		if !ok {
-			return httpp.NotFound("registry not found")
-		}
-
-		upstreamURL := (&url.URL{
-			Scheme: "https",
-			Host:   reg,
-			Path:   "/v2/",
-		}).JoinPath(path)
-		token, err := app.preflight(r.Context(), upstreamURL)
-		if revalidate && err != nil {
-			log.Warn("preflight failed, serving from cache")
-			return serveFromCache()
-		}
-		if err != nil {
-			return scope.Err(err, "preflight")
-		}
-
-		req, err := newRequest(r.Context(), http.MethodGet, upstreamURL)
-		if err != nil {
-			return scope.Err(err, "new request")
-		}
-		if revalidate {
-			req.Header.Set("If-None-Match", cached.ETag)
-		}
-		req.Header["Accept"] = r.Header.Values("Accept")
-		//req.Header.Set("Accept-Encoding", "gzip")
-		if token != "" {
-			req.Header.Set("Authorization", "Bearer "+token)
-		}
-		resp, err := app.client.Do(req)
-		if err == nil &&
-			!(resp.StatusCode == http.StatusOK ||
-				resp.StatusCode == http.StatusNotModified) {
-			err = httputil.ResponseAsError(resp)
-		}
-		if revalidate && err != nil {
-			log.Warn("proxying request failed, serving from cache")
-			return serveFromCache()
-		}
+func (app *App) setup(cfg *Config, cmd *cobra.Command, args []string) (err error) {
+	app.regs, err = parseRegistries(cfg.Registries, cfg.MaxRegistries)
+	if err != nil {
+		return fmt.Errorf("parse registries: %w", err)
+	}
+	err = parseUpstreamPrefixes(cfg.UpstreamPathPrefixes, app.regs)
+	if err != nil {
+		return fmt.Errorf("parse upstream path prefixes: %w", err)
+	}
+	app.refreshTokens, err = parseRegistryOptions(cfg.RefreshTokens, app.regs)
+	if err != nil {
+		return fmt.Errorf("parse refresh tokens: %w", err)
+	}
+	app.listenerRegs, err = parseListenerRegistries(cfg.ListenerRegistries, app.regs)
+	if err != nil {
+		return fmt.Errorf("parse listener registries: %w", err)
+	}
+	app.allowedRepos, err = parseAllowedRepositories(cfg.AllowedRepositories, app.regs)
+	if err != nil {
+		return fmt.Errorf("parse allowed repositories: %w", err)
+	}
+	app.oauthClientID = cfg.OAuthClientID
+	if cfg.DockerConfig != "" {
+		app.dockerConfig, err = loadDockerConfig(cfg.DockerConfig)
 		if err != nil {
-			return scope.Err(err, "do request")
+			return fmt.Errorf("load Docker config: %w", err)
 		}
-
-		if resp.StatusCode == http.StatusNotModified {
-			log.Debug("successfully revalidated cache")
-			err := app.cache.UpdateValidated(cachePath)
+	}
+	app.adminPassword = cfg.AdminPassword
+	app.cacheEntries = cfg.DebugCacheEntries
+	app.unconditionalCacheTime = cfg.UnconditionalCacheTime
+	app.offline = cfg.Offline
+	app.staleWhileRevalidate = cfg.StaleWhileRevalidate
+	app.staleGracePeriod = cfg.StaleGracePeriod
+	if cfg.ListCacheTTL > 0 {
+		app.listCache = ttlmap.New[string, listResponse](cfg.ListCacheTTL)
+		app.listCacheTTL = cfg.ListCacheTTL
+	}
+	if cfg.TagDigestTTL > 0 {
+		app.tagDigests = ttlmap.New[string, tagDigest](cfg.TagDigestTTL)
+		app.tagDigestTTL = cfg.TagDigestTTL
+	}
+	app.maxManifestSize = int64(cfg.MaxManifestSize)
+	app.maxObjectSize = uint64(cfg.MaxObjectSize)
+	app.maxErrorBody = int64(cfg.MaxErrorBody)
+	app.lruJournalTimeout = cfg.LRUJournalTimeout
+	app.upstreamIdleTimeout = cfg.UpstreamIdleTimeout
+	app.acceptMediaTypes = cfg.AcceptMediaTypes
+	app.prefetchAccept = cfg.PrefetchAccept
+	app.userAgent = cfg.UserAgent
+	app.forwardUserAgent = cfg.ForwardUserAgent
+	app.mediaTypes, err = newMediaTypes(cfg.ManifestMediaTypes)
+	if err != nil {
+		return fmt.Errorf("parse manifest media types: %w", err)
+	}
+	if cfg.ClientHtpasswd != "" || cfg.ClientToken != "" {
+		app.clientAuth = &clientAuth{htpasswd: cfg.ClientHtpasswd, token: cfg.ClientToken}
+		if cfg.ClientHtpasswd != "" {
+			app.clientAuth.users, err = loadHtpasswd(cfg.ClientHtpasswd)
 			if err != nil {
-				return scope.Err(err, "update cache expiry")
+				return fmt.Errorf("load htpasswd: %w", err)
 			}
-			return serveFromCache()
-		}
-
-		if revalidate {
-			log.Debug("failed to revalidate cache, proxying request")
-		} else {
-			log.Debug("proxying request")
-		}
-
-		eTag := resp.Header.Get("ETag")
-		contentType := resp.Header.Get("Content-Type")
-		contentLengthStr := resp.Header.Get("Content-Length")
-		contentLength, err := strconv.ParseUint(contentLengthStr, 10, 64)
-		if contentLengthStr == "" || err != nil {
-			return scope.Err(err, "proxied response has no content-length, this is unsupported")
-		}
-		w.Header().Set("ETag", eTag)
-		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Length", contentLengthStr)
-
-		// Note: ETag from the client isn't taken into account because neither
-		// docker nor podman use it at all. We can still use it to check
-		// upstreams though.
-
-		f, cleanup, err := app.cache.Create(contentType, eTag)
-		if err != nil {
-			return scope.Err(err, "create cache file")
 		}
-		defer cleanup()
-
-		body := io.TeeReader(resp.Body, f)
-
-		httpp.DisableCompression(w)
-
-		_, err = io.Copy(w, body)
-		if err != nil {
-			return scope.Err(err, "copy")
+	}
+	if cfg.ForwardClientCredentials && app.clientAuth != nil {
+		return errors.New("client credentials can't be forwarded to upstreams along with client authentication")
+	}
+	app.forwardCredentials = cfg.ForwardClientCredentials
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return errors.New("TLS requires both a certificate and a key")
 		}
-
-		err = app.cache.Store(f, cachePath, contentLength)
+		app.tlsCerts, err = newCertReloader(cfg.TLSCert, cfg.TLSKey)
 		if err != nil {
-			return scope.Err(err, "store cache file")
+			return fmt.Errorf("load TLS certificate: %w", err)
 		}
+		app.tlsBindAddr = cfg.TLSBindAddr
+	}
+	app.extraBindAddrs = cfg.ExtraBindAddrs
+	app.adminBindAddr = cfg.AdminBindAddr
+	switch cfg.EmptyResponses {
+	case emptyResponsesCache, emptyResponsesVerify, emptyResponsesRefuse:
+		app.emptyResponses = cfg.EmptyResponses
+	default:
+		return fmt.Errorf("invalid empty response handling %q", cfg.EmptyResponses)
+	}
+	switch cfg.ReadOnlyMisses {
+	case readOnlyMissesProxy, readOnlyMissesNotFound:
+		app.readOnlyMisses = cfg.ReadOnlyMisses
+	default:
+		return fmt.Errorf("invalid read-only cache miss handling %q", cfg.ReadOnlyMisses)
+	}
+	switch cfg.ContentTypeMismatch {
+	case contentTypeMismatchReject, contentTypeMismatchWarn:
+		app.contentTypeMismatch = cfg.ContentTypeMismatch
+	default:
+		return fmt.Errorf("invalid content type mismatch handling %q", cfg.ContentTypeMismatch)
+	}
+	app.rateLimits, err = parseRateLimits(cfg.RateLimits, app.regs)
+	if err != nil {
+		return fmt.Errorf("parse rate limits: %w", err)
+	}
+	if cfg.MaxUpstreamRequests > 0 {
+		app.upstreamLimit = newUpstreamLimiter(cfg.MaxUpstreamRequests, cfg.UpstreamQueueTimeout)
+	}
+	if cfg.UpstreamErrorHistory > 0 {
+		app.upstreamErrors = newUpstreamErrors(cfg.UpstreamErrorHistory)
+	}
 
+	transport, err := app.newTransport(cfg)
+	if err != nil {
+		return fmt.Errorf("create transport: %w", err)
+	}
+	app.client = &http.Client{Transport: transport}
+	if cfg.Validate {
+		return nil // checking the upstreams needs neither the cache nor background work
+	}
+	if err := app.setupCache(cfg, cmd); err != nil {
+		return err
+	}
+	if cfg.Fsck {
 		return nil
-	})
-	return mux, nil
+	}
+	if cfg.CertCheckInterval > 0 {
+		go app.checkCertsPeriodically(cmd.Context(), cfg.CertCheckInterval, cfg.CertExpiryWarning)
+	}
+	go app.maintainOnSIGHUP(cmd.Context())
+	return nil
 }
 
-func (app *App) preflight(ctx context.Context, upstreamURL *url.URL) (string, error) {
-	log := logutil.FromContext(ctx)
-	preflightReq, err := newRequest(ctx, http.MethodHead, upstreamURL)
+// setupCache opens the cache tiers and starts their background work.
+func (app *App) setupCache(cfg *Config, cmd *cobra.Command) (err error) {
+	lowerTiers, err := parseCacheTiers(cfg.LowerCacheTiers)
 	if err != nil {
-		return "", logutil.NewError(err, "new request")
+		return fmt.Errorf("parse cache tiers: %w", err)
 	}
-	resp, err := app.client.Do(preflightReq)
+	tiers := append([]cache.Tier{{
+		Path:     cfg.CacheDir,
+		MaxBytes: uint64(cfg.CacheSize),
+	}}, lowerTiers...)
+	for i := range tiers {
+		tiers[i].AccountBlocks = cfg.AccountBlocks
+		tiers[i].ReadOnly = cfg.ReadOnlyCache
+	}
+	app.cache, err = cache.NewTieredCache(tiers)
 	if err != nil {
-		return "", logutil.NewError(err, "do request")
+		return fmt.Errorf("create cache: %w", err)
 	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		parsed, err := wwwauth.Parse(resp.Header.Get("WWW-Authenticate"))
+	err = app.cache.SetWatermarks(cfg.EvictHighWatermark, cfg.EvictLowWatermark)
+	if err != nil {
+		return fmt.Errorf("configure eviction: %w", err)
+	}
+	err = app.cache.SetEvictionPolicy(cache.EvictionPolicy(cfg.EvictionPolicy))
+	if err != nil {
+		return fmt.Errorf("configure eviction: %w", err)
+	}
+	err = app.cache.SetPinned(cfg.PinnedPaths)
+	if err != nil {
+		return fmt.Errorf("configure eviction: %w", err)
+	}
+	err = app.cache.SetMaxFiles(cfg.MaxCacheFiles)
+	if err != nil {
+		return fmt.Errorf("configure eviction: %w", err)
+	}
+	err = app.cache.SetCompressTypes(cfg.CompressMediaTypes)
+	if err != nil {
+		return fmt.Errorf("configure compression: %w", err)
+	}
+	app.tempMaxAge = cfg.TempMaxAge
+	app.cache.SetSync(cfg.SyncWrites)
+	app.cache.SetStoreRetries(cfg.StoreRetries)
+	if cfg.Fsck {
+		return nil // checked by the command instead of serving
+	}
+	if cfg.TempSweepInterval > 0 {
+		go app.cache.SweepTempPeriodically(cmd.Context(), cfg.TempSweepInterval, cfg.TempMaxAge)
+	}
+	if app.forwardCredentials {
+		app.namespaceKey, err = app.cache.Secret()
 		if err != nil {
-			return "", logutil.NewError(
-				err, "parse www-authenticate",
-				slog.String("www_authenticate", resp.Header.Get("WWW-Authenticate")),
-			)
+			return fmt.Errorf("load cache secret: %w", err)
+		}
+	}
+	if cfg.CrossRegistryBlobs {
+		app.blobs = newBlobIndex()
+		if err := app.indexBlobs(); err != nil {
+			return fmt.Errorf("index blobs: %w", err)
 		}
+	}
+	if cfg.MemoryCacheSize > 0 {
+		app.memCache = newMemCache(int64(cfg.MemoryCacheSize), app.maxManifestSize)
+		app.cache.SetOnRemove(app.memCache.drop)
+	}
+	return nil
+}
 
-		log.Debug("preflight request unauthorized, fetching token")
-		tokenResp, err := app.fetchToken(ctx, parsed)
-		if err != nil {
-			return "", logutil.NewError(err, "fetch token")
+func (app *App) run(cfg *Config, cmd *cobra.Command, args []string) (httpp.Handler, error) {
+	mux, admin := app.routes()
+	if admin != mux {
+		if _, err := app.listen(cmd.Context(), app.adminBindAddr, admin); err != nil {
+			return nil, fmt.Errorf("listen on admin address: %w", err)
+		}
+	}
+	for _, addr := range app.extraBindAddrs {
+		if _, err := app.listen(cmd.Context(), addr, mux); err != nil {
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
 		}
-		return tokenResp.Token, nil
-	} else if resp.StatusCode != http.StatusOK {
-		err := httputil.ResponseAsError(resp)
-		return "", logutil.NewError(err, "status not ok")
 	}
-	log.Debug("preflight request successful, proceeding without authentication")
-	return "", nil
+	if app.tlsCerts != nil {
+		go func() {
+			err := app.serveTLS(cmd.Context(), app.tlsBindAddr, app.tlsCerts, mux)
+			if err != nil {
+				slog.Error("failed to serve HTTPS", slog.Any("error", err))
+			}
+		}()
+	}
+	return mux, nil
 }
 
-func newRequest(ctx context.Context, method string, u *url.URL) (*http.Request, error) {
-	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
-	if err != nil {
-		return nil, err
+// routes returns the handler for registry traffic and the one for the debug
+// and admin endpoints, which are the same unless a separate admin address is
+// configured. Health checks are served by both, for load balancers.
+func (app *App) routes() (mux, admin *httpp.ServeMux) {
+	mux = httpp.NewServeMux()
+	admin = mux
+	if app.adminBindAddr != "" {
+		admin = httpp.NewServeMux()
+		admin.HandleFunc("GET /healthz", app.healthz)
+	}
+	mux.HandleFunc("GET /v2/{$}", app.requireClientAuth(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Docker-Distribution-Api-Version", distributionAPIVersion)
+		return nil
+	}))
+	mux.HandleFunc("GET /healthz", app.healthz)
+	admin.HandleFunc("GET /debug/cache", app.debugAuth(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(app.cache.Stats())
+	}))
+	if app.cacheEntries {
+		admin.HandleFunc("GET /debug/cache/entries", app.debugAuth(func(w http.ResponseWriter, r *http.Request) error {
+			entries, err := app.cache.Entries()
+			if err != nil {
+				return logutil.NewError(err, "list cache entries")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(entries)
+		}))
+	}
+	admin.HandleFunc("GET /debug/proxy", app.debugAuth(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(proxyStats{
+			ClientDisconnects: app.clientDisconnects.Load(),
+			RequestBudgets:    app.rateLimits.remaining(),
+		})
+	}))
+	admin.HandleFunc("GET /debug/upstream-latency", app.debugAuth(app.listUpstreamLatency))
+	admin.HandleFunc("GET /debug/media-types", app.debugAuth(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(app.mediaTypes.Accept())
+	}))
+	if app.adminPassword != "" {
+		admin.HandleFunc("GET /admin/browse/{path...}", app.adminAuth(app.browse))
+		if app.upstreamErrors != nil {
+			admin.HandleFunc("GET /admin/upstream-errors", app.adminAuth(app.listUpstreamErrors))
+		}
+		admin.HandleFunc("POST /admin/prefetch", app.adminAuth(app.prefetch))
+		admin.HandleFunc("PUT /admin/cache-size", app.adminAuth(app.setCacheSize))
 	}
-	req.Header.Set("User-Agent", "cachistry/0.1 (+https://github.com/authenticvision/cachistry)")
-	return req, nil
+	mux.HandleFunc("GET /v2/{registry}/{path...}", app.logAccess(app.requireClientAuth(app.proxy)))
+	// The proxy is read-only, pushes must not look like missing repositories.
+	mux.HandleFunc("/v2/{$}", methodNotAllowed)
+	mux.HandleFunc("/v2/{registry}/{path...}", methodNotAllowed)
+	return mux, admin
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/authenticvision/util-go/fmtutil"
+)
+
+// maintain reloads what can be reloaded without a restart and tidies up the
+// cache, triggered by SIGHUP:
+//
+//   - the Docker config with upstream credentials and the client htpasswd
+//     file are read again, tokens cached for the old credentials are used
+//     until they expire
+//   - temporary files of failed downloads older than TempMaxAge are removed
+//   - files are evicted until each tier is within its limits again, e.g.
+//     after usage was accounted too low; PUT /admin/cache-size only changes
+//     the top tier and evicts right away
+//   - manifests held in memory are dropped, so that they are read from disk
+//     again, e.g. after files were removed from the cache directory by hand
+//
+// All other configuration, including registries, cache size and tiers, only
+// takes effect on restart. TLS certificates are reloaded on change anyway.
+// Each step runs even if an earlier one failed.
+func (app *App) maintain() error {
+	var errs []error
+	if err := app.dockerConfig.reload(); err != nil {
+		errs = append(errs, fmt.Errorf("reload Docker config: %w", err))
+	}
+	if err := app.clientAuth.reload(); err != nil {
+		errs = append(errs, fmt.Errorf("reload htpasswd: %w", err))
+	}
+	removed, reclaimed, err := app.cache.SweepTemp(app.tempMaxAge)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("sweep temporary files: %w", err))
+	}
+	if err := app.cache.EnforceLimits(); err != nil {
+		errs = append(errs, fmt.Errorf("enforce cache limits: %w", err))
+	}
+	app.memCache.flush()
+	slog.Info("maintenance done",
+		slog.Int("removed_temp_files", removed),
+		slog.String("reclaimed", fmtutil.FormatBytes(reclaimed)),
+		slog.Any("cache", app.cache.Stats()),
+	)
+	return errors.Join(errs...)
+}
+
+// maintainOnSIGHUP runs maintain on every SIGHUP until ctx is done.
+func (app *App) maintainOnSIGHUP(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		slog.Info("received SIGHUP, running maintenance")
+		if err := app.maintain(); err != nil {
+			slog.Error("maintenance failed", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMaintain(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+
+	dockerConfigPath := writeTestDockerConfig(t, `{"auths": {"ghcr.io": {"username": "old", "password": "pw"}}}`)
+	var err error
+	app.dockerConfig, err = loadDockerConfig(dockerConfigPath)
+	r.NoError(err)
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd := func(password string) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		r.NoError(err)
+		r.NoError(os.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\n"), 0o600))
+	}
+	writeHtpasswd("old")
+	app.clientAuth = &clientAuth{htpasswd: htpasswd}
+	r.NoError(app.clientAuth.reload())
+	login := func(password string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.SetBasicAuth("alice", password)
+		return app.clientAuth.authorized(req)
+	}
+	a.True(login("old"))
+
+	_, cleanup, err := app.cache.Create("application/octet-stream", `"etag"`, "", "")
+	r.NoError(err)
+	t.Cleanup(cleanup)
+	app.memCache = newMemCache(1<<20, 1<<20)
+	app.memCache.put("test/foo/manifests/latest", cache.Cached{MIMEType: "application/json"}, []byte("{}"), time.Now())
+
+	r.NoError(os.WriteFile(dockerConfigPath, []byte(`{"auths": {"ghcr.io": {"username": "new", "password": "pw"}}}`), 0o600))
+	writeHtpasswd("new")
+	r.NoError(app.maintain())
+
+	creds, err := app.dockerConfig.credentials(t.Context(), "ghcr.io")
+	r.NoError(err)
+	a.Equal("new", creds.username)
+	a.False(login("old"), "verified passwords must be forgotten")
+	a.True(login("new"))
+	temp, err := fs.ReadDir(app.cache.FS(), "-/tmp")
+	r.NoError(err)
+	a.Empty(temp, "temporary files are swept")
+	_, ok := app.memCache.get("test/foo/manifests/latest")
+	a.False(ok, "manifests in memory are dropped")
+
+	// a broken file keeps the previous credentials, but fails the pass
+	r.NoError(os.WriteFile(dockerConfigPath, []byte(`{`), 0o600))
+	r.ErrorContains(app.maintain(), "reload Docker config")
+	creds, err = app.dockerConfig.credentials(t.Context(), "ghcr.io")
+	r.NoError(err)
+	a.Equal("new", creds.username)
+}
+
+func TestMaintainOnSIGHUP(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	dockerConfigPath := writeTestDockerConfig(t, `{}`)
+	var err error
+	app.dockerConfig, err = loadDockerConfig(dockerConfigPath)
+	r.NoError(err)
+	// the handler may not be installed yet when the first signal is sent,
+	// which must not terminate the test
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGHUP)
+	defer signal.Stop(caught)
+	go app.maintainOnSIGHUP(t.Context())
+
+	r.NoError(os.WriteFile(dockerConfigPath, []byte(`{"auths": {"ghcr.io": {"username": "new", "password": "pw"}}}`), 0o600))
+	r.Eventually(func() bool {
+		r.NoError(syscall.Kill(os.Getpid(), syscall.SIGHUP))
+		creds, err := app.dockerConfig.credentials(t.Context(), "ghcr.io")
+		return err == nil && creds.username == "new"
+	}, 5*time.Second, 50*time.Millisecond)
+}
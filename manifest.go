@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+)
+
+var errManifestTooLarge = errors.New("manifest too large")
+var errUnknownMediaType = errors.New("unknown manifest media type")
+
+var manifestPathRe = regexp.MustCompile(`/manifests/[^/]+$`)
+
+// descriptor references content by digest, see the OCI image spec.
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"` // only in indexes
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats p like os/arch[/variant].
+func (p platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// manifest covers image manifests and indexes (manifest lists) of both the
+// OCI and the Docker format.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config,omitempty"`
+	Layers    []descriptor `json:"layers,omitempty"`
+	Manifests []descriptor `json:"manifests,omitempty"`
+}
+
+// parseManifest reads at most limit bytes of manifest JSON, so that a
+// malicious upstream can't exhaust memory. Larger manifests fail with
+// errManifestTooLarge, manifests with a media type not in types fail with
+// errUnknownMediaType.
+func parseManifest(r io.Reader, limit int64, types mediaTypes) (*manifest, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errManifestTooLarge, limit)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	// schema 1 manifests have no media type field
+	if m.MediaType != "" && !types.IsManifest(m.MediaType) {
+		return nil, fmt.Errorf("%w %q", errUnknownMediaType, m.MediaType)
+	}
+	return &m, nil
+}
+
+// fileDigest computes the sha256 digest of a file as used by registries in
+// the Docker-Content-Digest header.
+func fileDigest(fsys fs.FS, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
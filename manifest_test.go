@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseManifest(t *testing.T) {
+	r := require.New(t)
+	m, err := parseManifest(strings.NewReader(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:aa", "size": 2},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:bb", "size": 3}]
+	}`), 4096, mediaTypes{manifests: defaultManifestMediaTypes})
+	r.NoError(err)
+	r.Equal("application/vnd.oci.image.manifest.v1+json", m.MediaType)
+	r.Equal("sha256:aa", m.Config.Digest)
+	r.Equal([]descriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: "sha256:bb", Size: 3}}, m.Layers)
+}
+
+func TestParseManifestTooLarge(t *testing.T) {
+	r := require.New(t)
+	huge := `{"layers":[` + strings.Repeat(`{"digest":"sha256:bb"},`, 1000) + `{}]}`
+	_, err := parseManifest(strings.NewReader(huge), 4096, mediaTypes{manifests: defaultManifestMediaTypes})
+	r.ErrorIs(err, errManifestTooLarge)
+	_, err = parseManifest(strings.NewReader(huge), int64(len(huge)), mediaTypes{manifests: defaultManifestMediaTypes})
+	r.NoError(err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"slices"
+)
+
+// defaultManifestMediaTypes are the manifest and index media types understood
+// without configuration, in order of preference.
+var defaultManifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// legacyManifestMediaTypes are Docker schema 1 manifests, which are recognized
+// but never requested.
+var legacyManifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+}
+
+// containerdManifestAccept is what containerd, and thereby Docker, sends in
+// Accept headers of manifest requests.
+var containerdManifestAccept = []string{
+	"application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json, */*",
+}
+
+// mediaTypes are the manifest media types used for negotiating with upstreams
+// and for recognizing manifests.
+type mediaTypes struct {
+	manifests []string
+}
+
+// newMediaTypes extends the default manifest media types with custom ones,
+// e.g. of artifacts.
+func newMediaTypes(custom []string) (mediaTypes, error) {
+	manifests := slices.Clone(defaultManifestMediaTypes)
+	for _, mediaType := range custom {
+		parsed, params, err := mime.ParseMediaType(mediaType)
+		if err != nil || len(params) > 0 {
+			return mediaTypes{}, fmt.Errorf("malformed media type %q", mediaType)
+		}
+		if !slices.Contains(manifests, parsed) {
+			manifests = append(manifests, parsed)
+		}
+	}
+	return mediaTypes{manifests: manifests}, nil
+}
+
+// Accept returns the media types to accept when requesting manifests from
+// upstreams on behalf of clients not sending any, or on our own behalf.
+func (t mediaTypes) Accept() []string {
+	return t.manifests
+}
+
+// IsManifest reports whether mediaType denotes a manifest or index.
+func (t mediaTypes) IsManifest(mediaType string) bool {
+	return slices.Contains(t.manifests, mediaType) || slices.Contains(legacyManifestMediaTypes, mediaType)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomMediaTypes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	const custom = "application/vnd.example.artifact.manifest.v1+json"
+	manifest := `{"mediaType":"` + custom + `","layers":[{"digest":"sha256:aa"}]}`
+
+	_, err := parseManifest(strings.NewReader(manifest), 4096, mediaTypes{manifests: defaultManifestMediaTypes})
+	r.ErrorIs(err, errUnknownMediaType)
+
+	types, err := newMediaTypes([]string{custom, "Application/vnd.OCI.image.index.v1+json"})
+	r.NoError(err)
+	a.Equal(slices.Concat(defaultManifestMediaTypes, []string{custom}), types.Accept(), "defaults must not be duplicated")
+	a.True(types.IsManifest(custom))
+	a.True(types.IsManifest("application/vnd.docker.distribution.manifest.v1+prettyjws"))
+	m, err := parseManifest(strings.NewReader(manifest), 4096, types)
+	r.NoError(err)
+	a.Equal(custom, m.MediaType)
+
+	_, err = newMediaTypes([]string{"not a media type"})
+	r.Error(err)
+	_, err = newMediaTypes([]string{custom + "; q=1"})
+	r.Error(err)
+}
+
+func TestDefaultManifestAccept(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	const custom = "application/vnd.example.artifact.manifest.v1+json"
+	var err error
+	app.mediaTypes, err = newMediaTypes([]string{custom})
+	require.NoError(t, err)
+	var accepted [][]string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			accepted = append(accepted, req.Header.Values("Accept"))
+		}
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	_, err = proxyRequest(app, "foo/manifests/latest", nil)
+	a.NoError(err)
+	_, err = proxyRequest(app, "foo/manifests/other", http.Header{"Accept": {"application/json"}})
+	a.NoError(err)
+	a.Equal([][]string{app.mediaTypes.Accept(), {"application/json"}}, accepted)
+}
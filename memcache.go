@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+)
+
+// memCache keeps the contents and metadata of small cached objects, i.e.
+// manifests, in memory, to serve the hot set without touching the disk. It
+// is filled from the disk cache and evicts the least recently used entries
+// beyond maxBytes. A nil memCache is disabled.
+type memCache struct {
+	maxBytes int64
+	maxEntry int64
+
+	mu      sync.Mutex
+	used    int64
+	lru     list.List // of *memEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type memEntry struct {
+	path    string
+	cached  cache.Cached
+	data    []byte
+	digest  string
+	modTime time.Time
+}
+
+func newMemCache(maxBytes, maxEntry int64) *memCache {
+	return &memCache{
+		maxBytes: maxBytes,
+		maxEntry: min(maxEntry, maxBytes),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the entry for path, if any.
+func (m *memCache) get(path string) (*memEntry, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[path]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	entry := *el.Value.(*memEntry)
+	return &entry, true
+}
+
+// put stores data along with its metadata. Objects larger than maxEntry are
+// not kept, and drop a previous entry for path.
+func (m *memCache) put(path string, cached cache.Cached, data []byte, modTime time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(path)
+	if int64(len(data)) > m.maxEntry {
+		return
+	}
+	sum := sha256.Sum256(data)
+	m.entries[path] = m.lru.PushFront(&memEntry{
+		path:    path,
+		cached:  cached,
+		data:    data,
+		digest:  "sha256:" + hex.EncodeToString(sum[:]),
+		modTime: modTime,
+	})
+	m.used += int64(len(data))
+	for m.used > m.maxBytes {
+		m.remove(m.lru.Back().Value.(*memEntry).path)
+	}
+}
+
+// load reads path from fsys into the cache, unless it is too large.
+func (m *memCache) load(fsys fs.FS, path string, cached cache.Cached) (*memEntry, error) {
+	if m == nil {
+		return nil, nil
+	}
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > m.maxEntry {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(f, m.maxEntry+1))
+	if err != nil {
+		return nil, err
+	}
+	m.put(path, cached, data, info.ModTime())
+	entry, _ := m.get(path)
+	return entry, nil
+}
+
+// updateValidated records a successful revalidation of path.
+func (m *memCache) updateValidated(path string, validated time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[path]; ok {
+		el.Value.(*memEntry).cached.Validated = validated
+	}
+}
+
+// drop removes the entry for path, e.g. because it was replaced by an object
+// too large to keep or evicted from the disk cache.
+func (m *memCache) drop(path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(path)
+}
+
+// flush removes all entries, e.g. because the disk cache they mirror changed
+// underneath.
+func (m *memCache) flush() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Init()
+	clear(m.entries)
+	m.used = 0
+}
+
+func (m *memCache) remove(path string) {
+	el, ok := m.entries[path]
+	if !ok {
+		return
+	}
+	m.lru.Remove(el)
+	delete(m.entries, path)
+	m.used -= int64(len(el.Value.(*memEntry).data))
+}
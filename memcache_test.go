@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemCacheEviction(t *testing.T) {
+	a := assert.New(t)
+	m := newMemCache(10, 4)
+	m.put("a", cache.Cached{ETag: `"a"`}, []byte("aaaa"), time.Time{})
+	m.put("b", cache.Cached{}, []byte("bbbb"), time.Time{})
+	m.put("large", cache.Cached{}, []byte("large"), time.Time{})
+	_, ok := m.get("large")
+	a.False(ok, "entries above the size limit are not kept")
+
+	entry, ok := m.get("a")
+	a.True(ok)
+	a.Equal(`"a"`, entry.cached.ETag)
+	a.Equal("aaaa", string(entry.data))
+	m.put("c", cache.Cached{}, []byte("cccc"), time.Time{})
+	_, ok = m.get("b")
+	a.False(ok, "least recently used entry must be evicted")
+	_, ok = m.get("a")
+	a.True(ok)
+	a.Equal(int64(8), m.used)
+
+	m.drop("a")
+	_, ok = m.get("a")
+	a.False(ok)
+	a.Equal(int64(4), m.used)
+}
+
+func TestMemCacheProxy(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.memCache = newMemCache(1<<20, 1<<10)
+	const manifest = `{"schemaVersion":2}`
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		_, _ = w.Write([]byte(manifest))
+	})
+	_, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	entry, ok := app.memCache.get("test/foo/manifests/latest")
+	r.True(ok, "stored manifests are kept in memory")
+	a.Equal(manifest, string(entry.data))
+
+	// served from memory without touching the disk cache
+	stats := app.cache.Stats()
+	app.unconditionalCacheTime = time.Hour
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(manifest, w.Body.String())
+	a.Equal(`"v1"`, w.Header().Get("ETag"))
+	a.Equal(sha256Digest(manifest), w.Header().Get("Docker-Content-Digest"))
+	a.Equal(stats.Hits, app.cache.Stats().Hits)
+	a.Equal(1, requests)
+
+	// revalidation semantics are the same as for the disk cache
+	app.unconditionalCacheTime = 0
+	before := time.Now()
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(manifest, w.Body.String())
+	a.Equal(2, requests)
+	entry, _ = app.memCache.get("test/foo/manifests/latest")
+	a.False(entry.cached.Validated.Before(before))
+}
+
+func TestMemCacheFollowsDiskCache(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+	app := newTestApp(http.DefaultClient)
+	var err error
+	app.cache, err = cache.NewCache(dir, 50)
+	r.NoError(err)
+	app.memCache = newMemCache(1<<20, 1<<10)
+	app.cache.SetOnRemove(app.memCache.drop)
+	const manifest = `{"schemaVersion":2}`
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		_, _ = w.Write([]byte(manifest))
+	})
+	get := func(repo string) *httptest.ResponseRecorder {
+		w, err := proxyRequest(app, repo+"/manifests/latest", nil)
+		r.NoError(err)
+		r.Equal(http.StatusOK, w.Code)
+		r.Equal(manifest, w.Body.String())
+		return w
+	}
+
+	// hits in memory keep the manifest from being evicted from disk
+	app.unconditionalCacheTime = time.Hour
+	get("hot")
+	for _, repo := range []string{"a", "b", "c", "d"} {
+		get("hot")
+		get(repo)
+	}
+	_, ok := app.memCache.get("test/hot/manifests/latest")
+	a.True(ok)
+	_, ok = app.memCache.get("test/a/manifests/latest")
+	a.False(ok, "evicted from disk, so dropped from memory")
+
+	// revalidating an object which disappeared from disk fetches it again,
+	// within the upstream slot and request budget of the revalidation
+	r.NoError(os.Remove(filepath.Join(dir, "test/hot/manifests/latest")))
+	app.unconditionalCacheTime = 0
+	app.upstreamLimit = newUpstreamLimiter(1, time.Millisecond)
+	app.rateLimits, err = parseRateLimits([]string{"test=10/1h"}, app.regs)
+	r.NoError(err)
+	fetches := app.latency.registries["test"].Fetch.Total.count
+	requests = 0
+	get("hot")
+	a.Equal(2, requests)
+	a.Equal(9, app.rateLimits.remaining()["test"])
+	a.Equal(fetches+1, app.latency.registries["test"].Fetch.Total.count, "one round trip recorded")
+	cached, err := app.cache.Get("test/hot/manifests/latest")
+	r.NoError(err)
+	a.NotNil(cached)
+}
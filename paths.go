@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Grammar of repository names, references and digests as defined by the OCI
+// distribution spec.
+const (
+	nameComponentExpr = `[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*`
+	nameExpr          = nameComponentExpr + `(?:/` + nameComponentExpr + `)*`
+	tagExpr           = `[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}`
+	digestExpr        = `[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+`
+)
+
+// repositoryPathRe matches the paths below /v2/<registry>/ which are proxied.
+var repositoryPathRe = regexp.MustCompile(`^(?:_catalog|` + nameExpr + `/(?:manifests/(?:` + tagExpr + `|` + digestExpr + `)|blobs/` + digestExpr + `|tags/list|referrers/` + digestExpr + `))$`)
+
+// immutablePathRe matches paths of content-addressed objects, which never
+// change.
+var immutablePathRe = regexp.MustCompile(`/(?:blobs|manifests)/` + digestExpr + `$`)
+
+// validProxyPath reports whether registry and path form a well-formed
+// registry API path. Malformed paths are rejected rather than relying on
+// path cleaning, so that they can't escape or alias locations in the cache.
+func validProxyPath(registry, path string) bool {
+	if !registryRe.MatchString(registry) || !repositoryPathRe.MatchString(path) {
+		return false
+	}
+	// already implied by the grammar, but cheap enough to double-check
+	return filepath.IsLocal(filepath.Join(registry, path))
+}
+
+// repositoryNameRe captures the repository name of a path matching
+// repositoryPathRe, if any.
+var repositoryNameRe = regexp.MustCompile(`^(` + nameExpr + `)/(?:manifests|blobs|tags|referrers)/`)
+
+// normalizePath applies the implicit library/ namespace of Docker Hub, so
+// that e.g. docker.io/ubuntu and docker.io/library/ubuntu share the cache
+// and are fetched from where Docker Hub serves them.
+func normalizePath(registry, path string) string {
+	if registry != "docker.io" {
+		return path
+	}
+	m := repositoryNameRe.FindStringSubmatch(path)
+	if m == nil || strings.Contains(m[1], "/") {
+		return path
+	}
+	return "library/" + path
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidProxyPath(t *testing.T) {
+	a := assert.New(t)
+	for _, path := range []string{
+		"_catalog",
+		"library/ubuntu/tags/list",
+		"library/ubuntu/manifests/latest",
+		"library/ubuntu/manifests/" + testDigest,
+		"foo/blobs/" + testDigest,
+		"a.b_c__d--e/f/manifests/v1.0_rc-1",
+		"foo/referrers/" + testDigest,
+	} {
+		a.True(validProxyPath("test", path), path)
+	}
+	for _, path := range []string{
+		"",
+		"foo",
+		"foo/manifests/",
+		"foo/blobs/latest",
+		"../manifests/latest",
+		"foo/../../manifests/latest",
+		"foo/manifests/..",
+		"foo//manifests/latest",
+		"/etc/manifests/latest",
+		"Foo/manifests/latest",
+		"foo/manifests/latest/",
+		"foo/tags/list/../../blobs/" + testDigest,
+		"foo/manifests/-latest",
+		"foo/referrers/latest",
+	} {
+		a.False(validProxyPath("test", path), path)
+	}
+	a.False(validProxyPath("..", "foo/manifests/latest"))
+	a.False(validProxyPath("", "foo/manifests/latest"))
+}
+
+func TestProxyMalformedPath(t *testing.T) {
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected upstream request %s", req.URL)
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/{registry}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, app.proxy(w, r))
+	})
+	for _, target := range []string{
+		"/v2/test/%2e%2e/%2e%2e/manifests/latest",
+		"/v2/test/foo%2F..%2F..%2Fmanifests/latest",
+		"/v2/test/foo/manifests/%2e%2e",
+		"/v2/test/%2Fetc/manifests/latest",
+		"/v2/test/foo//manifests/latest",
+		"/v2/%2e%2e/foo/manifests/latest",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		// ServeMux redirects some of these to their cleaned form already,
+		// but none may reach the upstream.
+		redirected := w.Code >= 300 && w.Code < 400
+		assert.True(t, w.Code == http.StatusBadRequest || redirected, "%s: status %d", target, w.Code)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("library/ubuntu/manifests/latest", normalizePath("docker.io", "ubuntu/manifests/latest"))
+	a.Equal("library/ubuntu/blobs/"+testDigest, normalizePath("docker.io", "ubuntu/blobs/"+testDigest))
+	a.Equal("library/ubuntu/tags/list", normalizePath("docker.io", "ubuntu/tags/list"))
+	a.Equal("library/ubuntu/manifests/latest", normalizePath("docker.io", "library/ubuntu/manifests/latest"))
+	a.Equal("grafana/grafana/manifests/latest", normalizePath("docker.io", "grafana/grafana/manifests/latest"))
+	a.Equal("library/ubuntu/referrers/"+testDigest, normalizePath("docker.io", "ubuntu/referrers/"+testDigest))
+	a.Equal("_catalog", normalizePath("docker.io", "_catalog"))
+	a.Equal("ubuntu/manifests/latest", normalizePath("ghcr.io", "ubuntu/manifests/latest"))
+}
+
+func TestProxyDockerLibrary(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	var paths []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			paths = append(paths, req.URL.Path)
+		}
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	app.regs["docker.io"] = app.regs["test"]
+	app.unconditionalCacheTime = time.Hour
+	for _, path := range []string{"ubuntu/manifests/latest", "library/ubuntu/manifests/latest"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/docker.io/"+path, nil)
+		req.SetPathValue("registry", "docker.io")
+		req.SetPathValue("path", path)
+		w := httptest.NewRecorder()
+		r.NoError(app.proxy(w, req))
+		a.Equal("{}", w.Body.String())
+	}
+	a.Equal([]string{"/v2/library/ubuntu/manifests/latest"}, paths, "both share one cache entry")
+}
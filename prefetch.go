@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// imageRef is a parsed image reference like docker.io/library/ubuntu:22.04.
+type imageRef struct {
+	Registry   string
+	Repository string
+	Reference  string // tag or digest
+}
+
+// parseImageRef parses an image reference whose first component is the
+// registry. Without tag or digest, the latest tag is used.
+func parseImageRef(ref string) (imageRef, error) {
+	registry, rest, ok := strings.Cut(ref, "/")
+	if !ok || !registryRe.MatchString(registry) || rest == "" {
+		return imageRef{}, fmt.Errorf("malformed image reference %q, expected registry/repository[:tag|@digest]", ref)
+	}
+	r := imageRef{Registry: registry, Repository: rest, Reference: "latest"}
+	if repo, digest, ok := strings.Cut(rest, "@"); ok {
+		r.Repository, r.Reference = repo, digest
+	} else if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		r.Repository, r.Reference = rest[:i], rest[i+1:]
+	}
+	if r.Repository == "" || r.Reference == "" {
+		return imageRef{}, fmt.Errorf("malformed image reference %q", ref)
+	}
+	return r, nil
+}
+
+const (
+	prefetchCached  = "cached"
+	prefetchFetched = "fetched"
+	prefetchFailed  = "failed"
+)
+
+type prefetchResult struct {
+	Reference string           `json:"reference"`
+	Error     string           `json:"error,omitempty"`
+	Blobs     []prefetchedBlob `json:"blobs,omitempty"`
+}
+
+type prefetchedBlob struct {
+	Digest string `json:"digest"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// prefetch populates the cache with the images given as JSON array of
+// references in the request body. For indexes, only the manifests for the
+// platform query parameter (e.g. linux/amd64) are followed, if given.
+func (app *App) prefetch(w http.ResponseWriter, r *http.Request) error {
+	var refs []string
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&refs); err != nil {
+		http.Error(w, "expected a JSON array of image references", http.StatusBadRequest)
+		return nil
+	}
+	platform := r.URL.Query().Get("platform")
+	results := make([]prefetchResult, 0, len(refs))
+	for _, ref := range refs {
+		results = append(results, app.prefetchImage(r.Context(), ref, platform))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// prefetchImage fetches the manifests and blobs of an image through the
+// proxy, skipping blobs which are cached already. Manifests are requested
+// with the Accept header of clients, so that their pulls hit the variants
+// cached here.
+func (app *App) prefetchImage(ctx context.Context, ref string, platform string) prefetchResult {
+	log := logutil.FromContext(ctx).With(slog.String("reference", ref))
+	result := prefetchResult{Reference: ref}
+	image, err := parseImageRef(ref)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var blobs []string
+	seen := make(map[string]bool)
+	manifests := []string{image.Reference}
+	for len(manifests) > 0 {
+		reference := manifests[0]
+		manifests = manifests[1:]
+		req, err := newInternalRequest(ctx, image.Registry, path.Join(image.Repository, "manifests", reference))
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		req.Header["Accept"] = app.prefetchAccept
+		w, err := app.fetchThroughProxy(req, app.maxManifestSize+1)
+		if err != nil {
+			result.Error = fmt.Sprintf("fetch manifest %s: %s", reference, err)
+			return result
+		}
+		m, err := parseManifest(&w.body, app.maxManifestSize, app.mediaTypes)
+		if err != nil {
+			result.Error = fmt.Sprintf("parse manifest %s: %s", reference, err)
+			return result
+		}
+		for _, child := range m.Manifests {
+			if platform == "" || child.Platform != nil && child.Platform.String() == platform {
+				manifests = append(manifests, child.Digest)
+			}
+		}
+		if m.Config != nil {
+			m.Layers = append([]descriptor{*m.Config}, m.Layers...)
+		}
+		for _, layer := range m.Layers {
+			if !seen[layer.Digest] {
+				seen[layer.Digest] = true
+				blobs = append(blobs, layer.Digest)
+			}
+		}
+	}
+
+	for _, digest := range blobs {
+		blob := prefetchedBlob{Digest: digest, Status: prefetchFetched}
+		req, err := newInternalRequest(ctx, image.Registry, path.Join(image.Repository, "blobs", digest))
+		if err != nil {
+			blob.Status = prefetchFailed
+			blob.Error = err.Error()
+			result.Blobs = append(result.Blobs, blob)
+			continue
+		}
+		cachePath := app.cachePath(req, image.Registry, normalizePath(image.Registry, req.PathValue("path")))
+		cached, err := app.cache.Peek(cachePath)
+		if err == nil && cached != nil {
+			blob.Status = prefetchCached
+		} else if _, err := app.fetchThroughProxy(req, 0); err != nil {
+			log.Warn("failed to prefetch blob", slog.String("digest", digest), slog.Any("error", err))
+			blob.Status = prefetchFailed
+			blob.Error = err.Error()
+		}
+		result.Blobs = append(result.Blobs, blob)
+	}
+	return result
+}
+
+// newInternalRequest returns a request for a path of a registry like a client
+// would send it. It carries no client credentials, so what it fetches is
+// cached in the shared cache.
+func newInternalRequest(ctx context.Context, registry, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/v2/"+registry+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetPathValue("registry", registry)
+	req.SetPathValue("path", path)
+	return req, nil
+}
+
+// fetchThroughProxy serves req like it would serve a client, which caches
+// the response. At most limit bytes of the response body are kept.
+func (app *App) fetchThroughProxy(req *http.Request, limit int64) (*capturingWriter, error) {
+	w := &capturingWriter{header: make(http.Header), limit: limit}
+	if err := app.proxy(w, req); err != nil {
+		return nil, err
+	}
+	if w.status != 0 && w.status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", w.status)
+	}
+	return w, nil
+}
+
+// capturingWriter is an http.ResponseWriter keeping the status and at most
+// limit bytes of the body.
+type capturingWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	limit  int64
+}
+
+func (w *capturingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *capturingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *capturingWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if remaining := w.limit - int64(w.body.Len()); remaining > 0 {
+		w.body.Write(p[:min(int64(len(p)), remaining)])
+	}
+	return len(p), nil
+}
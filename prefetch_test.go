@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want imageRef
+		err  bool
+	}{
+		{"docker.io/library/ubuntu:22.04", imageRef{"docker.io", "library/ubuntu", "22.04"}, false},
+		{"docker.io/library/ubuntu", imageRef{"docker.io", "library/ubuntu", "latest"}, false},
+		{"localhost:5000/foo@sha256:aa", imageRef{"localhost:5000", "foo", "sha256:aa"}, false},
+		{"localhost:5000/foo", imageRef{"localhost:5000", "foo", "latest"}, false},
+		{"ubuntu", imageRef{}, true},
+		{"docker.io/", imageRef{}, true},
+		{"docker.io/foo:", imageRef{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseImageRef(tt.ref)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func sha256Digest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestPrefetch(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.maxManifestSize = 4096
+	app.prefetchAccept = containerdManifestAccept
+	config, layer, missing := "config", "layer", "missing"
+	amd64 := `{"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"digest":"` + sha256Digest(config) + `"},` +
+		`"layers":[{"digest":"` + sha256Digest(layer) + `"},{"digest":"` + sha256Digest(missing) + `"}]}`
+	arm64 := `{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":"sha256:arm"}]}`
+	index := `{"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+		`{"digest":"` + sha256Digest(amd64) + `","platform":{"os":"linux","architecture":"amd64"}},` +
+		`{"digest":"` + sha256Digest(arm64) + `","platform":{"os":"linux","architecture":"arm64"}}]}`
+	content := map[string]string{
+		"/v2/foo/manifests/latest":                 index,
+		"/v2/foo/manifests/" + sha256Digest(amd64): amd64,
+		"/v2/foo/manifests/" + sha256Digest(arm64): arm64,
+		"/v2/foo/blobs/" + sha256Digest(config):    config,
+		"/v2/foo/blobs/" + sha256Digest(layer):     layer,
+	}
+	var blobRequests []string
+	var manifestRequests int
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		data, ok := content[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			blobRequests = append(blobRequests, req.URL.Path)
+		} else {
+			manifestRequests++
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write([]byte(data))
+	})
+
+	prefetch := func() []prefetchResult {
+		req := httptest.NewRequest(http.MethodPost, "/admin/prefetch?platform=linux/amd64",
+			strings.NewReader(`["test/foo", "invalid"]`))
+		w := httptest.NewRecorder()
+		r.NoError(app.prefetch(w, req))
+		r.Equal(http.StatusOK, w.Code)
+		var results []prefetchResult
+		r.NoError(json.NewDecoder(w.Body).Decode(&results))
+		r.Len(results, 2)
+		a.Equal("invalid", results[1].Reference)
+		a.NotEmpty(results[1].Error)
+		return results
+	}
+
+	results := prefetch()
+	a.Empty(results[0].Error)
+	r.Len(results[0].Blobs, 3)
+	a.Equal(prefetchedBlob{Digest: sha256Digest(config), Status: prefetchFetched}, results[0].Blobs[0])
+	a.Equal(prefetchedBlob{Digest: sha256Digest(layer), Status: prefetchFetched}, results[0].Blobs[1])
+	a.Equal(prefetchFailed, results[0].Blobs[2].Status)
+	a.NotEmpty(results[0].Blobs[2].Error)
+	cached, err := app.cache.Peek("test/foo/blobs/" + sha256Digest(layer))
+	r.NoError(err)
+	a.NotNil(cached)
+	a.Len(blobRequests, 2, "arm64 layers must not be fetched")
+	// pulled like containerd does, the manifests are cached
+	app.unconditionalCacheTime = time.Minute
+	fetched := manifestRequests
+	for _, manifest := range []string{"latest", sha256Digest(amd64)} {
+		w, err := proxyRequest(app, "foo/manifests/"+manifest, http.Header{"Accept": containerdManifestAccept})
+		r.NoError(err)
+		a.Equal(http.StatusOK, w.Code, manifest)
+	}
+	a.Equal(fetched, manifestRequests)
+
+	// cached layers are skipped
+	results = prefetch()
+	a.Equal(prefetchCached, results[0].Blobs[0].Status)
+	a.Equal(prefetchCached, results[0].Blobs[1].Status)
+	a.Equal(prefetchFailed, results[0].Blobs[2].Status)
+	a.Len(blobRequests, 2)
+}
+
+func TestPrefetchDockerHubShortName(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.maxManifestSize = 4096
+	app.prefetchAccept = containerdManifestAccept
+	layer := "layer"
+	manifest := `{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":"` + sha256Digest(layer) + `"}]}`
+	content := map[string]string{
+		"/v2/library/ubuntu/manifests/latest":             manifest,
+		"/v2/library/ubuntu/blobs/" + sha256Digest(layer): layer,
+	}
+	blobRequests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		data, ok := content[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			blobRequests++
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write([]byte(data))
+	})
+	app.regs["docker.io"] = app.regs["test"]
+
+	prefetch := func() prefetchResult {
+		req := httptest.NewRequest(http.MethodPost, "/admin/prefetch", strings.NewReader(`["docker.io/ubuntu"]`))
+		w := httptest.NewRecorder()
+		r.NoError(app.prefetch(w, req))
+		r.Equal(http.StatusOK, w.Code)
+		var results []prefetchResult
+		r.NoError(json.NewDecoder(w.Body).Decode(&results))
+		r.Len(results, 1)
+		r.Empty(results[0].Error)
+		r.Len(results[0].Blobs, 1)
+		return results[0]
+	}
+
+	a.Equal(prefetchFetched, prefetch().Blobs[0].Status)
+	a.Equal(prefetchCached, prefetch().Blobs[0].Status, "the short name must find the library/ copy")
+	a.Equal(1, blobRequests)
+}
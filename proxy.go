@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/authenticvision/cachistry/httputil"
+	"github.com/authenticvision/cachistry/wwwauth"
+	"github.com/authenticvision/util-go/httpp"
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// distributionAPIVersion is sent in the Docker-Distribution-Api-Version
+// header, which some clients require to treat the proxy as a registry.
+const distributionAPIVersion = "registry/2.0"
+
+// proxy serves registry requests from the cache or the upstream. Errors due
+// to clients disconnecting are only counted, since they are no failures.
+// Other errors are reported in the OCI error format, which registry clients
+// expect, unless the response was started already. An unavailable cache
+// directory is reported as 503 Service Unavailable.
+func (app *App) proxy(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Docker-Distribution-Api-Version", distributionAPIVersion)
+	r = r.WithContext(withUserAgent(r.Context(), app.upstreamUserAgent(r.UserAgent())))
+	cw := &countingWriter{ResponseWriter: w}
+	err := app.serveProxy(cw, r)
+	if err == nil {
+		return nil
+	} else if r.Context().Err() != nil {
+		app.clientDisconnects.Add(1)
+		requestLog(r.Context()).Info("client disconnected", slog.Any("error", err))
+		return nil
+	}
+	var failure *upstreamFailure
+	if errors.As(err, &failure) {
+		requestLog(r.Context()).Warn("upstream request failed", slog.Any("error", err))
+		return failure.respond(w, r.PathValue("path"))
+	}
+	if errors.Is(err, cache.ErrUnavailable) {
+		// Health checks fail as well, so orchestration can stop routing
+		// requests here. Whatever comes back may be a different cache.
+		app.memCache.flush()
+		if cw.status == 0 {
+			requestLog(r.Context()).Error("cache unavailable", slog.Any("error", err))
+			return httputil.WriteOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "cache unavailable")
+		}
+	}
+	if cw.status != 0 {
+		return err
+	}
+	requestLog(r.Context()).Error("request failed", slog.Any("error", err))
+	return httputil.WriteOCIError(w, http.StatusInternalServerError, "UNKNOWN", "internal error, see the proxy's log")
+}
+
+// upstreamFailure marks failures of the upstream which happened before the
+// response was started, so that they can be reported to the client with a
+// fitting status instead of a generic server error.
+type upstreamFailure struct {
+	err error
+}
+
+func (e *upstreamFailure) Error() string { return e.err.Error() }
+
+func (e *upstreamFailure) Unwrap() error { return e.err }
+
+// respond passes through client errors of the upstream for path, e.g. 404,
+// and reports other failures as 502 Bad Gateway or 504 Gateway Timeout. A 401
+// is reported as 403 Forbidden: The proxy authenticates to upstreams itself,
+// so it failing isn't something clients could fix by authenticating, and
+// there is no challenge to send them.
+func (e *upstreamFailure) respond(w http.ResponseWriter, path string) error {
+	var httpErr *httputil.Error
+	var netErr net.Error
+	switch {
+	case errors.As(e.err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized:
+		return httputil.WriteOCIError(w, http.StatusForbidden, "DENIED", "upstream rejected the proxy's credentials")
+	case errors.As(e.err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500:
+		if len(httpErr.Errors) == 0 {
+			return httputil.WriteOCIError(w, httpErr.StatusCode, ociCode(httpErr.StatusCode, path), "upstream: "+http.StatusText(httpErr.StatusCode))
+		}
+		return httputil.WriteOCIErrors(w, httpErr.StatusCode, httpErr.Errors)
+	case errors.Is(e.err, errUpstreamStalled),
+		errors.Is(e.err, context.DeadlineExceeded),
+		errors.As(e.err, &netErr) && netErr.Timeout():
+		return httputil.WriteOCIError(w, http.StatusGatewayTimeout, "UNAVAILABLE", "upstream timed out")
+	default:
+		return httputil.WriteOCIError(w, http.StatusBadGateway, "UNAVAILABLE", "upstream unavailable: "+e.err.Error())
+	}
+}
+
+// ociCode returns the OCI error code for an upstream status without error
+// body, for a request of path.
+func ociCode(status int, path string) string {
+	switch status {
+	case http.StatusForbidden:
+		return "DENIED"
+	case http.StatusNotFound:
+		switch {
+		case manifestPathRe.MatchString(path):
+			return "MANIFEST_UNKNOWN"
+		case blobPathRe.MatchString(path):
+			return "BLOB_UNKNOWN"
+		}
+		return "NAME_UNKNOWN"
+	case http.StatusTooManyRequests:
+		return "TOOMANYREQUESTS"
+	default:
+		return "UNSUPPORTED"
+	}
+}
+
+// methodNotAllowed refuses requests other than GET and HEAD.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Allow", "GET, HEAD")
+	return httputil.WriteOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry proxy is read-only")
+}
+
+type proxyStats struct {
+	ClientDisconnects uint64         `json:"client_disconnect_total"`
+	RequestBudgets    map[string]int `json:"upstream_request_budget,omitempty"` // remaining requests by rate limited registry
+}
+
+func (app *App) serveProxy(w http.ResponseWriter, r *http.Request) error {
+	registry := r.PathValue("registry")
+	path := r.PathValue("path")
+	if !validProxyPath(registry, path) {
+		return httputil.WriteOCIError(w, http.StatusBadRequest, "NAME_INVALID", "malformed registry path")
+	}
+	path = normalizePath(registry, path)
+	if !app.registryAllowed(r, registry) {
+		return httputil.WriteOCIError(w, http.StatusForbidden, "DENIED", "registry not served on this listener")
+	}
+	if !app.repositoryAllowed(registry, path) {
+		return httputil.WriteOCIError(w, http.StatusForbidden, "DENIED", "repository not allowed on this proxy")
+	}
+	if listPathRe.MatchString(path) {
+		return app.proxyList(w, r, registry, path)
+	}
+	cachePath := app.cachePath(r, registry, path)
+	accept := normalizeAccept(r.Header.Values("Accept"), app.acceptMediaTypes)
+	if manifestPathRe.MatchString(cachePath) {
+		cachePath += variantSuffix(accept)
+		if len(r.Header.Values("Accept")) == 0 {
+			// Without Accept, some upstreams fall back to legacy formats.
+			accept = app.mediaTypes.Accept()
+		}
+	}
+
+	scope := logutil.NewScope("proxy", slog.String("cache_path", cachePath))
+	log := scope.Log(requestLog(r.Context()))
+	access := accessLogFromContext(r.Context())
+	access.setCachePath(cachePath)
+
+	if resolved, ok := app.resolvedTag(cachePath); ok {
+		served, err := app.serveResolvedTag(w, r, resolved, path)
+		if err != nil {
+			return scope.Err(err, "serve resolved tag")
+		} else if served {
+			log.Debug("serving manifest the tag recently resolved to", slog.String("digest", resolved.digest))
+			access.setDecision(decisionHit)
+			return nil
+		}
+	}
+
+	// Entries in memory are served without reading from the disk cache,
+	// which only records the access, so that it doesn't evict hot entries
+	// as if they were unused. Its hit counters are left alone.
+	mem, _ := app.memCache.get(cachePath)
+	var cached *cache.Cached
+	var err error
+	if mem != nil {
+		cached = &mem.cached
+		app.cache.Touch(cachePath)
+	} else {
+		cached, err = app.cache.Get(cachePath)
+		if err != nil {
+			return scope.Err(err, "check cache")
+		}
+	}
+	if cached == nil && app.blobs != nil {
+		// Blobs are content-addressed, so any copy with the same digest will
+		// do, and never needs revalidation.
+		otherPath, otherCached, err := app.findBlob(cachePath)
+		if err != nil {
+			return scope.Err(err, "find blob")
+		} else if otherCached != nil {
+			log.Debug("found blob cached for another repository", slog.String("other_cache_path", otherPath))
+			access.setDecision(decisionHit)
+			w.Header().Set("Content-Type", otherCached.MIMEType)
+			httputil.SetETag(w.Header(), otherCached.ETag)
+			w.Header().Set("Cache-Control", app.cacheControl(path))
+			if otherCached.Digest != "" {
+				w.Header().Set("Docker-Content-Digest", otherCached.Digest)
+			}
+			serveCachedFile(w, r, app.cache.FS(), otherPath, otherCached.LastModified)
+			return nil
+		}
+	}
+	serveFromCache := func(decision string) error {
+		log.Debug("serving from cache")
+		access.setDecision(decision)
+		if mem == nil && manifestPathRe.MatchString(cachePath) {
+			var err error
+			mem, err = app.memCache.load(app.cache.FS(), cachePath, *cached)
+			if err != nil {
+				return scope.Err(err, "load into memory")
+			}
+		}
+		digest := cached.Digest
+		if mem != nil {
+			digest = mem.digest
+		} else if manifestPathRe.MatchString(cachePath) {
+			// Clients verify manifests against this digest, so it must match
+			// the stored bytes rather than whatever the upstream claimed.
+			var err error
+			digest, err = fileDigest(app.cache.FS(), cachePath)
+			if err != nil {
+				return scope.Err(err, "compute manifest digest")
+			}
+		}
+		if digest != "" {
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+		if decision == decisionRevalidated || decision == decisionMiss {
+			app.recordTag(cachePath, digest)
+		}
+		w.Header().Set("Content-Type", cached.MIMEType)
+		httputil.SetETag(w.Header(), cached.ETag)
+		w.Header().Set("Cache-Control", app.cacheControl(path))
+		if decision == decisionStale || decision == decisionStaleRevalidating {
+			setStale(w.Header(), cached.Validated)
+		}
+		// answers matching If-None-Match with 304 Not Modified
+		if mem != nil {
+			http.ServeContent(w, r, "", lastModified(cached.LastModified, mem.modTime), bytes.NewReader(mem.data))
+		} else {
+			serveCachedFile(w, r, app.cache.FS(), cachePath, cached.LastModified)
+		}
+		return nil
+	}
+	// A read-only cache is kept fresh by whoever writes it.
+	if app.offline || app.cache.ReadOnly() {
+		if cached != nil {
+			return serveFromCache(decisionHit)
+		}
+		reason := ""
+		if app.offline {
+			reason = "not cached, and offline"
+		} else if app.readOnlyMisses == readOnlyMissesNotFound {
+			reason = "not cached, and the cache is read-only"
+		}
+		if reason != "" {
+			log.Debug(reason)
+			access.setDecision(decisionMiss)
+			code := "MANIFEST_UNKNOWN"
+			if blobPathRe.MatchString(cachePath) {
+				code = "BLOB_UNKNOWN"
+			}
+			return httputil.WriteOCIError(w, http.StatusNotFound, code, reason)
+		}
+	}
+	state := fresh
+	if cached != nil {
+		state = app.freshness(cached.Validated)
+		// A changed object would be sent in full, losing the range. Objects
+		// by digest can't change, so ranges of them are served from disk,
+		// as resuming clients expect.
+		if r.Header.Get("Range") != "" && immutablePathRe.MatchString(path) {
+			state = fresh
+		}
+		if state == fresh {
+			return serveFromCache(decisionHit)
+		}
+	}
+	revalidate := cached != nil
+
+	apiURL, ok := app.upstreamAPI(registry)
+	if !ok {
+		return httputil.WriteOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "registry not proxied")
+	}
+	upstreamURL := apiURL.JoinPath(path)
+
+	if revalidate && state == staleOK {
+		app.revalidateInBackground(r.Context(), registry, path, upstreamURL, accept, cachePath, *cached)
+		return serveFromCache(decisionStaleRevalidating)
+	}
+
+	if ok, retryAfter := app.rateLimits.take(registry); !ok {
+		if revalidate {
+			log.Warn("upstream request budget exhausted, serving from cache without revalidation")
+			return serveFromCache(decisionStale)
+		}
+		log.Warn("rejecting request, upstream request budget exhausted")
+		return writeRateLimited(w, retryAfter)
+	}
+
+	release, err := app.upstreamLimit.acquire(r.Context())
+	if revalidate && err != nil {
+		log.Warn("upstream busy, serving from cache without revalidation", slog.Any("error", err))
+		return serveFromCache(decisionStale)
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		log.Warn("rejecting request, upstream busy")
+		return httputil.WriteOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", err.Error())
+	} else if err != nil {
+		return scope.Err(err, "wait for upstream")
+	}
+	defer release()
+
+	token, err := app.preflight(r.Context(), registry, upstreamURL)
+	if err != nil && app.upstreamErrors != nil {
+		app.upstreamErrors.Record(registry, path, err)
+	}
+	if revalidate && err != nil {
+		log.Warn("preflight failed, serving from cache")
+		return serveFromCache(decisionStale)
+	}
+	if err != nil {
+		return scope.Err(&upstreamFailure{err}, "preflight")
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	req, err := newRequest(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return scope.Err(err, "new request")
+	}
+	if revalidate {
+		setConditional(req, cached)
+	}
+	setUpstreamHeaders(req, accept, token)
+	// Partial responses can't be cached, so a range request missing the cache
+	// is passed through, and the full object is fetched in the background.
+	var fullReq *http.Request
+	rangeRequest := cached == nil && r.Header.Get("Range") != ""
+	if rangeRequest {
+		fullReq = req.Clone(context.WithoutCancel(r.Context()))
+		req.Header.Set("Range", r.Header.Get("Range"))
+	}
+	start := time.Now()
+	resp, err := app.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		err := app.cache.UpdateValidated(cachePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Evicted meanwhile, e.g. while served from memory. It is
+			// fetched again right away, with the upstream slot and request
+			// budget taken for the revalidation.
+			log.Debug("revalidated object was evicted, fetching it again")
+			_ = resp.Body.Close()
+			app.memCache.drop(cachePath)
+			revalidate, cached, mem = false, nil, nil
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+		} else if err != nil {
+			_ = resp.Body.Close()
+			return scope.Err(err, "update cache expiry")
+		}
+		if !revalidate {
+			start = time.Now()
+			resp, err = app.client.Do(req)
+		}
+	}
+	if err == nil {
+		ttfb := time.Since(start)
+		access.setUpstreamStatus(resp.StatusCode)
+		access.setUpstreamTTFB(ttfb)
+		// until the body was passed on and cached, or the error was read
+		defer func() { app.latency.observeFetch(registry, ttfb, time.Since(start)) }()
+		watchIdle(ctx, resp, cancel, app.upstreamIdleTimeout)
+	}
+	if err == nil &&
+		!(resp.StatusCode == http.StatusOK ||
+			(revalidate && resp.StatusCode == http.StatusNotModified) ||
+			(rangeRequest && resp.StatusCode == http.StatusPartialContent)) {
+		err = httputil.ResponseAsErrorLimit(resp, app.maxErrorBody)
+	}
+	if err != nil && app.upstreamErrors != nil {
+		app.upstreamErrors.Record(registry, path, err)
+	}
+	if revalidate && err != nil {
+		log.Warn("proxying request failed, serving from cache")
+		return serveFromCache(decisionStale)
+	}
+	if err != nil {
+		return scope.Err(&upstreamFailure{err}, "do request")
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		log.Debug("successfully revalidated cache")
+		cached.Validated = time.Now()
+		app.memCache.updateValidated(cachePath, cached.Validated)
+		return serveFromCache(decisionRevalidated)
+	}
+
+	defer resp.Body.Close()
+	access.setDecision(decisionMiss)
+	if resp.StatusCode == http.StatusPartialContent {
+		log.Debug("proxying range request")
+		for _, key := range []string{"Content-Type", "Content-Length", "Content-Range"} {
+			if value := resp.Header.Get(key); value != "" {
+				w.Header().Set(key, value)
+			}
+		}
+		httputil.SetETag(w.Header(), resp.Header.Get("ETag"))
+		w.Header().Set("Accept-Ranges", "bytes")
+		httpp.DisableCompression(w)
+		w.WriteHeader(http.StatusPartialContent)
+		app.fetchInBackground(fullReq, cachePath)
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			return scope.Err(err, "copy")
+		}
+		return nil
+	}
+	// Otherwise, the upstream ignored the range and sent the full object.
+
+	if revalidate {
+		log.Debug("failed to revalidate cache, proxying request")
+	} else {
+		log.Debug("proxying request")
+	}
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if revalidate && encoding != "" && encoding != "identity" {
+		// despite asking for the identity encoding, the cached copy is only
+		// replaced by a decoded one
+		if encoding != "gzip" {
+			log.Warn("unsupported upstream content encoding, serving from cache", slog.String("content_encoding", encoding))
+			return serveFromCache(decisionStale)
+		}
+		replaced, err := app.storeDecoded(log, resp, cachePath)
+		if err != nil {
+			log.Warn("failed to replace cached object, serving from cache", slog.Any("error", err))
+			return serveFromCache(decisionStale)
+		}
+		cached, mem = replaced, nil
+		return serveFromCache(decisionMiss)
+	}
+	contentLength, err := responseLength(resp)
+	if err != nil {
+		return scope.Err(err, "unsupported proxied response")
+	}
+	err = app.checkContentType(log, resp, cachePath)
+	if err != nil && app.upstreamErrors != nil {
+		app.upstreamErrors.Record(registry, path, err)
+	}
+	if err != nil {
+		return scope.Err(err, "check content type")
+	}
+	httputil.SetETag(w.Header(), resp.Header.Get("ETag"))
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("Content-Length", strconv.FormatUint(contentLength, 10))
+	w.Header().Set("Cache-Control", app.cacheControl(path))
+	// Hits are served with range support, so misses advertise it as well.
+	// Range requests missing the cache are passed through to the upstream.
+	w.Header().Set("Accept-Ranges", "bytes")
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		w.Header().Set("Docker-Content-Digest", digest)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+
+	// Note: ETag from the client is only taken into account on cache hits,
+	// since neither docker nor podman use it at all. Here, it could only
+	// match if the object was evicted, and fetching it anyway refills the
+	// cache.
+
+	httpp.DisableCompression(w)
+	err = app.storeResponse(log, resp, contentLength, cachePath, w)
+	if err != nil {
+		return scope.Err(err, "store response")
+	}
+	app.recordTag(cachePath, resp.Header.Get("Docker-Content-Digest"))
+	return nil
+}
+
+// setStale marks a response served without successful revalidation as such,
+// see RFC 7234, sections 5.1 and 5.5.1.
+func setStale(h http.Header, validated time.Time) {
+	h.Set("Age", strconv.FormatInt(int64(max(time.Since(validated), 0)/time.Second), 10))
+	h.Set("Warning", `110 - "Response is Stale"`)
+}
+
+// lastModified returns the time of the Last-Modified header value stored
+// for a cached object, or fallback if there is none.
+func lastModified(stored string, fallback time.Time) time.Time {
+	if t, err := http.ParseTime(stored); err == nil {
+		return t
+	}
+	return fallback
+}
+
+// serveCachedFile is like http.ServeFileFS, but sends the Last-Modified
+// stored for the file instead of the time it was cached, if there is one.
+func serveCachedFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, stored string) {
+	modTime, err := http.ParseTime(stored)
+	if err != nil {
+		http.ServeFileFS(w, r, fsys, name)
+		return
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.ServeFileFS(w, r, fsys, name) // responds with the fitting error
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.ServeFileFS(w, r, fsys, name)
+		return
+	}
+	http.ServeContent(w, r, "", modTime, content)
+}
+
+// freshness tells how a cached object is served, by when it was last
+// validated.
+type freshness int
+
+const (
+	fresh          freshness = iota // served without asking the upstream
+	staleOK                         // served, and revalidated in the background
+	mustRevalidate                  // revalidated before serving
+)
+
+// freshness returns the freshness of an object validated at validated. Objects
+// are fresh for the unconditional cache time. With stale-while-revalidate,
+// they may be served stale for the grace period after.
+func (app *App) freshness(validated time.Time) freshness {
+	age := time.Since(validated)
+	switch {
+	case age <= app.unconditionalCacheTime:
+		return fresh
+	case app.staleWhileRevalidate && (app.staleGracePeriod == 0 || age <= app.unconditionalCacheTime+app.staleGracePeriod):
+		return staleOK
+	default:
+		return mustRevalidate
+	}
+}
+
+// cacheControl returns the Cache-Control header for responses to path.
+// Content-addressed objects can be cached forever, anything else must be
+// revalidated, which is cheap with If-None-Match.
+func (app *App) cacheControl(path string) string {
+	visibility := "public"
+	if app.clientAuth != nil {
+		visibility = "private"
+	}
+	if immutablePathRe.MatchString(path) {
+		return visibility + ", max-age=31536000, immutable"
+	}
+	return visibility + ", no-cache"
+}
+
+// responseLength returns the length of the body of resp, which is refused if
+// it is encoded, see newRequest.
+func responseLength(resp *http.Response) (uint64, error) {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return 0, logutil.NewError(nil, "unexpected content-encoding", slog.String("content_encoding", encoding))
+	}
+	switch {
+	case resp.ContentLength >= 0:
+		return uint64(resp.ContentLength), nil
+	case resp.Body == http.NoBody:
+		// e.g. HTTP/2 responses ending with their headers
+		return 0, nil
+	default:
+		return 0, logutil.NewError(nil, "missing content-length")
+	}
+}
+
+// storeResponse copies the body of resp to w and into the cache, unless the
+// cache is read-only.
+func (app *App) storeResponse(log *slog.Logger, resp *http.Response, contentLength uint64, cachePath string, w io.Writer) error {
+	uncached := app.cache.ReadOnly()
+	if app.tooLargeToCache(contentLength) {
+		log.Info("proxying object uncached, it exceeds the maximum object size",
+			slog.Uint64("content_length", contentLength),
+		)
+		uncached = true
+	}
+	if uncached {
+		_, err := io.Copy(w, resp.Body)
+		if err != nil {
+			return logutil.NewError(err, "copy")
+		}
+		return nil
+	}
+	if contentLength == 0 && !app.cacheEmpty(cachePath) {
+		log.Warn("not caching suspicious empty response")
+		return nil
+	}
+
+	f, cleanup, err := app.cache.Create(
+		resp.Header.Get("Content-Type"),
+		resp.Header.Get("ETag"),
+		resp.Header.Get("Docker-Content-Digest"),
+		resp.Header.Get("Last-Modified"),
+	)
+	if err != nil {
+		return logutil.NewError(err, "create cache file")
+	}
+	defer cleanup()
+
+	var dst io.Writer = app.cache.ReclaimingWriter(f, contentLength)
+	var buf *bytes.Buffer // for the memory cache
+	if app.memCache != nil && manifestPathRe.MatchString(cachePath) && int64(contentLength) <= app.memCache.maxEntry {
+		buf = bytes.NewBuffer(make([]byte, 0, contentLength))
+		dst = io.MultiWriter(dst, buf)
+	}
+	body := io.TeeReader(resp.Body, dst)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		return logutil.NewError(err, "copy")
+	}
+
+	err = app.cache.Store(f, cachePath, contentLength)
+	if err != nil {
+		return logutil.NewError(err, "store cache file")
+	}
+	if buf != nil {
+		app.memCache.put(cachePath, cache.Cached{
+			MIMEType:     resp.Header.Get("Content-Type"),
+			ETag:         resp.Header.Get("ETag"),
+			Validated:    time.Now(),
+			Digest:       resp.Header.Get("Docker-Content-Digest"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}, buf.Bytes(), time.Now())
+	} else {
+		app.memCache.drop(cachePath)
+	}
+	if app.blobs != nil {
+		app.blobs.Add(cachePath)
+	}
+	return nil
+}
+
+// storeDecoded replaces the object at cachePath by the gzip-encoded body of
+// resp, decoded, since the cache only holds identity-encoded objects. The
+// decoded size isn't known in advance, so it is stored in full before it can
+// be served.
+func (app *App) storeDecoded(log *slog.Logger, resp *http.Response, cachePath string) (*cache.Cached, error) {
+	err := app.checkContentType(log, resp, cachePath)
+	if err != nil {
+		return nil, err
+	}
+	body, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, logutil.NewError(err, "decode gzip")
+	}
+	f, cleanup, err := app.cache.Create(
+		resp.Header.Get("Content-Type"),
+		resp.Header.Get("ETag"),
+		resp.Header.Get("Docker-Content-Digest"),
+		resp.Header.Get("Last-Modified"),
+	)
+	if err != nil {
+		return nil, logutil.NewError(err, "create cache file")
+	}
+	defer cleanup()
+	limit := int64(math.MaxInt64)
+	if app.maxObjectSize > 0 {
+		limit = int64(min(app.maxObjectSize, math.MaxInt64-1)) + 1
+	}
+	n, err := io.Copy(f, io.LimitReader(body, limit))
+	if err != nil {
+		return nil, logutil.NewError(err, "decode gzip")
+	}
+	size := uint64(n)
+	if app.tooLargeToCache(size) {
+		return nil, logutil.NewError(nil, "decoded object exceeds the maximum object size")
+	}
+	if size == 0 && !app.cacheEmpty(cachePath) {
+		return nil, logutil.NewError(nil, "suspicious empty response")
+	}
+	err = app.cache.Store(f, cachePath, size)
+	if err != nil {
+		return nil, logutil.NewError(err, "store cache file")
+	}
+	app.memCache.drop(cachePath)
+	if app.blobs != nil {
+		app.blobs.Add(cachePath)
+	}
+	cached, err := app.cache.Peek(cachePath)
+	if err == nil && cached == nil {
+		err = logutil.NewError(fs.ErrNotExist, "evicted right after storing")
+	}
+	return cached, err
+}
+
+// tooLargeToCache reports whether objects of size are proxied without caching
+// them, so that a single huge layer can't evict the whole working set.
+func (app *App) tooLargeToCache(size uint64) bool {
+	return app.maxObjectSize > 0 && size > app.maxObjectSize
+}
+
+// fetchInBackground caches the full object requested by req, unless it is
+// already being fetched or the cache is read-only.
+func (app *App) fetchInBackground(req *http.Request, cachePath string) {
+	if app.cache.ReadOnly() {
+		return
+	}
+	if _, loaded := app.backgroundFetches.LoadOrStore(cachePath, struct{}{}); loaded {
+		return
+	}
+	log := requestLog(req.Context()).With(slog.String("cache_path", cachePath))
+	go func() {
+		defer app.backgroundFetches.Delete(cachePath)
+		release, err := app.upstreamLimit.acquire(req.Context())
+		if err != nil {
+			log.Warn("background fetch failed", slog.Any("error", err))
+			return
+		}
+		defer release()
+		err = app.fetchToCache(log, req, cachePath)
+		if err != nil {
+			log.Warn("background fetch failed", slog.Any("error", err))
+		} else {
+			log.Debug("cached object after range request")
+		}
+	}()
+}
+
+func (app *App) fetchToCache(log *slog.Logger, req *http.Request, cachePath string) error {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	defer cancel(nil)
+	resp, err := app.client.Do(req.WithContext(ctx))
+	if err == nil {
+		watchIdle(ctx, resp, cancel, app.upstreamIdleTimeout)
+	}
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		// answer to a background revalidation
+		_ = resp.Body.Close()
+		err := app.cache.UpdateValidated(cachePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// evicted meanwhile, fetched again by the next request
+			app.memCache.drop(cachePath)
+			return nil
+		} else if err != nil {
+			return logutil.NewError(err, "update cache expiry")
+		}
+		app.memCache.updateValidated(cachePath, time.Now())
+		return nil
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = httputil.ResponseAsErrorLimit(resp, app.maxErrorBody)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	contentLength, err := responseLength(resp)
+	if err != nil {
+		return err
+	}
+	if err := app.checkContentType(log, resp, cachePath); err != nil {
+		return err
+	}
+	if app.tooLargeToCache(contentLength) {
+		log.Debug("not fetching object exceeding the maximum object size in the background")
+		return nil
+	}
+	return app.storeResponse(log, resp, contentLength, cachePath, io.Discard)
+}
+
+// revalidateInBackground revalidates a cached object which was served to
+// the client without revalidation already, unless the object is being
+// fetched in the background already. The next request finds it validated or
+// replaced.
+func (app *App) revalidateInBackground(ctx context.Context, registry, path string, upstreamURL *url.URL, accept []string, cachePath string, cached cache.Cached) {
+	if _, loaded := app.backgroundFetches.LoadOrStore(cachePath, struct{}{}); loaded {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	log := requestLog(ctx).With(slog.String("cache_path", cachePath))
+	go func() {
+		defer app.backgroundFetches.Delete(cachePath)
+		err := app.revalidate(ctx, log, registry, upstreamURL, accept, cachePath, &cached)
+		if err != nil && app.upstreamErrors != nil {
+			app.upstreamErrors.Record(registry, path, err)
+		}
+		if err != nil {
+			log.Warn("background revalidation failed", slog.Any("error", err))
+		} else {
+			log.Debug("revalidated cache in the background")
+		}
+	}()
+}
+
+func (app *App) revalidate(ctx context.Context, log *slog.Logger, registry string, upstreamURL *url.URL, accept []string, cachePath string, cached *cache.Cached) error {
+	if ok, _ := app.rateLimits.take(registry); !ok {
+		return errors.New("upstream request budget exhausted")
+	}
+	release, err := app.upstreamLimit.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	token, err := app.preflight(ctx, registry, upstreamURL)
+	if err != nil {
+		return logutil.NewError(err, "preflight")
+	}
+	req, err := newRequest(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return logutil.NewError(err, "new request")
+	}
+	setConditional(req, cached)
+	setUpstreamHeaders(req, accept, token)
+	return app.fetchToCache(log, req, cachePath)
+}
+
+// setConditional makes req revalidate cached, preferring its ETag, which is
+// sent back exactly as the upstream sent it.
+func setConditional(req *http.Request, cached *cache.Cached) {
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	} else if cached.LastModified != "" {
+		// for upstreams not sending ETags
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+}
+
+// setUpstreamHeaders sets the Accept values and bearer token, if any, of
+// requests for upstream objects.
+func setUpstreamHeaders(req *http.Request, accept []string, token string) {
+	if len(accept) > 0 {
+		req.Header["Accept"] = accept
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (app *App) preflight(ctx context.Context, registry string, upstreamURL *url.URL) (string, error) {
+	log := requestLog(ctx)
+	preflightReq, err := newRequest(ctx, http.MethodHead, upstreamURL, nil)
+	if err != nil {
+		return "", logutil.NewError(err, "new request")
+	}
+	start := time.Now()
+	resp, err := app.client.Do(preflightReq)
+	if err != nil {
+		return "", logutil.NewError(err, "do request")
+	}
+	ttfb := time.Since(start)
+	defer func() {
+		total := time.Since(start)
+		app.latency.observePreflight(registry, ttfb, total)
+		accessLogFromContext(ctx).setPreflightDuration(total)
+	}()
+	if resp.StatusCode == http.StatusUnauthorized {
+		parsed, err := wwwauth.Parse(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			// log what could be made of the challenge, to tell which part of
+			// it the registry got wrong
+			scheme, params, problems := wwwauth.ParseLenient(resp.Header.Get("WWW-Authenticate"))
+			return "", logutil.NewError(
+				err, "parse www-authenticate",
+				slog.String("www_authenticate", resp.Header.Get("WWW-Authenticate")),
+				slog.String("scheme", scheme),
+				slog.Any("params", params),
+				slog.Any("problems", problems),
+			)
+		}
+
+		log.Debug("preflight request unauthorized, fetching token")
+		tokenResp, err := app.fetchToken(ctx, registry, parsed)
+		if err != nil {
+			return "", logutil.NewError(err, "fetch token")
+		}
+		return tokenResp.Bearer(), nil
+	} else if resp.StatusCode != http.StatusOK {
+		err := httputil.ResponseAsErrorLimit(resp, app.maxErrorBody)
+		return "", logutil.NewError(err, "status not ok")
+	}
+	log.Debug("preflight request successful, proceeding without authentication")
+	return "", nil
+}
+
+func newRequest(ctx context.Context, method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgentFromContext(ctx))
+	// The cache stores and serves bodies as-is, without Content-Encoding.
+	// Setting this also stops the transport from requesting gzip and
+	// decompressing transparently, which drops Content-Length. Layers are
+	// compressed already, and manifests too small to benefit.
+	req.Header.Set("Accept-Encoding", "identity")
+	return req, nil
+}
+
+const defaultUserAgent = "cachistry/0.1 (+https://github.com/authenticvision/cachistry)"
+
+type userAgentKey struct{}
+
+// withUserAgent sets the User-Agent of upstream requests made with ctx.
+func withUserAgent(ctx context.Context, userAgent string) context.Context {
+	return context.WithValue(ctx, userAgentKey{}, userAgent)
+}
+
+func userAgentFromContext(ctx context.Context) string {
+	if userAgent, ok := ctx.Value(userAgentKey{}).(string); ok && userAgent != "" {
+		return userAgent
+	}
+	return defaultUserAgent
+}
+
+// maxDownstreamUserAgent bounds how much of a client's User-Agent is
+// forwarded.
+const maxDownstreamUserAgent = 256
+
+// upstreamUserAgent returns the User-Agent for upstream requests made on
+// behalf of a client, which optionally includes the client's User-Agent so
+// that upstream operators can attribute traffic.
+func (app *App) upstreamUserAgent(downstream string) string {
+	userAgent := cmp.Or(app.userAgent, defaultUserAgent)
+	downstream = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '(' || r == ')' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(downstream))
+	if !app.forwardUserAgent || downstream == "" {
+		return userAgent
+	}
+	if len(downstream) > maxDownstreamUserAgent {
+		downstream = downstream[:maxDownstreamUserAgent]
+	}
+	return userAgent + " (downstream: " + downstream + ")"
+}
+
+const (
+	emptyResponsesCache  = "cache"  // cache like any other response
+	emptyResponsesVerify = "verify" // cache only blobs with the digest of empty content
+	emptyResponsesRefuse = "refuse" // never cache
+)
+
+// emptyDigests are the digests of empty content.
+var emptyDigests = map[string]bool{
+	"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855":                                                                 true,
+	"sha512:cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e": true,
+}
+
+const (
+	readOnlyMissesProxy    = "proxy" // proxy without caching
+	readOnlyMissesNotFound = "404"   // answer with 404 like when offline
+)
+
+const (
+	contentTypeMismatchReject = "reject" // fail the request without caching
+	contentTypeMismatchWarn   = "warn"   // log, but serve and cache anyway
+)
+
+// checkContentType rejects responses whose content type doesn't fit the kind
+// of path, e.g. an index returned for a blob by a misconfigured or malicious
+// upstream, which would otherwise be cached and served mislabeled.
+func (app *App) checkContentType(log *slog.Logger, resp *http.Response, cachePath string) error {
+	contentType := resp.Header.Get("Content-Type")
+	if app.plausibleContentType(cachePath, contentType) {
+		return nil
+	}
+	if app.contentTypeMismatch == contentTypeMismatchWarn {
+		log.Warn("content type doesn't fit path, caching anyway", slog.String("content_type", contentType))
+		return nil
+	}
+	return logutil.NewError(nil, "content type doesn't fit path", slog.String("content_type", contentType))
+}
+
+// plausibleContentType reports whether contentType fits cachePath, i.e. that
+// blobs aren't labeled as manifests. Manifests aren't checked, since some
+// upstreams serve them with generic content types.
+func (app *App) plausibleContentType(cachePath string, contentType string) bool {
+	if !blobPathRe.MatchString(cachePath) {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return !app.mediaTypes.IsManifest(mediaType)
+}
+
+// cacheEmpty decides whether an empty 200 response for cachePath is cached.
+// Misconfigured upstreams may send empty responses, which would otherwise be
+// served from cache forever.
+func (app *App) cacheEmpty(cachePath string) bool {
+	switch app.emptyResponses {
+	case emptyResponsesCache:
+		return true
+	case emptyResponsesVerify:
+		digest, ok := blobDigest(cachePath)
+		return ok && emptyDigests[digest]
+	default:
+		return false
+	}
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/authenticvision/cachistry/httputil"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyResponses(t *testing.T) {
+	const emptyDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		mode   string
+		path   string
+		cached bool
+	}{
+		{emptyResponsesCache, "foo/manifests/latest", true},
+		{emptyResponsesVerify, "foo/manifests/latest", false},
+		{emptyResponsesVerify, "foo/blobs/" + emptyDigest, true},
+		{emptyResponsesVerify, "foo/blobs/" + testDigest, false},
+		{emptyResponsesRefuse, "foo/blobs/" + emptyDigest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.path, func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+			app := newTestCacheApp(t)
+			app.emptyResponses = tt.mode
+			newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Length", "0")
+			})
+			w, err := proxyRequest(app, tt.path, nil)
+			r.NoError(err)
+			a.Equal(http.StatusOK, w.Code)
+			a.Empty(w.Body.String())
+			cached, err := app.cache.Peek("test/" + tt.path)
+			r.NoError(err)
+			a.Equal(tt.cached, cached != nil)
+		})
+	}
+}
+
+func TestRangeMiss(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	const content = "0123456789"
+	var ranges []string
+	var mu sync.Mutex
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, req.Method+" "+req.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(content))
+	})
+	path := "foo/blobs/" + testDigest
+
+	w, err := proxyRequest(app, path, http.Header{"Range": {"bytes=2-4"}})
+	r.NoError(err)
+	a.Equal(http.StatusPartialContent, w.Code)
+	a.Equal("234", w.Body.String())
+	a.Equal("bytes 2-4/10", w.Header().Get("Content-Range"))
+	a.Equal("bytes", w.Header().Get("Accept-Ranges"))
+
+	r.Eventually(func() bool {
+		cached, err := app.cache.Peek("test/" + path)
+		return err == nil && cached != nil
+	}, 5*time.Second, 10*time.Millisecond, "full object must be cached in the background")
+	a.Equal("0123456789", readCacheFile(t, app, "test/"+path))
+	mu.Lock()
+	a.Equal([]string{"HEAD ", "GET bytes=2-4", "GET "}, ranges)
+	mu.Unlock()
+
+	// hits are served from cache, including ranges
+	w, err = proxyRequest(app, path, http.Header{"Range": {"bytes=8-"}})
+	r.NoError(err)
+	a.Equal(http.StatusPartialContent, w.Code)
+	a.Equal("89", w.Body.String())
+}
+
+func TestRangeAfterMiss(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	const content = "0123456789"
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+	path := "foo/blobs/" + testDigest
+
+	miss, err := proxyRequest(app, path, nil)
+	r.NoError(err)
+	a.Equal(content, miss.Body.String())
+	hit, err := proxyRequest(app, path, http.Header{"Range": {"bytes=2-4"}})
+	r.NoError(err)
+	a.Equal(http.StatusPartialContent, hit.Code)
+	a.Equal("234", hit.Body.String())
+	a.Equal(1, requests, "ranges of cached objects are served from disk")
+	a.Equal("bytes", miss.Header().Get("Accept-Ranges"))
+	a.Equal(miss.Header().Get("Accept-Ranges"), hit.Header().Get("Accept-Ranges"))
+}
+
+func readCacheFile(t *testing.T, app *App, path string) string {
+	f, err := app.cache.FS().Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCachedManifestDigest(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.unconditionalCacheTime = time.Hour
+	const manifest = `{"schemaVersion":2}`
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:bogus")
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		_, _ = w.Write([]byte(manifest))
+	})
+	_, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(manifest, w.Body.String())
+	sum := sha256.Sum256(w.Body.Bytes())
+	a.Equal("sha256:"+hex.EncodeToString(sum[:]), w.Header().Get("Docker-Content-Digest"))
+}
+
+func TestBlobDigestRoundTrip(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.unconditionalCacheTime = time.Hour
+	const content = "hello"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Content-Digest", testDigest)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+	for _, source := range []string{"upstream", "cache"} {
+		w, err := proxyRequest(app, "foo/blobs/"+testDigest, nil)
+		r.NoError(err)
+		a.Equal(content, w.Body.String(), source)
+		a.Equal(testDigest, w.Header().Get("Docker-Content-Digest"), source)
+		a.Equal(distributionAPIVersion, w.Header().Get("Docker-Distribution-Api-Version"), source)
+	}
+	cached, err := app.cache.Peek("test/foo/blobs/" + testDigest)
+	r.NoError(err)
+	r.NotNil(cached)
+	a.Equal(testDigest, cached.Digest)
+}
+
+func TestClientIfNoneMatch(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.unconditionalCacheTime = time.Hour
+	const content = "hello"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+	_, err := proxyRequest(app, "foo/blobs/"+testDigest, nil)
+	r.NoError(err)
+
+	w, err := proxyRequest(app, "foo/blobs/"+testDigest, http.Header{"If-None-Match": {`"v1"`}})
+	r.NoError(err)
+	a.Equal(http.StatusNotModified, w.Code)
+	a.Empty(w.Body.String())
+	a.Equal(`"v1"`, w.Header().Get("ETag"))
+	a.Equal("public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+
+	w, err = proxyRequest(app, "foo/blobs/"+testDigest, http.Header{"If-None-Match": {`"v0"`}})
+	r.NoError(err)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(content, w.Body.String())
+
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("public, no-cache", w.Header().Get("Cache-Control"))
+}
+
+func TestManifestVariants(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.unconditionalCacheTime = time.Hour
+	const (
+		dockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+		ociIndex       = "application/vnd.oci.image.index.v1+json"
+	)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		mediaType := dockerManifest
+		if slices.Contains(req.Header.Values("Accept"), ociIndex) {
+			mediaType = ociIndex
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(mediaType)))
+		_, _ = w.Write([]byte(mediaType))
+	})
+
+	for range 2 {
+		for _, accept := range [][]string{
+			{dockerManifest},
+			{ociIndex, dockerManifest},
+			{dockerManifest + ", " + ociIndex}, // same variant as above
+		} {
+			w, err := proxyRequest(app, "foo/manifests/latest", http.Header{"Accept": accept})
+			r.NoError(err)
+			want := dockerManifest
+			if slices.Contains(accept, ociIndex) || strings.Contains(accept[0], ociIndex) {
+				want = ociIndex
+			}
+			a.Equal(want, w.Header().Get("Content-Type"))
+			a.Equal(want, w.Body.String())
+		}
+	}
+	a.Equal(2, requests, "each variant must be fetched once")
+}
+
+func TestContentTypeMismatch(t *testing.T) {
+	for _, mode := range []string{contentTypeMismatchReject, contentTypeMismatchWarn} {
+		t.Run(mode, func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+			app := newTestCacheApp(t)
+			app.contentTypeMismatch = mode
+			newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json; charset=utf-8")
+				w.Header().Set("Content-Length", "2")
+				_, _ = w.Write([]byte("{}"))
+			})
+			path := "foo/blobs/" + testDigest
+			w, err := proxyRequest(app, path, nil)
+			r.NoError(err)
+			cached, peekErr := app.cache.Peek("test/" + path)
+			r.NoError(peekErr)
+			if mode == contentTypeMismatchReject {
+				a.Equal(http.StatusInternalServerError, w.Code)
+				a.Contains(w.Body.String(), `"UNKNOWN"`)
+				a.Nil(cached)
+			} else {
+				a.NotNil(cached)
+			}
+
+			// manifests may be an index
+			_, err = proxyRequest(app, "foo/manifests/latest", nil)
+			a.NoError(err)
+		})
+	}
+}
+
+// cancelingWriter cancels the request once the response body is written to,
+// like a client disconnecting mid-download.
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestClientDisconnect(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Length", "1024")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	})
+	path := "foo/blobs/" + testDigest
+	ctx, cancel := context.WithCancel(t.Context())
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/v2/test/"+path, nil)
+	req.SetPathValue("registry", "test")
+	req.SetPathValue("path", path)
+	r.NoError(app.proxy(cancelingWriter{httptest.NewRecorder(), cancel}, req))
+	r.Equal(uint64(1), app.clientDisconnects.Load())
+	cached, err := app.cache.Peek("test/" + path)
+	r.NoError(err)
+	r.Nil(cached)
+
+	// genuine failures are reported to the client
+	app.regs["test"] = "127.0.0.1:1"
+	w, err := proxyRequest(app, path, nil)
+	r.NoError(err)
+	r.Equal(http.StatusBadGateway, w.Code)
+	r.Equal(uint64(1), app.clientDisconnects.Load())
+}
+
+func TestUpstreamUserAgent(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	var userAgents []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		userAgents = append(userAgents, req.Method+" "+req.UserAgent())
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	request := func(userAgent string) []string {
+		userAgents = nil
+		_, err := proxyRequest(app, "foo/manifests/latest", http.Header{"User-Agent": {userAgent}})
+		a.NoError(err)
+		return userAgents
+	}
+
+	a.Equal([]string{"HEAD " + defaultUserAgent, "GET " + defaultUserAgent}, request("docker/24.0.7"))
+
+	app.userAgent = "custom/1.0"
+	app.forwardUserAgent = true
+	a.Equal([]string{
+		"HEAD custom/1.0 (downstream: docker/24.0.7)",
+		"GET custom/1.0 (downstream: docker/24.0.7)",
+	}, request("docker/24.0.7"))
+	a.Equal([]string{"HEAD custom/1.0", "GET custom/1.0"}, request(""))
+	a.Equal("custom/1.0 (downstream: evil)", app.upstreamUserAgent("(evil)\r\n"))
+}
+
+func TestContentEncoding(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	const content = "hello"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		a.Equal("identity", req.Header.Get("Accept-Encoding"))
+		if strings.HasSuffix(req.URL.Path, "/gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+
+	w, err := proxyRequest(app, "foo/manifests/plain", nil)
+	r.NoError(err)
+	a.Equal(content, w.Body.String())
+	a.Empty(w.Header().Get("Content-Encoding"))
+
+	// an upstream ignoring Accept-Encoding can't be cached consistently
+	w, err = proxyRequest(app, "foo/manifests/gzip", nil)
+	r.NoError(err)
+	a.Equal(http.StatusInternalServerError, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	cached, err := app.cache.Peek("test/foo/manifests/gzip")
+	r.NoError(err)
+	a.Nil(cached)
+}
+
+func TestUpstreamFailureStatus(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodHead:
+			if strings.HasSuffix(req.URL.Path, "/denied") {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		case strings.HasSuffix(req.URL.Path, "/unauthorized"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
+		case strings.HasSuffix(req.URL.Path, "/missing"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+		case strings.Contains(req.URL.Path, "/blobs/"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	ociCodes := func(w *httptest.ResponseRecorder) []string {
+		var body struct {
+			Errors []httputil.OCIError `json:"errors"`
+		}
+		r.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+		var codes []string
+		for _, e := range body.Errors {
+			codes = append(codes, e.Code)
+		}
+		return codes
+	}
+
+	// client errors of the upstream are passed through, with its body
+	w, err := proxyRequest(app, "foo/manifests/missing", nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Equal([]string{"MANIFEST_UNKNOWN"}, ociCodes(w))
+
+	w, err = proxyRequest(app, "foo/manifests/denied", nil)
+	r.NoError(err)
+	a.Equal(http.StatusForbidden, w.Code)
+	a.Equal([]string{"DENIED"}, ociCodes(w))
+
+	// the proxy's upstream credentials were rejected, which clients can't
+	// fix by authenticating to the proxy
+	w, err = proxyRequest(app, "foo/manifests/unauthorized", nil)
+	r.NoError(err)
+	a.Equal(http.StatusForbidden, w.Code)
+	a.Equal([]string{"DENIED"}, ociCodes(w))
+	a.Empty(w.Header().Get("WWW-Authenticate"))
+
+	// without a body, the code fits the kind of object
+	w, err = proxyRequest(app, "foo/blobs/"+testDigest, nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Equal([]string{"BLOB_UNKNOWN"}, ociCodes(w))
+
+	// server errors are the upstream's fault, not the client's
+	w, err = proxyRequest(app, "foo/manifests/broken", nil)
+	r.NoError(err)
+	a.Equal(http.StatusBadGateway, w.Code)
+	a.Equal([]string{"UNAVAILABLE"}, ociCodes(w))
+
+	delete(app.regs, "test")
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Equal([]string{"NAME_UNKNOWN"}, ociCodes(w))
+}
+
+func TestZeroLengthBlob(t *testing.T) {
+	const emptyDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, http2 := range []bool{false, true} {
+		t.Run("http2="+strconv.FormatBool(http2), func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+			app := newTestCacheApp(t)
+			app.emptyResponses = emptyResponsesVerify
+			app.unconditionalCacheTime = time.Hour
+			requests := 0
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodGet {
+					requests++
+				}
+			}))
+			srv.EnableHTTP2 = http2
+			srv.StartTLS()
+			t.Cleanup(srv.Close)
+			app.client = srv.Client()
+			app.regs["test"] = strings.TrimPrefix(srv.URL, "https://")
+
+			path := "foo/blobs/" + emptyDigest
+			for range 2 {
+				w, err := proxyRequest(app, path, nil)
+				r.NoError(err)
+				a.Equal(http.StatusOK, w.Code)
+				a.Equal("0", w.Header().Get("Content-Length"))
+				a.Empty(w.Body.String())
+			}
+			a.Equal(1, requests)
+			a.Equal(uint64(1), app.cache.Stats().Hits)
+		})
+	}
+}
+
+func TestOffline(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "5")
+		_, _ = w.Write([]byte("hello"))
+	})
+	storeTestFile(t, app.cache, "test/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", "{}")
+	app.offline = true
+
+	// hits are never revalidated
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+
+	w, err = proxyRequest(app, "foo/blobs/"+testDigest, nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Contains(w.Body.String(), "BLOB_UNKNOWN")
+
+	w, err = proxyRequest(app, "foo/tags/list", nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Zero(requests)
+}
+
+func TestReadOnlyCache(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		requests++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "5")
+		_, _ = w.Write([]byte("hello"))
+	})
+	dir := t.TempDir()
+	writer, err := cache.NewCache(dir, 1<<20)
+	r.NoError(err)
+	storeTestFile(t, writer, "test/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", "{}")
+	app.cache, err = cache.NewTieredCache([]cache.Tier{{Path: dir, MaxBytes: 1 << 20, ReadOnly: true}})
+	r.NoError(err)
+	app.readOnlyMisses = readOnlyMissesProxy
+
+	// hits are never revalidated
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+	a.Zero(requests)
+
+	w, err = proxyRequest(app, "foo/blobs/"+testDigest, nil)
+	r.NoError(err)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("hello", w.Body.String())
+	a.Equal(1, requests)
+	cached, err := app.cache.Get("test/foo/blobs/" + testDigest)
+	r.NoError(err)
+	a.Nil(cached, "misses aren't stored")
+
+	app.readOnlyMisses = readOnlyMissesNotFound
+	w, err = proxyRequest(app, "foo/blobs/"+testDigest, nil)
+	r.NoError(err)
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Contains(w.Body.String(), "read-only")
+	a.Equal(1, requests)
+}
+
+func TestServeStaleHeaders(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	storeTestFile(t, app.cache, "test/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", "{}")
+
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+	a.Equal(`110 - "Response is Stale"`, w.Header().Get("Warning"))
+	age, err := strconv.Atoi(w.Header().Get("Age"))
+	r.NoError(err)
+	a.Less(age, 60)
+
+	app.unconditionalCacheTime = time.Hour
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Empty(w.Header().Get("Warning"), "fresh hits aren't stale")
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.maxObjectSize = 4
+	const content = "0123456789"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+	path := "foo/blobs/" + testDigest
+	w, err := proxyRequest(app, path, nil)
+	r.NoError(err)
+	a.Equal(content, w.Body.String())
+	a.Equal(strconv.Itoa(len(content)), w.Header().Get("Content-Length"))
+	cached, err := app.cache.Peek("test/" + path)
+	r.NoError(err)
+	a.Nil(cached)
+	a.Zero(app.cache.Stats().UsedBytes)
+}
+
+func TestLastModifiedRevalidation(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var conditions []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		conditions = append(conditions, req.Header.Get("If-None-Match")+"|"+req.Header.Get("If-Modified-Since"))
+		if req.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(lastModified, w.Header().Get("Last-Modified"))
+
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("{}", w.Body.String())
+	a.Equal(lastModified, w.Header().Get("Last-Modified"), "served from cache with the upstream's Last-Modified")
+	a.Equal([]string{"|", "|" + lastModified}, conditions)
+}
+
+func TestETagRevalidation(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	etags := map[string]string{"unquoted": `v1`, "weak": `W/"v1"`, "strong": `"v1"`}
+	var conditions []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		etag := etags[strings.TrimPrefix(req.URL.Path, "/v2/foo/manifests/")]
+		if condition := req.Header.Get("If-None-Match"); condition != "" {
+			conditions = append(conditions, condition)
+			// compared byte by byte, like some registries do
+			if condition == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	for _, tag := range []string{"unquoted", "weak", "strong"} {
+		w, err := proxyRequest(app, "foo/manifests/"+tag, nil)
+		r.NoError(err)
+		canonical, _ := httputil.CanonicalETag(etags[tag])
+		a.Equal(canonical, w.Header().Get("ETag"))
+		w, err = proxyRequest(app, "foo/manifests/"+tag, http.Header{"If-None-Match": {canonical}})
+		r.NoError(err)
+		a.Equal(http.StatusNotModified, w.Code, tag)
+	}
+	a.Equal([]string{`v1`, `W/"v1"`, `"v1"`}, conditions)
+}
+
+func TestRevalidationEncoding(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	_, err := gz.Write([]byte(`{"v":2}`))
+	r.NoError(err)
+	r.NoError(gz.Close())
+	var encodings []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		encodings = append(encodings, req.Header.Get("Accept-Encoding"))
+		if req.Header.Get("If-None-Match") != "" {
+			// ignores the requested encoding and the cached ETag
+			if strings.HasSuffix(req.URL.Path, "/br") {
+				w.Header().Set("Content-Encoding", "br")
+				w.Header().Set("Content-Length", "2")
+				_, _ = w.Write([]byte("br"))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("ETag", `"v2"`)
+			w.Header().Set("Content-Length", strconv.Itoa(encoded.Len()))
+			_, _ = w.Write(encoded.Bytes())
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+
+	// gzip is decoded and replaces the cached copy
+	_, err = proxyRequest(app, "foo/manifests/gzip", nil)
+	r.NoError(err)
+	w, err := proxyRequest(app, "foo/manifests/gzip", nil)
+	r.NoError(err)
+	a.Equal(`{"v":2}`, w.Body.String())
+	a.Empty(w.Header().Get("Content-Encoding"))
+	a.Equal(`"v2"`, w.Header().Get("ETag"))
+	a.Empty(w.Header().Get("Warning"))
+	cached, err := app.cache.Peek("test/foo/manifests/gzip")
+	r.NoError(err)
+	a.Equal(`"v2"`, cached.ETag)
+
+	// other encodings keep the cached copy, served stale
+	_, err = proxyRequest(app, "foo/manifests/br", nil)
+	r.NoError(err)
+	w, err = proxyRequest(app, "foo/manifests/br", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+	a.Equal(`"v1"`, w.Header().Get("ETag"))
+	a.NotEmpty(w.Header().Get("Warning"), "served stale")
+	a.Equal([]string{"identity", "identity", "identity", "identity"}, encodings)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.staleWhileRevalidate = true
+	var mu sync.Mutex
+	content := "v1"
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Header.Get("If-None-Match") == `"`+content+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"`+content+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	})
+	_, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+
+	mu.Lock()
+	content = "v2"
+	mu.Unlock()
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("v1", w.Body.String(), "served stale right away")
+	a.NotEmpty(w.Header().Get("Warning"))
+	r.Eventually(func() bool {
+		cached, err := app.cache.Peek("test/foo/manifests/latest")
+		return err == nil && cached != nil && cached.ETag == `"v2"`
+	}, 5*time.Second, 10*time.Millisecond, "replaced in the background")
+
+	// unchanged objects are only marked as validated
+	before := time.Now().Add(-time.Second)
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("v2", w.Body.String())
+	r.Eventually(func() bool {
+		_, fetching := app.backgroundFetches.Load("test/foo/manifests/latest")
+		return !fetching
+	}, 5*time.Second, 10*time.Millisecond)
+	cached, err := app.cache.Peek("test/foo/manifests/latest")
+	r.NoError(err)
+	a.True(cached.Validated.After(before))
+}
+
+func TestFreshness(t *testing.T) {
+	app := newTestApp(nil)
+	app.unconditionalCacheTime = time.Minute
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	tests := []struct {
+		name      string
+		swr       bool
+		grace     time.Duration
+		validated time.Time
+		expected  freshness
+	}{
+		{"fresh", false, 0, ago(30 * time.Second), fresh},
+		{"expired", false, 0, ago(2 * time.Minute), mustRevalidate},
+		{"grace without stale-while-revalidate", false, time.Hour, ago(2 * time.Minute), mustRevalidate},
+		{"unlimited grace", true, 0, ago(24 * time.Hour), staleOK},
+		{"within grace", true, time.Hour, ago(30 * time.Minute), staleOK},
+		{"past grace", true, time.Hour, ago(2 * time.Hour), mustRevalidate},
+		{"fresh with grace", true, time.Hour, ago(30 * time.Second), fresh},
+	}
+	for _, tt := range tests {
+		app.staleWhileRevalidate = tt.swr
+		app.staleGracePeriod = tt.grace
+		assert.Equal(t, tt.expected, app.freshness(tt.validated), tt.name)
+	}
+}
+
+func TestStaleGracePeriod(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.staleWhileRevalidate = true
+	app.staleGracePeriod = time.Nanosecond
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("v2"))
+	})
+	storeTestFile(t, app.cache, "test/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", "v1")
+
+	// past the grace period, so revalidated before serving
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("v2", w.Body.String())
+	a.Empty(w.Header().Get("Warning"))
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	handler, err := app.run(&Config{}, &cobra.Command{}, nil)
+	r.NoError(err)
+	for _, target := range []string{"/v2/", "/v2/docker.io/foo/blobs/uploads/", "/v2/docker.io/foo/manifests/latest"} {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			r.NoError(handler.ServeErrHTTP(w, httptest.NewRequest(method, target, nil)))
+			a.Equal(http.StatusMethodNotAllowed, w.Code, method+" "+target)
+			a.Equal("GET, HEAD", w.Header().Get("Allow"))
+		}
+	}
+	w := httptest.NewRecorder()
+	r.NoError(handler.ServeErrHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/", nil)))
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(distributionAPIVersion, w.Header().Get("Docker-Distribution-Api-Version"))
+}
+
+func TestCompressedManifest(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	r.NoError(app.cache.SetCompressTypes([]string{"application/*+json"}))
+	app.unconditionalCacheTime = time.Hour
+	manifest := `{"manifests":[` + strings.Repeat(`{"mediaType":"application/vnd.oci.image.manifest.v1+json"},`, 50) + `{}]}`
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		_, _ = w.Write([]byte(manifest))
+	})
+
+	for _, decision := range []string{"miss", "hit"} {
+		w, err := proxyRequest(app, "foo/manifests/latest", nil)
+		r.NoError(err)
+		a.Equal(manifest, w.Body.String(), decision)
+		a.Equal(strconv.Itoa(len(manifest)), w.Header().Get("Content-Length"), decision)
+	}
+	a.Less(app.cache.Stats().UsedBytes, uint64(len(manifest)))
+}
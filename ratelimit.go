@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authenticvision/cachistry/httputil"
+)
+
+// tokenBucket limits the rate of upstream requests to a registry. It holds up
+// to capacity tokens, refilled continuously at rate tokens per second.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket allows n requests per period, starting with a full bucket.
+func newTokenBucket(n int, period time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(n),
+		rate:     float64(n) / period.Seconds(),
+		tokens:   float64(n),
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take consumes a token if one is available. Otherwise, it returns how long
+// it takes until the next one is.
+func (b *tokenBucket) take(now time.Time) (ok bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// remaining returns the number of requests which could be made right now.
+func (b *tokenBucket) remaining(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return int(b.tokens)
+}
+
+// rateLimits holds the request budgets of registries with a rate limit.
+type rateLimits map[string]*tokenBucket
+
+// parseRateLimits parses registry=n/period pairs like docker.io=100/6h.
+func parseRateLimits(pairs []string, regs map[string]string) (rateLimits, error) {
+	opts, err := parseRegistryOptions(pairs, regs)
+	if err != nil {
+		return nil, err
+	}
+	limits := make(rateLimits, len(opts))
+	for reg, value := range opts {
+		nStr, periodStr, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("malformed rate limit %q for %s, expected requests/period", value, reg)
+		}
+		n, err := strconv.Atoi(nStr)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid number of requests in rate limit %q for %s", value, reg)
+		}
+		period, err := time.ParseDuration(periodStr)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid period in rate limit %q for %s", value, reg)
+		}
+		limits[reg] = newTokenBucket(n, period)
+	}
+	return limits, nil
+}
+
+// take consumes a request of the budget of registry, see tokenBucket.take.
+// Registries without a rate limit are always allowed.
+func (l rateLimits) take(registry string) (ok bool, retryAfter time.Duration) {
+	bucket, limited := l[registry]
+	if !limited {
+		return true, 0
+	}
+	return bucket.take(time.Now())
+}
+
+// remaining returns the remaining budget per rate limited registry.
+func (l rateLimits) remaining() map[string]int {
+	now := time.Now()
+	remaining := make(map[string]int, len(l))
+	for reg, bucket := range l {
+		remaining[reg] = bucket.remaining(now)
+	}
+	return remaining
+}
+
+// writeRateLimited tells the client to come back once the budget allows
+// another upstream request.
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	return httputil.WriteOCIError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "upstream request budget exhausted")
+}
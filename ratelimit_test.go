@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	a := assert.New(t)
+	b := newTokenBucket(2, time.Minute)
+	now := b.last
+	ok, _ := b.take(now)
+	a.True(ok)
+	ok, _ = b.take(now)
+	a.True(ok)
+	ok, retryAfter := b.take(now)
+	a.False(ok)
+	a.Equal(30*time.Second, retryAfter)
+	a.Equal(0, b.remaining(now))
+
+	now = now.Add(30 * time.Second)
+	a.Equal(1, b.remaining(now))
+	now = now.Add(time.Hour)
+	a.Equal(2, b.remaining(now), "refills up to capacity only")
+}
+
+func TestParseRateLimits(t *testing.T) {
+	r := require.New(t)
+	regs := map[string]string{"docker.io": "registry-1.docker.io", "ghcr.io": "ghcr.io"}
+	limits, err := parseRateLimits([]string{"docker.io=100/6h"}, regs)
+	r.NoError(err)
+	r.Equal(map[string]int{"docker.io": 100}, limits.remaining())
+	for _, pair := range []string{"docker.io=100", "docker.io=0/1h", "docker.io=x/1h", "docker.io=1/x", "docker.io=1/-1h"} {
+		_, err := parseRateLimits([]string{pair}, regs)
+		r.Error(err, pair)
+	}
+}
+
+func TestRateLimitedProxy(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			requests++
+		}
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	app.rateLimits = rateLimits{"test": newTokenBucket(1, time.Hour)}
+
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(http.StatusOK, w.Code)
+
+	// due for revalidation, but served stale
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+	a.NotEmpty(w.Header().Get("Warning"))
+
+	w, err = proxyRequest(app, "foo/manifests/other", nil)
+	r.NoError(err)
+	a.Equal(http.StatusTooManyRequests, w.Code)
+	a.NotEmpty(w.Header().Get("Retry-After"))
+	a.Equal(1, requests)
+	a.Equal(map[string]int{"test": 0}, app.rateLimits.remaining())
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// registryRe matches a registry host name with optional port, as used in
+// image references.
+var registryRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*(:[0-9]+)?$`)
+
+// parseRegistries validates the configured registries and maps them to their
+// upstream host. A maxCount of zero disables the limit.
+func parseRegistries(registries []string, maxCount int) (map[string]string, error) {
+	if maxCount > 0 && len(registries) > maxCount {
+		return nil, fmt.Errorf("too many registries: %d configured, at most %d allowed", len(registries), maxCount)
+	}
+	regs := make(map[string]string, len(registries))
+	for _, reg := range registries {
+		if !registryRe.MatchString(reg) {
+			return nil, fmt.Errorf("malformed registry %q", reg)
+		}
+		if _, exists := regs[reg]; exists {
+			return nil, fmt.Errorf("duplicate registry %q", reg)
+		}
+		if reg == "docker.io" {
+			regs[reg] = "registry-1.docker.io"
+		} else {
+			regs[reg] = reg
+		}
+	}
+	return regs, nil
+}
+
+// parseRegistryOptions parses per-registry options given as registry=value
+// pairs. Each registry must be configured and may only appear once.
+func parseRegistryOptions(pairs []string, regs map[string]string) (map[string]string, error) {
+	opts := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		reg, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed registry option %q, expected registry=value", pair)
+		}
+		if _, exists := regs[reg]; !exists {
+			return nil, fmt.Errorf("option for unknown registry %q", reg)
+		}
+		if _, exists := opts[reg]; exists {
+			return nil, fmt.Errorf("duplicate option for registry %q", reg)
+		}
+		opts[reg] = value
+	}
+	return opts, nil
+}
+
+// parseUpstreamPrefixes parses registry=path pairs of upstreams serving the
+// registry API below a path prefix, and appends the prefixes to the upstream
+// hosts in regs.
+func parseUpstreamPrefixes(pairs []string, regs map[string]string) error {
+	prefixes, err := parseRegistryOptions(pairs, regs)
+	if err != nil {
+		return err
+	}
+	for reg, prefix := range prefixes {
+		u, err := url.Parse(prefix)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("malformed path prefix %q for registry %q", prefix, reg)
+		}
+		if trimmed := strings.Trim(u.Path, "/"); trimmed != "" {
+			regs[reg] += "/" + trimmed
+		}
+	}
+	return nil
+}
+
+// upstreamAPI returns the URL of the registry API of registry's upstream,
+// which is https://host/v2/ unless it has a path prefix.
+func (app *App) upstreamAPI(registry string) (*url.URL, bool) {
+	reg, ok := app.regs[registry]
+	if !ok {
+		return nil, false
+	}
+	host, prefix, _ := strings.Cut(reg, "/")
+	return &url.URL{Scheme: "https", Host: host, Path: path.Join("/", prefix, "v2") + "/"}, true
+}
+
+// upstreamHost returns the host of an upstream as stored in App.regs,
+// without its path prefix.
+func upstreamHost(reg string) string {
+	host, _, _ := strings.Cut(reg, "/")
+	return host
+}
+
+// parseListenerRegistries parses address=registry pairs restricting which
+// registries are served on a listener. Addresses are given as host:port or
+// :port, the latter matching any host, as do unspecified hosts like 0.0.0.0.
+// The result maps normalized addresses to the sets of allowed registries.
+func parseListenerRegistries(pairs []string, regs map[string]string) (map[string]map[string]bool, error) {
+	listeners := make(map[string]map[string]bool)
+	for _, pair := range pairs {
+		addr, reg, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed listener registry %q, expected address=registry", pair)
+		}
+		if _, exists := regs[reg]; !exists {
+			return nil, fmt.Errorf("listener registry for unknown registry %q", reg)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed listener address %q: %w", addr, err)
+		}
+		if host != "" {
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return nil, fmt.Errorf("listener address %q must be an IP address: %w", addr, err)
+			}
+			if ip.IsUnspecified() {
+				host = ""
+			} else {
+				host = ip.Unmap().String()
+			}
+		}
+		addr = net.JoinHostPort(host, port)
+		if listeners[addr] == nil {
+			listeners[addr] = make(map[string]bool)
+		}
+		listeners[addr][reg] = true
+	}
+	return listeners, nil
+}
+
+// registryAllowed reports whether registry may be proxied on the listener
+// which accepted r. Listeners without configured registries serve all. If
+// restrictions are configured, requests from unknown listeners serve none.
+func (app *App) registryAllowed(r *http.Request, registry string) bool {
+	if len(app.listenerRegs) == 0 {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return false
+	}
+	port := fmt.Sprint(addrPort.Port())
+	allowed, ok := app.listenerRegs[net.JoinHostPort(addrPort.Addr().Unmap().String(), port)]
+	if !ok {
+		allowed, ok = app.listenerRegs[net.JoinHostPort("", port)]
+	}
+	return !ok || allowed[registry]
+}
+
+// parseAllowedRepositories parses registry=pattern pairs restricting the
+// repositories proxied from a registry. Patterns are understood by
+// path.Match, a pattern matching a namespace allows everything below it. The
+// result maps registries to their patterns.
+func parseAllowedRepositories(pairs []string, regs map[string]string) (map[string][]string, error) {
+	allowed := make(map[string][]string)
+	for _, pair := range pairs {
+		reg, pattern, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed allowed repository %q, expected registry=pattern", pair)
+		}
+		if _, exists := regs[reg]; !exists {
+			return nil, fmt.Errorf("allowed repository for unknown registry %q", reg)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+		allowed[reg] = append(allowed[reg], pattern)
+	}
+	return allowed, nil
+}
+
+// repositoryAllowed reports whether apiPath, relative to /v2/<registry>/, is
+// in a repository which may be proxied. Registries without allowed
+// repositories serve all. The catalog of a restricted registry isn't served,
+// since it lists all repositories.
+func (app *App) repositoryAllowed(registry, apiPath string) bool {
+	patterns, ok := app.allowedRepos[registry]
+	if !ok {
+		return true
+	}
+	m := repositoryNameRe.FindStringSubmatch(apiPath)
+	if m == nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		for name := m[1]; name != "."; name = path.Dir(name) {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
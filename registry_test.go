@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegistries(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	regs, err := parseRegistries([]string{"docker.io", "ghcr.io", "localhost:5000"}, 0)
+	r.NoError(err)
+	a.Equal(map[string]string{
+		"docker.io":      "registry-1.docker.io",
+		"ghcr.io":        "ghcr.io",
+		"localhost:5000": "localhost:5000",
+	}, regs)
+}
+
+func TestParseRegistriesDuplicate(t *testing.T) {
+	_, err := parseRegistries([]string{"ghcr.io", "docker.io", "ghcr.io"}, 0)
+	require.ErrorContains(t, err, `duplicate registry "ghcr.io"`)
+}
+
+func TestParseRegistriesMalformed(t *testing.T) {
+	for _, reg := range []string{"", "https://ghcr.io", "ghcr.io/foo", "-ghcr.io", "ghcr..io", "GHCR.io", "ghcr.io:"} {
+		_, err := parseRegistries([]string{reg}, 0)
+		require.ErrorContains(t, err, "malformed registry", reg)
+	}
+}
+
+func TestParseRegistriesMaxCount(t *testing.T) {
+	_, err := parseRegistries([]string{"docker.io", "ghcr.io", "quay.io"}, 2)
+	require.ErrorContains(t, err, "too many registries")
+	_, err = parseRegistries([]string{"docker.io", "ghcr.io"}, 2)
+	require.NoError(t, err)
+}
+
+func TestParseRegistryOptions(t *testing.T) {
+	r := require.New(t)
+	regs := map[string]string{"docker.io": "registry-1.docker.io", "ghcr.io": "ghcr.io"}
+	opts, err := parseRegistryOptions([]string{"ghcr.io=a=b"}, regs)
+	r.NoError(err)
+	r.Equal(map[string]string{"ghcr.io": "a=b"}, opts)
+	_, err = parseRegistryOptions([]string{"ghcr.io"}, regs)
+	r.ErrorContains(err, "malformed registry option")
+	_, err = parseRegistryOptions([]string{"quay.io=x"}, regs)
+	r.ErrorContains(err, "unknown registry")
+	_, err = parseRegistryOptions([]string{"ghcr.io=x", "ghcr.io=y"}, regs)
+	r.ErrorContains(err, "duplicate option")
+}
+
+func TestUpstreamPathPrefixes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := &App{regs: map[string]string{"docker.io": "registry-1.docker.io", "example.com": "example.com"}}
+	r.NoError(parseUpstreamPrefixes([]string{"example.com=/artifacts/oci/"}, app.regs))
+	a.Equal("example.com/artifacts/oci", app.regs["example.com"])
+	a.Equal("example.com", upstreamHost(app.regs["example.com"]))
+
+	u, ok := app.upstreamAPI("example.com")
+	r.True(ok)
+	a.Equal("https://example.com/artifacts/oci/v2/", u.String())
+	u, ok = app.upstreamAPI("docker.io")
+	r.True(ok)
+	a.Equal("https://registry-1.docker.io/v2/", u.String())
+	_, ok = app.upstreamAPI("quay.io")
+	a.False(ok)
+
+	for _, prefix := range []string{"https://example.com/x", "/x?y", "%zz"} {
+		a.Error(parseUpstreamPrefixes([]string{"docker.io=" + prefix}, app.regs), prefix)
+	}
+}
+
+func TestProxyUpstreamPathPrefix(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	var paths []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	r.NoError(parseUpstreamPrefixes([]string{"test=/artifacts"}, app.regs))
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal("{}", w.Body.String())
+	a.Equal([]string{"HEAD /artifacts/v2/foo/manifests/latest", "GET /artifacts/v2/foo/manifests/latest"}, paths)
+}
+
+func TestParseListenerRegistries(t *testing.T) {
+	r := require.New(t)
+	regs := map[string]string{"docker.io": "registry-1.docker.io", "ghcr.io": "ghcr.io"}
+	listeners, err := parseListenerRegistries([]string{":5443=docker.io", "0.0.0.0:5000=ghcr.io", "10.0.0.1:5000=docker.io", "10.0.0.1:5000=ghcr.io"}, regs)
+	r.NoError(err)
+	r.Equal(map[string]map[string]bool{
+		":5443":         {"docker.io": true},
+		":5000":         {"ghcr.io": true},
+		"10.0.0.1:5000": {"docker.io": true, "ghcr.io": true},
+	}, listeners)
+	_, err = parseListenerRegistries([]string{":5443"}, regs)
+	r.ErrorContains(err, "malformed listener registry")
+	_, err = parseListenerRegistries([]string{":5443=quay.io"}, regs)
+	r.ErrorContains(err, "unknown registry")
+	_, err = parseListenerRegistries([]string{"localhost:5443=ghcr.io"}, regs)
+	r.ErrorContains(err, "must be an IP address")
+}
+
+func TestRegistryAllowed(t *testing.T) {
+	a := assert.New(t)
+	app := newTestApp(http.DefaultClient)
+	regs := map[string]string{"docker.io": "registry-1.docker.io", "ghcr.io": "ghcr.io"}
+	var err error
+	app.listenerRegs, err = parseListenerRegistries([]string{":5443=docker.io", "10.0.0.1:5000=ghcr.io"}, regs)
+	require.NoError(t, err)
+	on := func(local string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		addr, err := net.ResolveTCPAddr("tcp", local)
+		require.NoError(t, err)
+		return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+	}
+	a.True(app.registryAllowed(on("127.0.0.1:5443"), "docker.io"))
+	a.False(app.registryAllowed(on("127.0.0.1:5443"), "ghcr.io"))
+	a.True(app.registryAllowed(on("10.0.0.1:5000"), "ghcr.io"))
+	a.False(app.registryAllowed(on("10.0.0.1:5000"), "docker.io"))
+	a.True(app.registryAllowed(on("10.0.0.2:5000"), "docker.io"), "other listeners are unrestricted")
+	a.False(app.registryAllowed(httptest.NewRequest(http.MethodGet, "/v2/", nil), "docker.io"), "unknown listeners are restricted")
+	unix := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	unix = unix.WithContext(context.WithValue(unix.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/cachistry.sock", Net: "unix"}))
+	a.False(app.registryAllowed(unix, "docker.io"), "unparseable listener addresses are restricted")
+
+	w := httptest.NewRecorder()
+	req := on("127.0.0.1:5443")
+	req.SetPathValue("registry", "ghcr.io")
+	req.SetPathValue("path", "foo/manifests/latest")
+	a.NoError(app.proxy(w, req))
+	a.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestParseAllowedRepositories(t *testing.T) {
+	r := require.New(t)
+	regs := map[string]string{"docker.io": "registry-1.docker.io", "ghcr.io": "ghcr.io"}
+	allowed, err := parseAllowedRepositories([]string{"docker.io=library/*", "docker.io=org", "ghcr.io=org/*"}, regs)
+	r.NoError(err)
+	r.Equal(map[string][]string{"docker.io": {"library/*", "org"}, "ghcr.io": {"org/*"}}, allowed)
+	_, err = parseAllowedRepositories([]string{"docker.io"}, regs)
+	r.ErrorContains(err, "malformed allowed repository")
+	_, err = parseAllowedRepositories([]string{"quay.io=org"}, regs)
+	r.ErrorContains(err, "unknown registry")
+	_, err = parseAllowedRepositories([]string{"docker.io=["}, regs)
+	r.ErrorContains(err, "invalid repository pattern")
+}
+
+func TestRepositoryAllowed(t *testing.T) {
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.allowedRepos = map[string][]string{"docker.io": {"library/*", "org"}}
+	a.True(app.repositoryAllowed("docker.io", "library/alpine/manifests/latest"))
+	a.False(app.repositoryAllowed("docker.io", "organization/app/manifests/latest"))
+	a.True(app.repositoryAllowed("docker.io", "org/team/app/blobs/"+testDigest), "everything below a namespace")
+	a.False(app.repositoryAllowed("docker.io", "other/app/tags/list"))
+	a.False(app.repositoryAllowed("docker.io", "_catalog"))
+	a.True(app.repositoryAllowed("ghcr.io", "other/app/manifests/latest"), "other registries are unrestricted")
+
+	// checked before any upstream contact, after the implicit library/
+	requests := 0
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	})
+	app.regs["docker.io"] = app.regs["test"]
+	for path, status := range map[string]int{
+		"alpine/manifests/latest":   http.StatusOK,
+		"evil/app/manifests/latest": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/docker.io/"+path, nil)
+		req.SetPathValue("registry", "docker.io")
+		req.SetPathValue("path", path)
+		w := httptest.NewRecorder()
+		a.NoError(app.proxy(w, req))
+		a.Equal(status, w.Code, path)
+	}
+	a.Equal(2, requests, "preflight and fetch of the allowed manifest only")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/authenticvision/util-go/logutil"
+)
+
+// requestIDHeader carries the ID correlating all log lines of a request. It is
+// accepted from clients and echoed back in responses.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestID bounds the length of request IDs accepted from clients.
+const maxRequestID = 128
+
+type requestIDKey struct{}
+
+// withRequestID attaches a request ID to ctx, which requestLog adds to every
+// log line.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns the logger of ctx, annotated with the request ID if ctx
+// has one.
+func requestLog(ctx context.Context) *slog.Logger {
+	log := logutil.FromContext(ctx)
+	if id := requestIDFromContext(ctx); id != "" {
+		log = log.With(slog.String("request_id", id))
+	}
+	return log
+}
+
+// requestID returns the request ID sent by the client, or a new random one if
+// it sent none or one that isn't safe to log and echo.
+func requestID(clientID string) string {
+	if validRequestID(clientID) {
+		return clientID
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("abc-123", requestID("abc-123"))
+	for _, clientID := range []string{"", "with space", "new\nline", strings.Repeat("x", maxRequestID+1)} {
+		id := requestID(clientID)
+		a.Len(id, 32, "%q", clientID)
+		a.NotEqual(id, requestID(clientID), "%q", clientID)
+	}
+}
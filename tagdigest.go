@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/authenticvision/cachistry/cache"
+	"github.com/authenticvision/cachistry/httputil"
+)
+
+// tagCachePathRe matches cache paths of manifests referenced by tag rather
+// than by digest, capturing what comes before the tag and the variant suffix.
+var tagCachePathRe = regexp.MustCompile(`^(.+/manifests/)` + tagExpr + `(#[0-9a-f]+)?$`)
+
+var digestRe = regexp.MustCompile(`^` + digestExpr + `$`)
+
+// tagDigest is what a tag manifest last resolved to upstream.
+type tagDigest struct {
+	digest     string
+	cachePath  string // of the manifest by digest, with the same variant
+	resolvedAt time.Time
+}
+
+// recordTag remembers that the tag manifest at cachePath resolved to digest
+// upstream just now. An empty digest, i.e. an upstream not telling, forgets
+// a previous resolution.
+func (app *App) recordTag(cachePath, digest string) {
+	if app.tagDigests == nil {
+		return
+	}
+	m := tagCachePathRe.FindStringSubmatch(cachePath)
+	if m == nil {
+		return
+	}
+	if !digestRe.MatchString(digest) {
+		app.tagDigests.Delete(cachePath)
+		return
+	}
+	app.tagDigests.Store(cachePath, tagDigest{
+		digest:     digest,
+		cachePath:  m[1] + digest + m[2],
+		resolvedAt: time.Now(),
+	})
+}
+
+// resolvedTag returns the recent resolution of the tag manifest at
+// cachePath, if any.
+func (app *App) resolvedTag(cachePath string) (tagDigest, bool) {
+	if app.tagDigests == nil {
+		return tagDigest{}, false
+	}
+	resolved, ok := app.tagDigests.Load(cachePath)
+	if !ok || time.Since(resolved.resolvedAt) >= app.tagDigestTTL {
+		return tagDigest{}, false
+	}
+	return resolved, true
+}
+
+// serveResolvedTag serves the manifest a tag recently resolved to, if it is
+// cached by digest. Manifests by digest never change, so this needs no
+// upstream round trip at all. The tag itself is revalidated once the
+// resolution expires, which picks up a moved tag.
+func (app *App) serveResolvedTag(w http.ResponseWriter, r *http.Request, resolved tagDigest, path string) (bool, error) {
+	setHeaders := func(cached cache.Cached) {
+		w.Header().Set("Content-Type", cached.MIMEType)
+		httputil.SetETag(w.Header(), cached.ETag)
+		w.Header().Set("Cache-Control", app.cacheControl(path))
+		w.Header().Set("Docker-Content-Digest", resolved.digest)
+	}
+	if mem, ok := app.memCache.get(resolved.cachePath); ok {
+		setHeaders(mem.cached)
+		http.ServeContent(w, r, "", lastModified(mem.cached.LastModified, mem.modTime), bytes.NewReader(mem.data))
+		return true, nil
+	}
+	cached, err := app.cache.Get(resolved.cachePath)
+	if err != nil || cached == nil {
+		return false, err
+	}
+	setHeaders(*cached)
+	serveCachedFile(w, r, app.cache.FS(), resolved.cachePath, cached.LastModified)
+	return true, nil
+}
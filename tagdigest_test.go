@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mologie/ttlmap-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvedTag(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.tagDigestTTL = time.Hour
+	app.tagDigests = ttlmap.New[string, tagDigest](app.tagDigestTTL)
+	const v1, v2 = `{"schemaVersion":2,"v":1}`, `{"schemaVersion":2,"v":2}`
+	var mu sync.Mutex
+	latest := v1
+	var requests []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.URL.Path)
+		manifest := latest
+		if !strings.HasSuffix(req.URL.Path, "/latest") {
+			manifest = v1
+		}
+		if req.Header.Get("If-None-Match") == sha256Digest(manifest) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", sha256Digest(manifest))
+		w.Header().Set("Docker-Content-Digest", sha256Digest(manifest))
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		_, _ = w.Write([]byte(manifest))
+	})
+
+	_, err := proxyRequest(app, "foo/manifests/"+sha256Digest(v1), nil)
+	r.NoError(err)
+	_, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	r.Len(requests, 2)
+
+	// served from the manifest by digest, even though the tag is due
+	app.unconditionalCacheTime = 0
+	w, err := proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(v1, w.Body.String())
+	a.Equal(sha256Digest(v1), w.Header().Get("Docker-Content-Digest"))
+	a.Equal("public, no-cache", w.Header().Get("Cache-Control"))
+	a.Len(requests, 2)
+
+	// once the resolution expires, the moved tag is picked up
+	mu.Lock()
+	latest = v2
+	mu.Unlock()
+	app.tagDigestTTL = 0
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(v2, w.Body.String())
+	a.Len(requests, 3)
+	resolved, ok := app.tagDigests.Load("test/foo/manifests/latest")
+	r.True(ok)
+	a.Equal(sha256Digest(v2), resolved.digest)
+
+	// the new digest isn't cached, so the tag is revalidated as usual
+	app.tagDigestTTL = time.Hour
+	w, err = proxyRequest(app, "foo/manifests/latest", nil)
+	r.NoError(err)
+	a.Equal(v2, w.Body.String())
+	a.Len(requests, 4)
+}
+
+func TestRecordTag(t *testing.T) {
+	a := assert.New(t)
+	app := newTestApp(http.DefaultClient)
+	app.tagDigestTTL = time.Hour
+	app.tagDigests = ttlmap.New[string, tagDigest](app.tagDigestTTL)
+	const digest = "sha256:0123456789abcdef"
+
+	app.recordTag("test/foo/manifests/latest#0123abcd", digest)
+	resolved, ok := app.resolvedTag("test/foo/manifests/latest#0123abcd")
+	a.True(ok)
+	a.Equal("test/foo/manifests/"+digest+"#0123abcd", resolved.cachePath)
+
+	app.recordTag("test/foo/manifests/latest#0123abcd", "../../escape")
+	_, ok = app.resolvedTag("test/foo/manifests/latest#0123abcd")
+	a.False(ok, "invalid digests drop the resolution")
+
+	app.recordTag("test/foo/manifests/"+digest, digest)
+	_, ok = app.resolvedTag("test/foo/manifests/" + digest)
+	a.False(ok, "only tags are resolved")
+}
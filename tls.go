@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/authenticvision/util-go/httpp"
+)
+
+// certReloader serves a certificate from PEM files, reloading them whenever
+// they change, so that renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If reloading fails,
+// the previous certificate keeps being served.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := c.latestModTime()
+	if err != nil && c.cert != nil {
+		slog.Warn("failed to check TLS certificate for changes", slog.Any("error", err))
+		return c.cert, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil && c.cert != nil {
+		slog.Warn("failed to reload TLS certificate", slog.Any("error", err))
+		return c.cert, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load key pair: %w", err)
+	}
+	if c.cert != nil {
+		slog.Info("reloaded TLS certificate", slog.String("cert_file", c.certFile))
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// serveTLS serves handler over HTTPS on addr until ctx is done.
+func (app *App) serveTLS(ctx context.Context, addr string, certs *certReloader, handler httpp.Handler) error {
+	srv := newServer(ctx, handler)
+	srv.Addr = addr
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	return serveUntilDone(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+}
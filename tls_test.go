@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, cert tls.Certificate, certFile, keyFile string, modTime time.Time) {
+	r := require.New(t)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	r.NoError(err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	r.NoError(os.WriteFile(certFile, certPEM, 0o644))
+	r.NoError(os.WriteFile(keyFile, keyPEM, 0o600))
+	r.NoError(os.Chtimes(certFile, modTime, modTime))
+	r.NoError(os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestCertReloader(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	_, err := newCertReloader(certFile, keyFile)
+	r.Error(err)
+
+	first := newTestCert(t, time.Now().Add(time.Hour))
+	writeTestCert(t, first, certFile, keyFile, time.Now().Add(-time.Minute))
+	certs, err := newCertReloader(certFile, keyFile)
+	r.NoError(err)
+	cert, err := certs.getCertificate(nil)
+	r.NoError(err)
+	a.Equal(first.Certificate[0], cert.Certificate[0])
+
+	renewed := newTestCert(t, time.Now().Add(2*time.Hour))
+	writeTestCert(t, renewed, certFile, keyFile, time.Now())
+	cert, err = certs.getCertificate(nil)
+	r.NoError(err)
+	a.Equal(renewed.Certificate[0], cert.Certificate[0])
+
+	// a broken renewal keeps the previous certificate
+	r.NoError(os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	r.NoError(os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	cert, err = certs.getCertificate(nil)
+	r.NoError(err)
+	a.Equal(renewed.Certificate[0], cert.Certificate[0])
+}
@@ -7,38 +7,98 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/authenticvision/cachistry/httputil"
 	"github.com/authenticvision/cachistry/wwwauth"
 	"github.com/authenticvision/util-go/logutil"
 )
 
-func (app *App) fetchToken(ctx context.Context, wwwAuth wwwauth.WWWAuthenticate) (Token, error) {
-	log := logutil.FromContext(ctx).With(slog.Any("www_authenticate", wwwAuth))
-	if token, ok := app.tokenCache.Load(wwwAuth); ok {
-		log.Debug("loaded token from cache")
+func (app *App) fetchToken(ctx context.Context, registry string, wwwAuth wwwauth.WWWAuthenticate) (Token, error) {
+	log := requestLog(ctx).With(slog.Any("www_authenticate", wwwAuth))
+	// Tokens obtained with a registry's refresh token must not be shared
+	// with other registries using the same auth server.
+	cacheKey := registry + "\x00" + wwwAuth.Key()
+	// Neither must tokens obtained with one client's credentials be handed
+	// to another client.
+	if creds, ok := forwardedCredentials(ctx); ok {
+		cacheKey += "\x00" + app.credentialsNamespace(creds)
+	}
+	if token, ok := app.cachedToken(log, cacheKey); ok {
 		return token, nil
 	}
-	u, err := url.Parse(wwwAuth.Realm)
-	if err != nil {
-		return Token{}, logutil.NewError(err, "parse realm")
+	// Concurrent cache misses for the same scope share one auth server
+	// round-trip. It isn't canceled along with ctx, since other callers may
+	// still be waiting for it.
+	flight := app.tokenFlights.DoChan(cacheKey, func() (any, error) {
+		// A flight which completed after the lookup above has cached its
+		// token already, there is no need to ask the auth server again.
+		if token, ok := app.cachedToken(log, cacheKey); ok {
+			return token, nil
+		}
+		return app.requestToken(context.WithoutCancel(ctx), registry, wwwAuth, cacheKey)
+	})
+	select {
+	case res := <-flight:
+		if res.Err != nil {
+			return Token{}, res.Err
+		}
+		return res.Val.(Token), nil
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
 	}
-	q := u.Query()
-	q.Set("scope", wwwAuth.Scope)
-	q.Set("service", wwwAuth.Service)
-	u.RawQuery = q.Encode()
+}
 
-	tokenReq, err := newRequest(ctx, http.MethodGet, u)
+// cachedToken returns the cached token for cacheKey, unless it is about to
+// expire.
+func (app *App) cachedToken(log *slog.Logger, cacheKey string) (Token, bool) {
+	token, ok := app.tokenCache.Load(cacheKey)
+	if !ok {
+		return Token{}, false
+	}
+	if !time.Now().Add(tokenExpiryMargin).Before(token.ExpiresAt()) {
+		log.Debug("cached token is about to expire, fetching new one")
+		return Token{}, false
+	}
+	log.Debug("loaded token from cache")
+	return token, true
+}
+
+// requestToken fetches a token from the auth server and stores it in the
+// token cache.
+func (app *App) requestToken(ctx context.Context, registry string, wwwAuth wwwauth.WWWAuthenticate, cacheKey string) (Token, error) {
+	refreshToken, ok := app.refreshTokens[registry]
+	creds, forwarded := forwardedCredentials(ctx)
+	var err error
+	if forwarded {
+		// take the place of all of the proxy's own credentials
+		refreshToken, ok = "", false
+	} else if creds, err = app.dockerConfig.credentials(ctx, registry); err != nil {
+		return Token{}, logutil.NewError(err, "look up credentials")
+	}
+	var tokenReq *http.Request
+	if !ok && creds.identityToken != "" {
+		refreshToken, ok = creds.identityToken, true
+	}
+	if ok {
+		tokenReq, err = app.newOAuth2TokenRequest(ctx, wwwAuth, refreshToken)
+	} else {
+		tokenReq, err = newTokenRequest(ctx, wwwAuth)
+	}
 	if err != nil {
 		return Token{}, logutil.NewError(err, "new request")
 	}
+	if !ok && creds.username != "" {
+		tokenReq.SetBasicAuth(creds.username, creds.password)
+	}
 	resp, err := app.client.Do(tokenReq)
 	if err != nil {
 		return Token{}, logutil.NewError(err, "do request")
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err := httputil.ResponseAsError(resp)
+		err := httputil.ResponseAsErrorLimit(resp, app.maxErrorBody)
 		return Token{}, logutil.NewError(err, "status not ok")
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -56,14 +116,115 @@ func (app *App) fetchToken(ctx context.Context, wwwAuth wwwauth.WWWAuthenticate)
 	if err != nil {
 		return Token{}, logutil.NewError(err, "unmarshal token")
 	}
+	token.fetchedAt = time.Now()
 
-	slog.Debug("fetched token", slog.Any("token", token))
-	app.tokenCache.Store(wwwAuth, token)
+	requestLog(ctx).Debug("fetched token", slog.Any("token", token))
+	app.tokenCache.Store(cacheKey, token)
 	return token, nil
 }
 
+// newTokenRequest builds a request for the anonymous GET flow of the Docker
+// token spec.
+func newTokenRequest(ctx context.Context, wwwAuth wwwauth.WWWAuthenticate) (*http.Request, error) {
+	u, err := url.Parse(wwwAuth.Realm)
+	if err != nil {
+		return nil, logutil.NewError(err, "parse realm")
+	}
+	q := u.Query()
+	// One scope parameter is sent per scope. Some auth servers reject empty
+	// parameters, e.g. for registry-wide challenges without a scope.
+	for _, scope := range wwwAuth.Scope {
+		q.Add("scope", scope)
+	}
+	if wwwAuth.Service != "" {
+		q.Set("service", wwwAuth.Service)
+	}
+	u.RawQuery = q.Encode()
+	return newRequest(ctx, http.MethodGet, u, nil)
+}
+
+// newOAuth2TokenRequest builds a request for the OAuth2 flow of the Docker
+// token spec, which exchanges a refresh token (also called identity token)
+// for an access token.
+func (app *App) newOAuth2TokenRequest(ctx context.Context, wwwAuth wwwauth.WWWAuthenticate, refreshToken string) (*http.Request, error) {
+	u, err := url.Parse(wwwAuth.Realm)
+	if err != nil {
+		return nil, logutil.NewError(err, "parse realm")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	form.Set("client_id", app.oauthClientID)
+	if wwwAuth.Service != "" {
+		form.Set("service", wwwAuth.Service)
+	}
+	if len(wwwAuth.Scope) > 0 {
+		form.Set("scope", strings.Join(wwwAuth.Scope, " "))
+	}
+	req, err := newRequest(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+const (
+	// defaultTokenExpiresIn applies when the auth server omits expires_in,
+	// as mandated by the Docker token spec.
+	defaultTokenExpiresIn = 60 * time.Second
+
+	// minTokenTTL is the least amount of time a token is considered valid,
+	// even if the auth server's clock is skewed.
+	minTokenTTL = 10 * time.Second
+
+	// maxTokenTTL is the longest a token is considered valid, and how long
+	// the token cache keeps entries. Each is used until its own ExpiresAt.
+	maxTokenTTL = time.Hour
+
+	// tokenExpiryMargin avoids using a token which expires in-flight.
+	tokenExpiryMargin = 5 * time.Second
+)
+
 type Token struct {
-	Token     string `json:"token"`
-	ExpiresIn int64  `json:"expires_in"`
-	IssuedAt  string `json:"issued_at"`
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"` // alias of Token, e.g. in the OAuth2 flow
+	ExpiresIn   int64  `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+
+	fetchedAt time.Time
+}
+
+// ExpiresAt computes the absolute expiry time of the token from IssuedAt and
+// ExpiresIn, falling back to the time it was fetched if IssuedAt is absent or
+// unparseable. The result is clamped to a range relative to the fetch time, so
+// that a skewed auth server clock yields sane values, and to maxTokenTTL.
+func (t Token) ExpiresAt() time.Time {
+	expiresIn := time.Duration(t.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = defaultTokenExpiresIn
+	}
+	expiresIn = min(expiresIn, maxTokenTTL)
+	issuedAt, err := time.Parse(time.RFC3339, t.IssuedAt)
+	if err != nil {
+		issuedAt = t.fetchedAt
+	}
+	latest := t.fetchedAt.Add(expiresIn)
+	earliest := t.fetchedAt.Add(min(minTokenTTL, expiresIn))
+	expiresAt := issuedAt.Add(expiresIn)
+	if expiresAt.After(latest) {
+		return latest
+	} else if expiresAt.Before(earliest) {
+		return earliest
+	}
+	return expiresAt
+}
+
+// Bearer returns the credential to send as bearer token. Servers may return it
+// in either the token or the access_token field.
+func (t Token) Bearer() string {
+	if t.Token != "" {
+		return t.Token
+	}
+	return t.AccessToken
 }
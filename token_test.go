@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/authenticvision/cachistry/wwwauth"
+	"github.com/mologie/ttlmap-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApp(client *http.Client) *App {
+	return &App{
+		client:     client,
+		regs:       make(map[string]string),
+		tokenCache: ttlmap.New[string, Token](maxTokenTTL),
+		mediaTypes: mediaTypes{manifests: defaultManifestMediaTypes},
+	}
+}
+
+func TestFetchTokenEmptyScope(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		a.False(q.Has("scope"))
+		a.Equal("registry.example.com", q.Get("service"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Token{Token: "secret"})
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	token, err := app.fetchToken(t.Context(), "registry.example.com", wwwauth.WWWAuthenticate{
+		Realm:   srv.URL + "/token",
+		Service: "registry.example.com",
+	})
+	r.NoError(err)
+	a.Equal("secret", token.Token)
+}
+
+func TestFetchTokenMultipleScopes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		a.Equal([]string{"repository:foo/bar:pull", "repository:foo/baz:pull"}, req.URL.Query()["scope"])
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Token{Token: "secret"})
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	wwwAuth := wwwauth.WWWAuthenticate{
+		Realm:   srv.URL + "/token",
+		Service: "registry.example.com",
+		Scope:   []string{"repository:foo/bar:pull", "repository:foo/baz:pull"},
+	}
+	for range 2 {
+		token, err := app.fetchToken(t.Context(), "registry.example.com", wwwAuth)
+		r.NoError(err)
+		a.Equal("secret", token.Token)
+	}
+	a.Equal(1, requests, "second fetch should be served from the token cache")
+}
+
+func TestFetchTokenConcurrent(t *testing.T) {
+	r := require.New(t)
+	var requests atomic.Int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Token{Token: "secret"})
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	wwwAuth := wwwauth.WWWAuthenticate{
+		Realm:   srv.URL + "/token",
+		Service: "registry.example.com",
+		Scope:   []string{"repository:foo/bar:pull"},
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			token, err := app.fetchToken(t.Context(), "registry.example.com", wwwAuth)
+			assert.NoError(t, err)
+			assert.Equal(t, "secret", token.Token)
+		})
+	}
+	// Fetches either join the one in flight or, once it completed, find its
+	// token in the token cache, so there is one request however they race.
+	<-started
+	close(release)
+	wg.Wait()
+	r.Equal(int32(1), requests.Load())
+}
+
+func TestFetchTokenOAuth2(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.Equal(http.MethodPost, req.Method)
+		a.NoError(req.ParseForm())
+		a.Equal("refresh_token", req.PostForm.Get("grant_type"))
+		a.Equal("refresh-secret", req.PostForm.Get("refresh_token"))
+		a.Equal("cachistry", req.PostForm.Get("client_id"))
+		a.Equal("registry.example.com", req.PostForm.Get("service"))
+		a.Equal("repository:foo/bar:pull repository:foo/baz:pull", req.PostForm.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"secret","expires_in":300}`))
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	app.refreshTokens = map[string]string{"registry.example.com": "refresh-secret"}
+	app.oauthClientID = "cachistry"
+	token, err := app.fetchToken(t.Context(), "registry.example.com", wwwauth.WWWAuthenticate{
+		Realm:   srv.URL + "/token",
+		Service: "registry.example.com",
+		Scope:   []string{"repository:foo/bar:pull", "repository:foo/baz:pull"},
+	})
+	r.NoError(err)
+	a.Equal("secret", token.Bearer())
+}
+
+func TestTokenBearer(t *testing.T) {
+	a := assert.New(t)
+	var token Token
+	a.NoError(json.Unmarshal([]byte(`{"access_token":"access"}`), &token))
+	a.Equal("access", token.Bearer())
+	a.NoError(json.Unmarshal([]byte(`{"token":"token","access_token":"access"}`), &token))
+	a.Equal("token", token.Bearer())
+}
+
+func TestTokenExpiresAt(t *testing.T) {
+	a := assert.New(t)
+	now := time.Date(2025, 11, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		token Token
+		want  time.Time
+	}{
+		{"no issued_at", Token{ExpiresIn: 300}, now.Add(300 * time.Second)},
+		{"no expires_in", Token{}, now.Add(60 * time.Second)},
+		{"issued_at", Token{ExpiresIn: 300, IssuedAt: "2025-11-01T11:59:00Z"}, now.Add(240 * time.Second)},
+		{"unparseable issued_at", Token{ExpiresIn: 300, IssuedAt: "garbage"}, now.Add(300 * time.Second)},
+		{"clock ahead", Token{ExpiresIn: 300, IssuedAt: "2025-11-01T13:00:00Z"}, now.Add(300 * time.Second)},
+		{"clock behind", Token{ExpiresIn: 300, IssuedAt: "2025-11-01T11:00:00Z"}, now.Add(10 * time.Second)},
+		{"short-lived", Token{ExpiresIn: 5, IssuedAt: "2025-11-01T11:00:00Z"}, now.Add(5 * time.Second)},
+		{"long-lived", Token{ExpiresIn: 86400}, now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		tt.token.fetchedAt = now
+		a.Equal(tt.want, tt.token.ExpiresAt(), tt.name)
+	}
+}
+
+func TestFetchTokenExpired(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Token{Token: "secret", ExpiresIn: 1})
+	}))
+	defer srv.Close()
+
+	app := newTestApp(srv.Client())
+	wwwAuth := wwwauth.WWWAuthenticate{Realm: srv.URL + "/token"}
+	for range 2 {
+		_, err := app.fetchToken(t.Context(), "registry.example.com", wwwAuth)
+		r.NoError(err)
+	}
+	a.Equal(2, requests, "token within expiry margin must not be served from cache")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/authenticvision/cachistry/dnscache"
+	"golang.org/x/net/http/httpproxy"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTransport creates the transport for all upstream requests.
+func (app *App) newTransport(cfg *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dial := (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if cfg.DNSCacheTTL > 0 {
+		dial = dnscache.New(cfg.DNSCacheTTL, nil).DialContext
+	}
+	transport.DialContext = dial
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	// Connections are reused across preflight, token and object requests,
+	// which mostly go to the same few hosts.
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.ForceAttemptHTTP2 = cfg.UpstreamHTTP2
+	if !cfg.UpstreamHTTP2 {
+		// a non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	proxy, err := upstreamProxy(cfg.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream proxy: %w", err)
+	}
+	transport.Proxy = proxy
+
+	sniOverrides, err := parseRegistryOptions(cfg.SNIOverrides, app.regs)
+	if err != nil {
+		return nil, fmt.Errorf("parse sni overrides: %w", err)
+	}
+	if len(sniOverrides) > 0 {
+		// connections are made to the upstream host, not the registry name
+		serverNames := make(map[string]string, len(sniOverrides))
+		for reg, serverName := range sniOverrides {
+			// TLS to proxied upstreams is tunneled through CONNECT, which
+			// bypasses the dial function applying the override.
+			req := &http.Request{URL: &url.URL{Scheme: "https", Host: upstreamHost(app.regs[reg])}}
+			if u, err := proxy(req); err != nil || u != nil {
+				return nil, fmt.Errorf("sni override for %s can't be applied through the upstream proxy, exclude it with NO_PROXY", reg)
+			}
+			serverNames[upstreamHost(app.regs[reg])] = serverName
+		}
+		tlsConfig := transport.TLSClientConfig
+		if cfg.UpstreamHTTP2 {
+			// the transport doesn't configure ALPN on connections it
+			// doesn't dial itself
+			if tlsConfig != nil {
+				tlsConfig = tlsConfig.Clone()
+			} else {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		transport.DialTLSContext = sniDialTLS(dial, serverNames, tlsConfig)
+	}
+	return transport, nil
+}
+
+// upstreamProxy returns the proxy function for upstream requests. Proxies are
+// taken from HTTP_PROXY and HTTPS_PROXY, unless proxyURL overrides them.
+// Hosts in NO_PROXY bypass the proxy either way.
+func upstreamProxy(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	cfg := httpproxy.FromEnvironment()
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("proxy %q must be an absolute URL", proxyURL)
+		}
+		cfg.HTTPProxy = proxyURL
+		cfg.HTTPSProxy = proxyURL
+	}
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
+
+// sniDialTLS returns a TLS dial function, which sends a different server name
+// than the connection's host for hosts in serverNames. The certificate is
+// verified against the overridden server name.
+func sniDialTLS(dial dialFunc, serverNames map[string]string, tlsConfig *tls.Config) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var cfg *tls.Config
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+		if serverName, ok := serverNames[host]; ok {
+			cfg.ServerName = serverName
+		} else {
+			cfg.ServerName = host
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNIOverride(t *testing.T) {
+	r := require.New(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != "example.com" {
+				return nil, fmt.Errorf("unexpected server name %q", hello.ServerName)
+			}
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	r.NoError(err)
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	dial := (&net.Dialer{}).DialContext
+	newClient := func(serverNames map[string]string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialTLSContext: sniDialTLS(dial, serverNames, tlsConfig),
+		}}
+	}
+
+	_, err = newClient(nil).Get("https://localhost:" + port + "/")
+	r.Error(err)
+
+	resp, err := newClient(map[string]string{"localhost": "example.com"}).Get("https://localhost:" + port + "/")
+	r.NoError(err)
+	_ = resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	r := require.New(t)
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	app := newTestApp(http.DefaultClient)
+	transport, err := app.newTransport(&Config{ResponseHeaderTimeout: 100 * time.Millisecond})
+	r.NoError(err)
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	_, err = client.Get(srv.URL)
+	r.ErrorContains(err, "timeout awaiting response headers")
+	r.Less(time.Since(start), 5*time.Second)
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	r := require.New(t)
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "registry.internal,.corp.example.com")
+	proxyFor := func(proxy func(*http.Request) (*url.URL, error), host string) string {
+		req, err := http.NewRequest(http.MethodGet, "https://"+host+"/v2/", nil)
+		r.NoError(err)
+		u, err := proxy(req)
+		r.NoError(err)
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	app := newTestApp(nil)
+	transport, err := app.newTransport(&Config{})
+	r.NoError(err)
+	r.Equal("http://env-proxy.example.com:3128", proxyFor(transport.Proxy, "ghcr.io"))
+	r.Empty(proxyFor(transport.Proxy, "registry.internal"))
+	r.Empty(proxyFor(transport.Proxy, "harbor.corp.example.com"))
+
+	transport, err = app.newTransport(&Config{UpstreamProxy: "http://proxy.example.com:8080"})
+	r.NoError(err)
+	r.Equal("http://proxy.example.com:8080", proxyFor(transport.Proxy, "ghcr.io"))
+	r.Empty(proxyFor(transport.Proxy, "registry.internal"), "NO_PROXY must apply to the override")
+
+	_, err = app.newTransport(&Config{UpstreamProxy: "proxy.example.com"})
+	r.Error(err)
+
+	// SNI overrides can't be applied through a proxy
+	app.regs = map[string]string{"ghcr.io": "ghcr.io", "registry.internal": "registry.internal"}
+	_, err = app.newTransport(&Config{SNIOverrides: []string{"ghcr.io=example.com"}})
+	r.ErrorContains(err, "sni override for ghcr.io")
+	_, err = app.newTransport(&Config{SNIOverrides: []string{"registry.internal=example.com"}})
+	r.NoError(err)
+}
+
+func TestConnectionReuse(t *testing.T) {
+	for _, http2 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("http2=%v", http2), func(t *testing.T) {
+			r := require.New(t)
+			var conns atomic.Int32
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.EnableHTTP2 = true
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			app := newTestApp(nil)
+			transport, err := app.newTransport(&Config{
+				UpstreamHTTP2:       http2,
+				MaxIdleConnsPerHost: 8,
+				IdleConnTimeout:     time.Minute,
+			})
+			r.NoError(err)
+			r.Equal(8, transport.MaxIdleConnsPerHost)
+			r.Equal(time.Minute, transport.IdleConnTimeout)
+			transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			client := &http.Client{Transport: transport}
+			for range 3 {
+				resp, err := client.Get(srv.URL)
+				r.NoError(err)
+				_ = resp.Body.Close()
+				if http2 {
+					r.Equal(2, resp.ProtoMajor)
+				} else {
+					r.Equal(1, resp.ProtoMajor)
+				}
+			}
+			r.Equal(int32(1), conns.Load())
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/authenticvision/cachistry/httputil"
+)
+
+// maxRecordedErrorBody caps the size of each recorded error body.
+const maxRecordedErrorBody = 1024
+
+type upstreamError struct {
+	Time     time.Time `json:"time"`
+	Registry string    `json:"registry"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status,omitempty"` // zero if no response was received
+	Body     string    `json:"body"`
+}
+
+// upstreamErrors is a ring buffer of the most recent upstream failures.
+type upstreamErrors struct {
+	mu      sync.Mutex
+	entries []upstreamError
+	next    int
+	full    bool
+}
+
+func newUpstreamErrors(size int) *upstreamErrors {
+	return &upstreamErrors{entries: make([]upstreamError, size)}
+}
+
+// Record adds err to the history. Errors not caused by an HTTP response are
+// recorded without status.
+func (u *upstreamErrors) Record(registry string, path string, err error) {
+	entry := upstreamError{
+		Time:     time.Now(),
+		Registry: registry,
+		Path:     path,
+	}
+	var httpErr *httputil.Error
+	if errors.As(err, &httpErr) {
+		entry.Status = httpErr.StatusCode
+		entry.Body = httpErr.Message
+	} else {
+		entry.Body = err.Error()
+	}
+	if len(entry.Body) > maxRecordedErrorBody {
+		entry.Body = entry.Body[:maxRecordedErrorBody]
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.entries[u.next] = entry
+	u.next = (u.next + 1) % len(u.entries)
+	if u.next == 0 {
+		u.full = true
+	}
+}
+
+// List returns the recorded errors, most recent first.
+func (u *upstreamErrors) List() []upstreamError {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := u.next
+	if u.full {
+		n = len(u.entries)
+	}
+	list := make([]upstreamError, 0, n)
+	for i := range n {
+		list = append(list, u.entries[(u.next-1-i+len(u.entries))%len(u.entries)])
+	}
+	return list
+}
+
+func (app *App) listUpstreamErrors(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.upstreamErrors.List())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUpstream starts a TLS upstream registry and configures app to proxy
+// registry "test" to it.
+func newTestUpstream(t *testing.T, app *App, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	app.client = srv.Client()
+	app.regs["test"] = u.Host
+	return srv
+}
+
+func proxyRequest(app *App, path string, header http.Header) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/test/"+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetPathValue("registry", "test")
+	req.SetPathValue("path", path)
+	w := httptest.NewRecorder()
+	err := app.proxy(w, req)
+	return w, err
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.adminPassword = "secret"
+	app.upstreamErrors = newUpstreamErrors(2)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(req.URL.Path + strings.Repeat("x", 2000)))
+	})
+	for _, path := range []string{"foo/manifests/a", "foo/manifests/b", "foo/manifests/c"} {
+		w, err := proxyRequest(app, path, nil)
+		r.NoError(err)
+		r.Equal(http.StatusBadGateway, w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/upstream-errors", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.NoError(app.adminAuth(app.listUpstreamErrors)(w, req))
+	var list []upstreamError
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &list))
+	r.Len(list, 2)
+	a.Equal("foo/manifests/c", list[0].Path)
+	a.Equal("foo/manifests/b", list[1].Path)
+	a.Equal("test", list[0].Registry)
+	a.Equal(http.StatusInternalServerError, list[0].Status)
+	a.True(strings.HasPrefix(list[0].Body, "/v2/foo/manifests/c"))
+	a.Len(list[0].Body, maxRecordedErrorBody)
+}
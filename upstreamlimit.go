@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errUpstreamBusy = errors.New("too many concurrent upstream requests")
+
+// upstreamLimiter bounds the number of concurrent upstream requests, so that
+// a cold start with many concurrent pulls doesn't trip registry rate limits
+// or exhaust sockets. A nil limiter doesn't limit.
+type upstreamLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newUpstreamLimiter(maxConcurrent int, timeout time.Duration) *upstreamLimiter {
+	return &upstreamLimiter{
+		slots:   make(chan struct{}, maxConcurrent),
+		timeout: timeout,
+	}
+}
+
+// acquire waits up to the limiter's timeout for a free slot. The returned
+// function releases the slot.
+func (l *upstreamLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	requestLog(ctx).Info("waiting for a free upstream request slot")
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errUpstreamBusy
+	}
+}
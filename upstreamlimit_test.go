@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamLimiter(t *testing.T) {
+	r := require.New(t)
+	l := newUpstreamLimiter(1, 10*time.Millisecond)
+	release, err := l.acquire(t.Context())
+	r.NoError(err)
+	_, err = l.acquire(t.Context())
+	r.ErrorIs(err, errUpstreamBusy)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = l.acquire(ctx)
+	r.ErrorIs(err, context.Canceled)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release()
+	}()
+	l.timeout = time.Minute
+	release, err = l.acquire(t.Context())
+	r.NoError(err, "waiting requests must get a released slot")
+	release()
+
+	var unlimited *upstreamLimiter
+	release, err = unlimited.acquire(t.Context())
+	r.NoError(err)
+	release()
+}
+
+func TestProxyUpstreamLimit(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	app := newTestCacheApp(t)
+	app.unconditionalCacheTime = time.Hour
+	app.upstreamLimit = newUpstreamLimiter(1, 10*time.Millisecond)
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("{}"))
+	})
+	_, err := proxyRequest(app, "foo/manifests/cached", nil)
+	r.NoError(err)
+
+	release, err := app.upstreamLimit.acquire(t.Context())
+	r.NoError(err)
+	defer release()
+	w, err := proxyRequest(app, "foo/manifests/other", nil)
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, w.Code)
+	w, err = proxyRequest(app, "foo/tags/list", nil)
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, w.Code, "listings are limited, too")
+	w, err = proxyRequest(app, "foo/manifests/cached", nil)
+	r.NoError(err)
+	a.Equal(http.StatusOK, w.Code, "cache hits must bypass the limit")
+	a.Equal("{}", w.Body.String())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+// validateTimeout bounds the check of a single upstream.
+const validateTimeout = 30 * time.Second
+
+// validateUpstreams checks that every configured registry is reachable and,
+// if it challenges, hands out a token with the configured credentials. It
+// logs the outcome per registry and fails if any registry failed.
+func (app *App) validateUpstreams(ctx context.Context) error {
+	ctx = withUserAgent(withRequestID(ctx, "validate"), app.userAgent)
+	failed := 0
+	for _, registry := range slices.Sorted(maps.Keys(app.regs)) {
+		log := slog.With(slog.String("registry", registry), slog.String("upstream", app.regs[registry]))
+		upstreamURL, _ := app.upstreamAPI(registry)
+		checkCtx, cancel := context.WithTimeout(ctx, validateTimeout)
+		token, err := app.preflight(checkCtx, registry, upstreamURL)
+		cancel()
+		if err != nil {
+			log.Error("upstream check failed", slog.Any("error", err))
+			failed++
+		} else {
+			log.Info("upstream check passed", slog.Bool("authenticated", token != ""))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d upstreams failed the check", failed, len(app.regs))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUpstreams(t *testing.T) {
+	r := require.New(t)
+	app := newTestCacheApp(t)
+	var paths []string
+	newTestUpstream(t, app, func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+	})
+	r.NoError(app.validateUpstreams(t.Context()))
+	assert.Equal(t, []string{"HEAD /v2/"}, paths)
+
+	app.regs["unreachable"] = "127.0.0.1:1"
+	r.ErrorContains(app.validateUpstreams(t.Context()), "1 of 2 upstreams failed")
+}
@@ -0,0 +1,89 @@
+package wwwauth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Param is an auth parameter of a challenge.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// ParseLenient splits a challenge into its scheme and auth parameters like
+// Parse, but carries on past parts it can't make sense of, which it describes
+// in problems along with their offset in s. It is meant for diagnosing
+// challenges which Parse rejects, not for fetching tokens.
+func ParseLenient(s string) (scheme string, params []Param, problems []string) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	symbols := lex.Symbols()
+	if len(tokens) == 0 || tokens[0].Type != symbols["Token"] {
+		return "", nil, append(problems, "missing scheme")
+	}
+	scheme = tokens[0].Value
+
+	// Parameters are separated by commas, each one must be name=value.
+	var field []lexer.Token
+	flush := func() {
+		if len(field) == 0 {
+			return
+		}
+		if len(field) == 3 && field[0].Type == symbols["Token"] && field[1].Type == symbols["ValueSep"] &&
+			(field[2].Type == symbols["Token"] || field[2].Type == symbols["Value"]) {
+			params = append(params, Param{Name: field[0].Value, Value: unquote(field[2].Value)})
+		} else {
+			start := field[0].Pos.Offset
+			last := field[len(field)-1]
+			problems = append(problems, fmt.Sprintf("malformed parameter %q at offset %d", s[start:last.Pos.Offset+len(last.Value)], start))
+		}
+		field = nil
+	}
+	for _, tok := range tokens[1:] {
+		if tok.Type == symbols["FieldSep"] {
+			flush()
+		} else {
+			field = append(field, tok)
+		}
+	}
+	flush()
+	return scheme, params, problems
+}
+
+// tokenize returns the tokens of s without whitespace, up to the first part
+// which isn't a token at all, e.g. an unterminated quoted string.
+func tokenize(s string) ([]lexer.Token, error) {
+	lx, err := lex.LexString("", s)
+	if err != nil {
+		return nil, err
+	}
+	whitespace := lex.Symbols()["Whitespace"]
+	var tokens []lexer.Token
+	for {
+		tok, err := lx.Next()
+		if err != nil {
+			return tokens, err
+		} else if tok.EOF() {
+			return tokens, nil
+		} else if tok.Type != whitespace {
+			tokens = append(tokens, tok)
+		}
+	}
+}
+
+// unquote strips the quotes of quoted values, leaving tokens as they are.
+func unquote(value string) string {
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+}
@@ -2,7 +2,7 @@ package wwwauth
 
 import (
 	"fmt"
-	"log/slog"
+	"strings"
 
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
@@ -13,30 +13,42 @@ var lex = lexer.MustSimple([]lexer.SimpleRule{
 	{Name: "Whitespace", Pattern: `\s+`},
 	{Name: "FieldSep", Pattern: `,`},
 	{Name: "ValueSep", Pattern: `=`},
-	{Name: "Name", Pattern: `[a-zA-Z0-9_*.-]+`},
+	// Unquoted parameter values are tokens in RFC 9110, but registries also
+	// send e.g. URLs unquoted, so anything up to a separator is accepted.
+	{Name: "Token", Pattern: `[^\s",=]+`},
 	{Name: "Value", Pattern: `"(\\"|[^"])*"`},
 })
 
 type wwwauth struct {
-	Scheme string  `parser:"@Name"`
-	Params []param `parser:"@@ (',' @@)*"`
+	Scheme string `parser:"@Token"`
+	// A challenge carries either auth parameters or a token68 (RFC 9110,
+	// section 11.2), which is parsed but not used.
+	Params  []param `parser:"( @@ (',' @@)*"`
+	Token68 string  `parser:"| @Token @'='* )?"`
 }
 
 type param struct {
-	Field string `parser:"@Name '='"`
-	Value string `parser:"@Value"`
+	Field string `parser:"@Token '='"`
+	Value string `parser:"@(Value | Token)"`
 }
 
 var parser = participle.MustBuild[wwwauth](
 	participle.Lexer(lex),
 	participle.Elide("Whitespace"),
 	participle.Unquote("Value"),
+	participle.UseLookahead(3),
 )
 
 type WWWAuthenticate struct {
 	Realm   string
 	Service string
-	Scope   string
+	Scope   []string
+}
+
+// Key returns a string uniquely identifying the challenge, suitable as map
+// key for caching tokens.
+func (w WWWAuthenticate) Key() string {
+	return strings.Join(append([]string{w.Realm, w.Service}, w.Scope...), "\x00")
 }
 
 type Error struct {
@@ -57,13 +69,16 @@ func Parse(s string) (WWWAuthenticate, error) {
 	var ret WWWAuthenticate
 	var wwwErr Error
 	for _, p := range parsed.Params {
-		switch p.Field {
+		// Auth parameter names are case-insensitive (RFC 9110, section 11.2)
+		switch strings.ToLower(p.Field) {
 		case "realm":
 			ret.Realm = p.Value
 		case "service":
 			ret.Service = p.Value
 		case "scope":
-			ret.Scope = p.Value
+			// Challenges may repeat the scope parameter or contain several
+			// space-separated scopes in a single value.
+			ret.Scope = append(ret.Scope, strings.Fields(p.Value)...)
 		case "error":
 			wwwErr.Code = p.Value
 		case "error_description":
@@ -71,7 +86,8 @@ func Parse(s string) (WWWAuthenticate, error) {
 		case "error_uri":
 			wwwErr.URI = p.Value
 		default:
-			return WWWAuthenticate{}, logutil.NewError(nil, "unknown field", slog.String("field", p.Field))
+			// Registries may send additional parameters, which are irrelevant
+			// for fetching a token.
 		}
 	}
 	if wwwErr.Code != "" {
@@ -15,5 +15,114 @@ func TestParse(t *testing.T) {
 	r.NoError(err)
 	a.Equal(parsed.Realm, "https://auth.docker.io/token")
 	a.Equal(parsed.Service, "registry.docker.io")
-	a.Equal(parsed.Scope, "repository:library/ubuntu:pull")
+	a.Equal(parsed.Scope, []string{"repository:library/ubuntu:pull"})
+}
+
+func TestParseMixedCase(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	wwwauth := `Bearer Realm="https://auth.docker.io/token",SERVICE="registry.docker.io",scope="repository:library/ubuntu:pull"`
+	parsed, err := Parse(wwwauth)
+	r.NoError(err)
+	a.Equal(parsed.Realm, "https://auth.docker.io/token")
+	a.Equal(parsed.Service, "registry.docker.io")
+	a.Equal(parsed.Scope, []string{"repository:library/ubuntu:pull"})
+}
+
+func TestParseUnknownFields(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	wwwauth := `Bearer realm="https://auth.example.com/token",charset="UTF-8",service="registry.example.com",x-extra="foo",scope="repository:foo/bar:pull"`
+	parsed, err := Parse(wwwauth)
+	r.NoError(err)
+	a.Equal(parsed.Realm, "https://auth.example.com/token")
+	a.Equal(parsed.Service, "registry.example.com")
+	a.Equal(parsed.Scope, []string{"repository:foo/bar:pull"})
+}
+
+func TestParseError(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	wwwauth := `Bearer realm="https://auth.docker.io/token",Error="insufficient_scope",error_description="access denied"`
+	_, err := Parse(wwwauth)
+	var wwwErr Error
+	r.ErrorAs(err, &wwwErr)
+	a.Equal(wwwErr.Code, "insufficient_scope")
+	a.Equal(wwwErr.Description, "access denied")
+}
+
+func TestParseMultipleScopes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	wwwauth := `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull",scope="repository:foo/baz:pull repository:foo/qux:pull,push"`
+	parsed, err := Parse(wwwauth)
+	r.NoError(err)
+	a.Equal(parsed.Scope, []string{
+		"repository:foo/bar:pull",
+		"repository:foo/baz:pull",
+		"repository:foo/qux:pull,push",
+	})
+}
+
+func TestKey(t *testing.T) {
+	a := assert.New(t)
+	base := WWWAuthenticate{Realm: "https://auth.example.com/token", Service: "registry.example.com"}
+	one := base
+	one.Scope = []string{"repository:foo/bar:pull"}
+	two := base
+	two.Scope = []string{"repository:foo/bar:pull", "repository:foo/baz:pull"}
+	a.NotEqual(base.Key(), one.Key())
+	a.NotEqual(one.Key(), two.Key())
+	a.Equal(two.Key(), WWWAuthenticate{
+		Realm:   base.Realm,
+		Service: base.Service,
+		Scope:   []string{"repository:foo/bar:pull", "repository:foo/baz:pull"},
+	}.Key())
+}
+
+func TestParseUnquoted(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	wwwauth := `Bearer realm=https://auth.example.com/token, service="registry.example.com",scope=repository:foo/bar:pull`
+	parsed, err := Parse(wwwauth)
+	r.NoError(err)
+	a.Equal("https://auth.example.com/token", parsed.Realm)
+	a.Equal("registry.example.com", parsed.Service)
+	a.Equal([]string{"repository:foo/bar:pull"}, parsed.Scope)
+}
+
+func TestParseToken68(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	for _, wwwauth := range []string{`Negotiate abc+/def==`, `Negotiate abc`} {
+		parsed, err := Parse(wwwauth)
+		r.NoError(err, wwwauth)
+		a.Empty(parsed.Realm, wwwauth)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	a := assert.New(t)
+	challenge := `Bearer realm="https://auth.example.com/token",service=registry.example.com,scope,foo=bar=baz,scope="repository:a/b:pull"`
+	_, err := Parse(challenge)
+	a.Error(err)
+	scheme, params, problems := ParseLenient(challenge)
+	a.Equal("Bearer", scheme)
+	a.Equal([]Param{
+		{Name: "realm", Value: "https://auth.example.com/token"},
+		{Name: "service", Value: "registry.example.com"},
+		{Name: "scope", Value: "repository:a/b:pull"},
+	}, params)
+	a.Equal([]string{
+		`malformed parameter "scope" at offset 75`,
+		`malformed parameter "foo=bar=baz" at offset 81`,
+	}, problems)
+
+	scheme, params, problems = ParseLenient(`Bearer realm="https://auth.example.com/token",service="unterminated`)
+	a.Equal("Bearer", scheme)
+	a.Equal([]Param{{Name: "realm", Value: "https://auth.example.com/token"}}, params)
+	a.Len(problems, 2)
+
+	_, _, problems = ParseLenient(``)
+	a.Equal([]string{"missing scheme"}, problems)
 }